@@ -63,6 +63,43 @@ func (c *Client) Login(username string, password string) (string, error) {
 	}
 }
 
+func (c *Client) SearchServices(catalog string, text string, tags []string) (*api.SearchResult, error) {
+
+	params := url.Values{}
+	if catalog != "" {
+		params.Set("catalog", catalog)
+	}
+	if text != "" {
+		params.Set("q", text)
+	}
+	for _, tag := range tags {
+		params.Add("tag", tag)
+	}
+	request, err := http.NewRequest("GET", c.BasePath+"services/search?"+params.Encode(), nil)
+
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	resp, err := c.HttpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusOK {
+
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		result := api.SearchResult{}
+		json.Unmarshal([]byte(body), &result)
+		return &result, nil
+	} else {
+		err := errors.New(resp.Status)
+		return nil, err
+	}
+}
+
 func (c *Client) ListServices(catalog string) (*[]api.ServiceSpec, error) {
 
 	url := c.BasePath + "services"
@@ -153,6 +190,34 @@ func (c *Client) GetService(name string) (*api.ServiceSpec, error) {
 	return nil, nil
 }
 
+func (c *Client) GetServiceGraph(name string) (*api.ServiceGraph, error) {
+
+	url := c.BasePath + "services/" + name + "/graph"
+
+	request, err := http.NewRequest("GET", url, nil)
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+
+	resp, err := c.HttpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusOK {
+
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		graph := api.ServiceGraph{}
+		json.Unmarshal([]byte(body), &graph)
+		return &graph, nil
+	} else {
+		return nil, errors.New(resp.Status)
+	}
+}
+
 func (c *Client) ListStacks() (*[]api.Stack, error) {
 
 	url := c.BasePath + "stacks"
@@ -203,6 +268,8 @@ func (c *Client) AddStack(stack *api.Stack) (*api.Stack, error) {
 			json.Unmarshal([]byte(body), &stack)
 			return &stack, nil
 
+		} else if resp.StatusCode == http.StatusBadRequest {
+			return nil, validationError(resp)
 		} else {
 			return nil, errors.New(resp.Status)
 		}
@@ -210,7 +277,46 @@ func (c *Client) AddStack(stack *api.Stack) (*api.Stack, error) {
 	return nil, nil
 }
 
-func (c *Client) UpdateStack(stack *api.Stack) error {
+// CloneStack creates a stopped copy of the stack
+func (c *Client) CloneStack(sid string, clone *api.StackClone) (*api.Stack, error) {
+
+	url := c.BasePath + "stacks/" + sid + "/clone"
+
+	data, err := json.Marshal(clone)
+	request, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	resp, err := c.HttpClient.Do(request)
+	if err != nil {
+		return nil, err
+	} else {
+		if resp.StatusCode == http.StatusOK {
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return nil, err
+			}
+
+			stack := api.Stack{}
+			err = json.Unmarshal([]byte(body), &stack)
+			if err != nil {
+				return nil, err
+			}
+			return &stack, nil
+
+		} else if resp.StatusCode == http.StatusBadRequest {
+			return nil, validationError(resp)
+		} else if resp.StatusCode == http.StatusConflict {
+			return nil, conflictError(resp)
+		} else {
+			return nil, errors.New(resp.Status)
+		}
+	}
+}
+
+// UpdateStack saves the stack. Changes to a running stack are applied by
+// the operation returned, which is nil for a stopped stack.
+func (c *Client) UpdateStack(stack *api.Stack) (*api.Operation, error) {
 
 	url := c.BasePath + "stacks/" + stack.Id
 
@@ -220,21 +326,39 @@ func (c *Client) UpdateStack(stack *api.Stack) error {
 	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
 	resp, err := c.HttpClient.Do(request)
 	if err != nil {
-		return err
+		return nil, err
 	} else {
 		if resp.StatusCode == http.StatusOK {
 			defer resp.Body.Close()
 			body, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			stack := api.Stack{}
 			json.Unmarshal([]byte(body), &stack)
-			return nil
+			return nil, nil
 
+		} else if resp.StatusCode == http.StatusAccepted {
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return nil, err
+			}
+
+			operation := api.Operation{}
+			err = json.Unmarshal([]byte(body), &operation)
+			if err != nil {
+				return nil, err
+			}
+			return &operation, nil
+
+		} else if resp.StatusCode == http.StatusBadRequest {
+			return nil, validationError(resp)
+		} else if resp.StatusCode == http.StatusConflict {
+			return nil, conflictError(resp)
 		} else {
-			return errors.New(resp.Status)
+			return nil, errors.New(resp.Status)
 		}
 	}
 }
@@ -362,12 +486,81 @@ func (c *Client) AddService(service *api.ServiceSpec, token string, catalog stri
 			service := api.ServiceSpec{}
 			json.Unmarshal([]byte(body), &service)
 			return &service, nil
+		} else if resp.StatusCode == http.StatusBadRequest {
+			return nil, validationError(resp)
 		} else {
 			return nil, errors.New(resp.Status)
 		}
 	}
 }
 
+// Returns the field errors of a 400 response with a validation result as a
+// single error, or just the status otherwise
+func validationError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	result := api.ValidationResult{}
+	if json.Unmarshal([]byte(body), &result) == nil && len(result.Errors) > 0 {
+		messages := []string{resp.Status}
+		for _, e := range result.Errors {
+			messages = append(messages, fmt.Sprintf("%s: %s", e.Field, e.Message))
+		}
+		return errors.New(strings.Join(messages, "\n"))
+	}
+	return errors.New(resp.Status)
+}
+
+// conflictError returns the reason the server gave for a conflict, if any
+func conflictError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		Error string
+	}{}
+	if json.Unmarshal([]byte(body), &result) == nil && result.Error != "" {
+		return errors.New(result.Error)
+	}
+	return errors.New(resp.Status)
+}
+
+func (c *Client) ImportCompose(data []byte, prefix string) (*api.ImportResult, error) {
+
+	params := url.Values{}
+	if prefix != "" {
+		params.Set("prefix", prefix)
+	}
+
+	request, err := http.NewRequest("POST", c.BasePath+"services/import/compose?"+params.Encode(), bytes.NewBuffer(data))
+	request.Header.Set("Content-Type", "application/x-yaml")
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	resp, err := c.HttpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		result := api.ImportResult{}
+		json.Unmarshal([]byte(body), &result)
+		return &result, nil
+	} else {
+		return nil, errors.New(resp.Status + ": " + strings.TrimSpace(string(body)))
+	}
+}
+
 func (c *Client) DeleteService(service string, token string, catalog string) error {
 
 	url := c.BasePath + "services/" + service
@@ -447,6 +640,133 @@ func (c *Client) DeleteStack(stackKey string) error {
 	return nil
 }
 
+func (c *Client) ListTemplates() (*[]api.StackTemplate, error) {
+
+	url := c.BasePath + "templates"
+
+	request, err := http.NewRequest("GET", url, nil)
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	resp, err := c.HttpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusOK {
+
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		templates := make([]api.StackTemplate, 0)
+		json.Unmarshal([]byte(body), &templates)
+		return &templates, nil
+	} else {
+		return nil, errors.New(resp.Status)
+	}
+}
+
+// SaveStackTemplate saves a template from the stack's services
+func (c *Client) SaveStackTemplate(sid string, template *api.StackTemplate) (*api.StackTemplate, error) {
+	return c.postTemplate(c.BasePath+"stacks/"+sid+"/template", "POST", template)
+}
+
+// ShareTemplate creates a new link to the template, or removes the link if
+// revoke is set
+func (c *Client) ShareTemplate(id string, revoke bool) (*api.StackTemplate, error) {
+	return c.postTemplate(fmt.Sprintf("%stemplates/%s/share?revoke=%t", c.BasePath, id, revoke), "PUT", nil)
+}
+
+func (c *Client) PublishTemplate(id string, revoke bool) (*api.StackTemplate, error) {
+	return c.postTemplate(fmt.Sprintf("%stemplates/%s/publish?revoke=%t", c.BasePath, id, revoke), "PUT", nil)
+}
+
+func (c *Client) postTemplate(url string, method string, template *api.StackTemplate) (*api.StackTemplate, error) {
+
+	data, err := json.Marshal(template)
+	request, err := http.NewRequest(method, url, bytes.NewBuffer(data))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	resp, err := c.HttpClient.Do(request)
+	if err != nil {
+		return nil, err
+	} else {
+		if resp.StatusCode == http.StatusOK {
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return nil, err
+			}
+
+			template := api.StackTemplate{}
+			err = json.Unmarshal([]byte(body), &template)
+			if err != nil {
+				return nil, err
+			}
+			return &template, nil
+
+		} else if resp.StatusCode == http.StatusBadRequest {
+			return nil, validationError(resp)
+		} else {
+			return nil, errors.New(resp.Status)
+		}
+	}
+}
+
+// InstantiateTemplate creates a stack from the template
+func (c *Client) InstantiateTemplate(id string, instance *api.TemplateInstance) (*api.Stack, error) {
+
+	url := c.BasePath + "templates/" + id + "/instantiate"
+
+	data, err := json.Marshal(instance)
+	request, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	resp, err := c.HttpClient.Do(request)
+	if err != nil {
+		return nil, err
+	} else {
+		if resp.StatusCode == http.StatusOK {
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return nil, err
+			}
+
+			stack := api.Stack{}
+			err = json.Unmarshal([]byte(body), &stack)
+			if err != nil {
+				return nil, err
+			}
+			return &stack, nil
+
+		} else if resp.StatusCode == http.StatusBadRequest {
+			return nil, validationError(resp)
+		} else {
+			return nil, errors.New(resp.Status)
+		}
+	}
+}
+
+func (c *Client) DeleteTemplate(id string) error {
+
+	url := c.BasePath + "templates/" + id
+
+	request, err := http.NewRequest("DELETE", url, nil)
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	resp, err := c.HttpClient.Do(request)
+	if err != nil {
+		return err
+	} else {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.New(resp.Status)
+		}
+	}
+	return nil
+}
+
 func (c *Client) GetStack(sid string) (*api.Stack, error) {
 	url := c.BasePath + "stacks/" + sid
 
@@ -478,6 +798,30 @@ func (c *Client) GetStack(sid string) (*api.Stack, error) {
 	}
 }
 
+func (c *Client) ExportStack(sid string, format string) ([]byte, error) {
+	url := c.BasePath + "stacks/" + sid + "/export?format=" + format
+
+	request, err := http.NewRequest("GET", url, nil)
+
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	resp, err := c.HttpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		return body, nil
+	} else {
+		return nil, errors.New(resp.Status)
+	}
+}
+
 func (c *Client) GetLogs(sid string, lines int) (string, error) {
 
 	url := c.BasePath + "logs/" + sid
@@ -507,9 +851,39 @@ func (c *Client) GetLogs(sid string, lines int) (string, error) {
 	}
 }
 
-func (c *Client) StartStack(stack string) (*api.Stack, error) {
+func (c *Client) StartStack(stack string) (*api.Operation, error) {
+	return c.stackOperation("start/", stack)
+}
+
+func (c *Client) StopStack(stack string) (*api.Operation, error) {
+	return c.stackOperation("stop/", stack)
+}
 
-	url := c.BasePath + "start/" + stack
+func (c *Client) RestartStack(stack string) (*api.Operation, error) {
+	return c.stackOperation("restart/", stack)
+}
+
+// StartStackService starts a service of a started stack, and the stopped
+// services that depend on it if cascade is set
+func (c *Client) StartStackService(ssid string, cascade bool) (*api.Operation, error) {
+	return c.stackOperation("start/", fmt.Sprintf("%s?cascade=%t", ssid, cascade))
+}
+
+// StopStackService stops a service of a stack, and the services that depend
+// on it if cascade is set
+func (c *Client) StopStackService(ssid string, cascade bool) (*api.Operation, error) {
+	return c.stackOperation("stop/", fmt.Sprintf("%s?cascade=%t", ssid, cascade))
+}
+
+// RestartStackService restarts a service of a stack, and the services that
+// depend on it if cascade is set
+func (c *Client) RestartStackService(ssid string, cascade bool) (*api.Operation, error) {
+	return c.stackOperation("restart/", fmt.Sprintf("%s?cascade=%t", ssid, cascade))
+}
+
+func (c *Client) stackOperation(path string, id string) (*api.Operation, error) {
+
+	url := c.BasePath + path + id
 
 	request, err := http.NewRequest("GET", url, nil)
 	request.Header.Set("Content-Type", "application/json")
@@ -518,31 +892,37 @@ func (c *Client) StartStack(stack string) (*api.Stack, error) {
 	if err != nil {
 		return nil, err
 	} else {
-		if resp.StatusCode == http.StatusOK {
+		if resp.StatusCode == http.StatusAccepted {
 			defer resp.Body.Close()
 			body, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
 				return nil, err
 			}
 
-			stack := api.Stack{}
-			err = json.Unmarshal([]byte(body), &stack)
+			operation := api.Operation{}
+			err = json.Unmarshal([]byte(body), &operation)
 			if err != nil {
 				return nil, err
 			}
 
-			return &stack, nil
+			return &operation, nil
+		} else if resp.StatusCode == http.StatusBadRequest {
+			return nil, validationError(resp)
+		} else if resp.StatusCode == http.StatusConflict {
+			return nil, conflictError(resp)
 		} else {
 			return nil, errors.New(resp.Status)
 		}
 	}
 }
 
-func (c *Client) StopStack(stack string) (*api.Stack, error) {
-	url := c.BasePath + "stop/" + stack
+// GetOperation returns the operation, waiting up to wait seconds for it to
+// complete if it is running
+func (c *Client) GetOperation(id string, wait int) (*api.Operation, error) {
+
+	url := fmt.Sprintf("%soperations/%s?wait=%d", c.BasePath, id, wait)
 
 	request, err := http.NewRequest("GET", url, nil)
-	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
 	resp, err := c.HttpClient.Do(request)
 	if err != nil {
@@ -555,13 +935,13 @@ func (c *Client) StopStack(stack string) (*api.Stack, error) {
 				return nil, err
 			}
 
-			stack := api.Stack{}
-			err = json.Unmarshal([]byte(body), &stack)
+			operation := api.Operation{}
+			err = json.Unmarshal([]byte(body), &operation)
 			if err != nil {
 				return nil, err
 			}
-			return &stack, nil
 
+			return &operation, nil
 		} else {
 			return nil, errors.New(resp.Status)
 		}
@@ -5,10 +5,12 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/ghodss/yaml"
 	api "github.com/ndslabs/apiserver/types"
 	"github.com/spf13/cobra"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"text/tabwriter"
 )
@@ -32,10 +34,10 @@ func init() {
 	// add stack flags
 	addStackCmd.Flags().StringVar(&opts, "opt", "", "Comma-delimited list of optional services")
 
-	addAccountCmd.Flags().StringVarP(&file, "file", "f", "", "Path to account definition (json)")
+	addAccountCmd.Flags().StringVarP(&file, "file", "f", "", "Path to account definition (json or yaml)")
 
-	addServiceCmd.Flags().StringVarP(&file, "file", "f", "", "Path to service definition (json)")
-	addServiceCmd.Flags().StringVar(&dir, "dir", "", "Path to directory of service definitions (json)")
+	addServiceCmd.Flags().StringVarP(&file, "file", "f", "", "Path to service definition (json or yaml)")
+	addServiceCmd.Flags().StringVar(&dir, "dir", "", "Path to directory of service definitions (json or yaml)")
 	addServiceCmd.Flags().StringVarP(&catalog, "catalog", "c", "user", "Catalog to use")
 	addServiceCmd.Flags().BoolVarP(&update, "update", "u", false, "Update existing service")
 
@@ -59,7 +61,11 @@ var addAccountCmd = &cobra.Command{
 				fmt.Printf("Error reading account file: %s\n", err.Error())
 				os.Exit(-1)
 			}
-			json.Unmarshal(data, &account)
+			err = yaml.Unmarshal(data, &account)
+			if err != nil {
+				fmt.Printf("Error reading account file: %s\n", err.Error())
+				os.Exit(-1)
+			}
 		} else if len(args) == 2 {
 			account.Id = args[0]
 			account.Name = args[0]
@@ -101,11 +107,13 @@ func addServiceFile(path string, catalog string) error {
 		return err
 	}
 
-	if len(path) > 4 && path[len(path)-4:len(path)] != "json" {
-		fmt.Println("Expecting extension .json")
+	ext := filepath.Ext(path)
+	if ext != ".json" && ext != ".yaml" && ext != ".yml" {
+		fmt.Println("Expecting extension .json, .yaml or .yml")
 		return nil
 	}
-	err = json.Unmarshal(data, &service)
+	// YAML is a superset of JSON
+	err = yaml.Unmarshal(data, &service)
 	if err != nil {
 		fmt.Println(err)
 		return err
@@ -185,11 +193,14 @@ var addMountCmd = &cobra.Command{
 		if !ssidFound {
 			fmt.Printf("No such stack service id %s\n", ssid)
 		}
-		err = client.UpdateStack(stack)
+		operation, err := client.UpdateStack(stack)
 		if err != nil {
 			fmt.Printf("Error updating stack: %s\n", err)
 			return
 		}
+		if operation != nil {
+			printChanges(operation)
+		}
 		if Verbose {
 			data, err := json.MarshalIndent(stack, "", "   ")
 			if err != nil {
@@ -255,24 +266,14 @@ func contains(s []string, e string) bool {
 	return false
 }
 
-func addRequiredDependencies(stackKey string, stack *api.Stack) {
-
-	service, _ := client.GetService(stackKey)
-
-	if service != nil {
-		for _, depends := range service.Dependencies {
-			if depends.Required {
-				stackService := api.StackService{}
-				stackService.Service = depends.DependencyKey
-				if !containsService(stack.Services, stackService) {
-					stack.Services = append(stack.Services, stackService)
-					//fmt.Printf("Adding required dependency %s\n", depends.DependencyKey)
-					addRequiredDependencies(depends.DependencyKey, stack)
-				}
-			}
+// Add services to the stack, skipping any that are already present
+func addStackServices(stack *api.Stack, keys []string) {
+	for _, key := range keys {
+		stackService := api.StackService{}
+		stackService.Service = key
+		if !containsService(stack.Services, stackService) {
+			stack.Services = append(stack.Services, stackService)
 		}
-	} else {
-		fmt.Printf("Warning: unable to find service with key %s\n", stackKey)
 	}
 }
 
@@ -296,23 +297,26 @@ func addStack(serviceKey string, name string, opt string) {
 	}
 	optional := strings.Split(opt, ",")
 
-	// Add this service
+	// Add this service and everything it requires
+	graph, err := client.GetServiceGraph(serviceKey)
+	if err != nil {
+		fmt.Printf("Error adding stack: %s\n", err)
+		return
+	}
+
 	stack := api.Stack{}
 	stack.Key = serviceKey
 	stack.Name = name
-
-	stackService := api.StackService{}
-	stackService.Service = serviceKey
-	stack.Services = append(stack.Services, stackService)
-
-	addRequiredDependencies(serviceKey, &stack)
+	addStackServices(&stack, append([]string{serviceKey}, graph.Required...))
 
 	for _, depends := range service.Dependencies {
-		if contains(optional, depends.DependencyKey) {
-			stackService = api.StackService{}
-			stackService.Service = depends.DependencyKey
-			stack.Services = append(stack.Services, stackService)
-			addRequiredDependencies(depends.DependencyKey, &stack)
+		if !depends.Required && contains(optional, depends.DependencyKey) {
+			depGraph, err := client.GetServiceGraph(depends.DependencyKey)
+			if err != nil {
+				fmt.Printf("Error adding stack: %s\n", err)
+				return
+			}
+			addStackServices(&stack, append([]string{depends.DependencyKey}, depGraph.Required...))
 		}
 	}
 
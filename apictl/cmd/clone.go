@@ -0,0 +1,46 @@
+// Copyright © 2016 National Data Service
+
+package cmd
+
+import (
+	"fmt"
+	api "github.com/ndslabs/apiserver/types"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var (
+	cloneName    string
+	cloneVolumes string
+)
+
+// cloneCmd represents the clone command
+var cloneCmd = &cobra.Command{
+	Use:    "clone [stackId]",
+	Short:  "Create a copy of a stack",
+	PreRun: Connect,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if len(args) == 0 {
+			cmd.Usage()
+			os.Exit(-1)
+		}
+
+		sid := args[0]
+
+		clone := api.StackClone{Name: cloneName, Volumes: api.CloneVolumes(cloneVolumes)}
+		stack, err := client.CloneStack(sid, &clone)
+		if err != nil {
+			fmt.Printf("Error cloning %s: %s\n", sid, err)
+			return
+		}
+		fmt.Printf("Cloned %s as %s (%s)\n", sid, stack.Id, stack.Name)
+	},
+	PostRun: RefreshToken,
+}
+
+func init() {
+	RootCmd.AddCommand(cloneCmd)
+	cloneCmd.Flags().StringVar(&cloneName, "name", "", "Name of the copy (default the stack's name with \"(copy)\")")
+	cloneCmd.Flags().StringVar(&cloneVolumes, "volumes", "new", "Data for the copy: share the stack's AppData folders, copy them or start with new ones (share, copy, new)")
+}
@@ -0,0 +1,65 @@
+// Copyright © 2016 National Data Service
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	format string
+	output string
+)
+
+func init() {
+	RootCmd.AddCommand(exportCmd)
+	exportCmd.AddCommand(exportStackCmd)
+
+	exportStackCmd.Flags().StringVar(&format, "format", "k8s", "Output format (k8s, compose)")
+	exportStackCmd.Flags().StringVarP(&output, "output", "o", "", "Output file (default <stackId>.yaml or docker-compose.yml)")
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export [resource] [args]",
+	Short: "Export a resource",
+}
+
+var exportStackCmd = &cobra.Command{
+	Use:    "stack [stackId]",
+	Short:  "Export a stack as Kubernetes manifests or a docker-compose file",
+	PreRun: Connect,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			cmd.Usage()
+			os.Exit(-1)
+		}
+		exportStack(args[0], format, output)
+	},
+	PostRun: RefreshToken,
+}
+
+func exportStack(sid string, format string, path string) {
+	data, err := client.ExportStack(sid, format)
+	if err != nil {
+		fmt.Printf("Error exporting stack %s: %s\n", sid, err)
+		return
+	}
+
+	if path == "" {
+		path = sid + ".yaml"
+		if format == "compose" {
+			path = "docker-compose.yml"
+		}
+	}
+
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		fmt.Printf("Error writing %s: %s\n", path, err)
+		return
+	}
+	fmt.Println("Exported stack " + sid + " to " + path)
+}
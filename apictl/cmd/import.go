@@ -0,0 +1,126 @@
+// Copyright © 2016 National Data Service
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ndslabs/apiserver/graph"
+	api "github.com/ndslabs/apiserver/types"
+	"github.com/spf13/cobra"
+)
+
+var (
+	prefix    string
+	addImport bool
+)
+
+func init() {
+	RootCmd.AddCommand(importCmd)
+	importCmd.AddCommand(importComposeCmd)
+
+	importComposeCmd.Flags().StringVarP(&file, "file", "f", "docker-compose.yml", "Path to docker-compose file")
+	importComposeCmd.Flags().StringVar(&prefix, "prefix", "", "Prefix for generated service keys")
+	importComposeCmd.Flags().StringVar(&dir, "dir", "", "Write service definitions (json) to this directory")
+	importComposeCmd.Flags().BoolVar(&addImport, "add", false, "Add the services to the catalog")
+	importComposeCmd.Flags().StringVarP(&catalog, "catalog", "c", "user", "Catalog to use")
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import [format]",
+	Short: "Convert definitions from other formats to services",
+}
+
+var importComposeCmd = &cobra.Command{
+	Use:    "compose",
+	Short:  "Convert a docker-compose file to service definitions",
+	PreRun: Connect,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Printf("Error reading compose file: %s\n", err)
+			os.Exit(-1)
+		}
+
+		result, err := client.ImportCompose(data, prefix)
+		if err != nil {
+			fmt.Printf("Error importing %s: %s\n", file, err)
+			os.Exit(-1)
+		}
+
+		for _, warning := range result.Warnings {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+		}
+
+		if len(dir) > 0 {
+			writeServices(result.Services, dir)
+		}
+		if addImport {
+			addServices(result.Services, catalog)
+		}
+		if len(dir) == 0 && !addImport {
+			data, _ := json.MarshalIndent(result.Services, "", "   ")
+			fmt.Println(string(data))
+		}
+	},
+	PostRun: RefreshToken,
+}
+
+func writeServices(services []api.ServiceSpec, path string) {
+	os.MkdirAll(path, 0755)
+	for _, service := range services {
+		data, _ := json.MarshalIndent(service, "", "   ")
+		name := filepath.Join(path, service.Key+".json")
+		err := ioutil.WriteFile(name, data, 0644)
+		if err != nil {
+			fmt.Printf("Error writing %s: %s\n", name, err)
+		} else {
+			fmt.Println("Wrote " + name)
+		}
+	}
+}
+
+// Add services to the catalog, dependencies first
+func addServices(services []api.ServiceSpec, catalog string) {
+	specs := map[string]*api.ServiceSpec{}
+	keys := []string{}
+	for i := range services {
+		specs[services[i].Key] = &services[i]
+		keys = append(keys, services[i].Key)
+	}
+
+	deps, err := graph.New(keys, func(key string) *api.ServiceSpec { return specs[key] })
+	if err != nil {
+		fmt.Printf("Unable to add services: %s\n", err)
+		return
+	}
+	order, err := deps.StartOrder()
+	if err != nil {
+		fmt.Printf("Unable to add services: %s\n", err)
+		return
+	}
+
+	token := client.Token
+	if catalog == "system" {
+		password := credentials("Admin password: ")
+		token, err = client.Login("admin", password)
+		if err != nil {
+			fmt.Printf("Unable to add services: %s\n", err)
+			return
+		}
+	}
+
+	for _, key := range order {
+		_, err := client.AddService(specs[key], token, catalog, false)
+		if err != nil {
+			fmt.Printf("Unable to add service %s: %s\n", key, err)
+			return
+		}
+		fmt.Println("Added service " + key)
+	}
+}
@@ -5,11 +5,17 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
+	api "github.com/ndslabs/apiserver/types"
 	"github.com/spf13/cobra"
 	"os"
 	"text/tabwriter"
 )
 
+var (
+	searchText string
+	searchTags []string
+)
+
 // listCmd represents the list command
 var listCmd = &cobra.Command{
 	Use:   "list",
@@ -22,10 +28,23 @@ var listServicesCmd = &cobra.Command{
 	PreRun: Connect,
 	Run: func(cmd *cobra.Command, args []string) {
 
-		services, err := client.ListServices(catalog)
-		if err != nil {
-			fmt.Printf("Error listing services: %s\n", err)
-			return
+		var services *[]api.ServiceSpec
+		var facets []api.Facet
+		if searchText != "" || len(searchTags) > 0 {
+			result, err := client.SearchServices(catalog, searchText, searchTags)
+			if err != nil {
+				fmt.Printf("Error searching services: %s\n", err)
+				return
+			}
+			services = &result.Services
+			facets = result.Facets
+		} else {
+			var err error
+			services, err = client.ListServices(catalog)
+			if err != nil {
+				fmt.Printf("Error listing services: %s\n", err)
+				return
+			}
 		}
 
 		w := new(tabwriter.Writer)
@@ -44,6 +63,20 @@ var listServicesCmd = &cobra.Command{
 			}
 		}
 		w.Flush()
+
+		if len(facets) > 0 {
+			fmt.Println()
+			w.Init(os.Stdout, 15, 4, 3, ' ', 0)
+			fmt.Fprintln(w, "TAG\tSERVICES")
+			for _, facet := range facets {
+				name := facet.Name
+				if name == "" {
+					name = facet.Id
+				}
+				fmt.Fprintf(w, "%s\t%d\n", name, facet.Count)
+			}
+			w.Flush()
+		}
 	},
 	PostRun: RefreshToken,
 }
@@ -159,6 +192,8 @@ func init() {
 	RootCmd.AddCommand(listCmd)
 
 	listServicesCmd.Flags().StringVarP(&catalog, "catalog", "c", "user", "Catalog to use")
+	listServicesCmd.Flags().StringVar(&searchText, "search", "", "Only list services matching the text")
+	listServicesCmd.Flags().StringSliceVar(&searchTags, "tag", []string{}, "Only list services with the tag (repeatable)")
 
 	listCmd.AddCommand(listServicesCmd)
 	listCmd.AddCommand(listStacksCmd)
@@ -0,0 +1,62 @@
+// Copyright © 2016 National Data Service
+
+package cmd
+
+import (
+	"fmt"
+	api "github.com/ndslabs/apiserver/types"
+	"sort"
+)
+
+// Follow the operation until it completes, printing each change in the
+// status of its services
+func waitOperation(operation *api.Operation) {
+	statuses := map[string]string{}
+	for {
+		for _, service := range operation.Services {
+			status := service.Status
+			if service.Message != "" {
+				status = fmt.Sprintf("%s (%s)", service.Status, service.Message)
+			}
+			if statuses[service.Service] != status {
+				statuses[service.Service] = status
+				fmt.Printf("%-20s %s\n", service.Service, status)
+			}
+		}
+		if operation.Phase != api.OperationRunning {
+			break
+		}
+
+		next, err := client.GetOperation(operation.Id, 10)
+		if err != nil {
+			fmt.Printf("Error getting operation %s: %s\n", operation.Id, err)
+			return
+		}
+		operation = next
+	}
+
+	target := "Stack " + operation.Stack
+	if operation.StackService != "" {
+		target = "Service " + operation.StackService
+	}
+	if operation.Phase == api.OperationSucceeded {
+		fmt.Printf("%s %s succeeded\n", target, operation.Type)
+	} else {
+		fmt.Printf("%s %s failed: %s\n", target, operation.Type, operation.Error)
+	}
+}
+
+// Print the changes being applied to a running stack
+func printChanges(operation *api.Operation) {
+	ssids := []string{}
+	for ssid := range operation.Changes {
+		ssids = append(ssids, ssid)
+	}
+	sort.Strings(ssids)
+	for _, ssid := range ssids {
+		for _, change := range operation.Changes[ssid] {
+			fmt.Printf("%s %s: %v -> %v\n", ssid, change.Field, change.Old, change.New)
+		}
+	}
+	fmt.Printf("Applying changes to %s (operation %s)\n", operation.Stack, operation.Id)
+}
@@ -0,0 +1,48 @@
+// Copyright © 2016 National Data Service
+
+package cmd
+
+import (
+	"fmt"
+	api "github.com/ndslabs/apiserver/types"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+// restartCmd represents the restart command
+var restartCmd = &cobra.Command{
+	Use:    "restart [stackName|stackServiceId]",
+	Short:  "Restart a stack or one of its services",
+	PreRun: Connect,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if len(args) == 0 {
+			cmd.Usage()
+			os.Exit(-1)
+		}
+
+		stackId := args[0]
+
+		var operation *api.Operation
+		var err error
+		if strings.Contains(stackId, "-") {
+			operation, err = client.RestartStackService(stackId, cascade)
+		} else {
+			operation, err = client.RestartStack(stackId)
+		}
+		if err != nil {
+			fmt.Printf("Error restarting %s: %s\n", stackId, err)
+		} else if wait {
+			waitOperation(operation)
+		} else {
+			fmt.Printf("Restarting %s (operation %s)\n", stackId, operation.Id)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(restartCmd)
+	restartCmd.Flags().BoolVar(&cascade, "cascade", false, "Include the services that depend on the service")
+	restartCmd.Flags().BoolVar(&wait, "wait", false, "Wait for the stack or service to restart, showing the progress of each service")
+}
@@ -5,9 +5,19 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
+	api "github.com/ndslabs/apiserver/types"
+	validation "github.com/ndslabs/apiserver/validation"
 	"github.com/spf13/cobra"
 	"os"
 	"strings"
+	"time"
+)
+
+var (
+	scheduleStart      string
+	scheduleStop       string
+	scheduleMaxRuntime time.Duration
+	scheduleClear      bool
 )
 
 // listCmd represents the list command
@@ -19,6 +29,12 @@ var setCmd = &cobra.Command{
 func init() {
 	RootCmd.AddCommand(setCmd)
 	setCmd.AddCommand(setEnvCmd)
+	setCmd.AddCommand(setScheduleCmd)
+
+	setScheduleCmd.Flags().StringVar(&scheduleStart, "start", "", "Cron expression for starting the stack, e.g. \"0 9 * * 1-5\"")
+	setScheduleCmd.Flags().StringVar(&scheduleStop, "stop", "", "Cron expression for stopping the stack, e.g. \"0 18 * * *\"")
+	setScheduleCmd.Flags().DurationVar(&scheduleMaxRuntime, "max-runtime", 0, "Stop the stack after it has run this long, e.g. 8h")
+	setScheduleCmd.Flags().BoolVar(&scheduleClear, "clear", false, "Remove the stack's schedule")
 }
 
 var setEnvCmd = &cobra.Command{
@@ -59,14 +75,17 @@ var setEnvCmd = &cobra.Command{
 				found := false
 				for _, config := range spec.Config {
 					if config.Name == varName {
-						if config.CanOverride {
-							fmt.Printf("%s %s %t\n", varName, varValue, config.CanOverride)
-							stackService.Config[varName] = varValue
-							found = true
-						} else {
+						if !config.CanOverride {
 							fmt.Printf("Cannot override variable %s\n", varName)
 							return
 						}
+						if err := validation.ValidateConfigValue(&config, varValue); err != nil {
+							fmt.Printf("Invalid value for %s: %s\n", varName, err)
+							return
+						}
+						fmt.Printf("%s %s %t\n", varName, varValue, config.CanOverride)
+						stackService.Config[varName] = varValue
+						found = true
 					}
 				}
 				if !found {
@@ -80,11 +99,14 @@ var setEnvCmd = &cobra.Command{
 		if !ssidFound {
 			fmt.Printf("No such stack service id %s\n", ssid)
 		}
-		err = client.UpdateStack(stack)
+		operation, err := client.UpdateStack(stack)
 		if err != nil {
 			fmt.Printf("Error updating stack: %s\n", err)
 			return
 		}
+		if operation != nil {
+			printChanges(operation)
+		}
 		if Verbose {
 			data, err := json.MarshalIndent(stack, "", "   ")
 			if err != nil {
@@ -98,3 +120,58 @@ var setEnvCmd = &cobra.Command{
 	},
 	PostRun: RefreshToken,
 }
+
+var setScheduleCmd = &cobra.Command{
+	Use:    "schedule [stackId]",
+	Short:  "Set when the stack starts and stops and how long it may run",
+	PreRun: Connect,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Usage()
+			os.Exit(-1)
+		}
+		sid := args[0]
+
+		stack, err := client.GetStack(sid)
+		if err != nil {
+			fmt.Printf("Get stack failed: %s\n", err)
+			return
+		}
+
+		if scheduleClear {
+			stack.Schedule = nil
+		} else {
+			if stack.Schedule == nil {
+				stack.Schedule = &api.StackSchedule{}
+			}
+			if cmd.Flags().Changed("start") {
+				stack.Schedule.Start = scheduleStart
+			}
+			if cmd.Flags().Changed("stop") {
+				stack.Schedule.Stop = scheduleStop
+			}
+			if cmd.Flags().Changed("max-runtime") {
+				stack.Schedule.MaxRuntime = int(scheduleMaxRuntime.Seconds())
+			}
+			if errors := validation.ValidateSchedule(stack.Schedule); len(errors) > 0 {
+				for _, e := range errors {
+					fmt.Printf("Invalid %s: %s\n", e.Field, e.Message)
+				}
+				return
+			}
+		}
+
+		_, err = client.UpdateStack(stack)
+		if err != nil {
+			fmt.Printf("Error updating stack: %s\n", err)
+			return
+		}
+		if stack.Schedule == nil {
+			fmt.Printf("Removed the schedule of %s\n", sid)
+		} else {
+			fmt.Printf("Stack %s: start %q, stop %q, maximum runtime %s\n", sid, stack.Schedule.Start,
+				stack.Schedule.Stop, time.Duration(stack.Schedule.MaxRuntime)*time.Second)
+		}
+	},
+	PostRun: RefreshToken,
+}
@@ -6,12 +6,19 @@ import (
 	"fmt"
 	"github.com/spf13/cobra"
 	"os"
+	"strings"
+)
+
+var (
+	devMode bool
+	wait    bool
+	cascade bool
 )
 
 // startCmd represents the start command
 var startCmd = &cobra.Command{
-	Use:    "start [stackName]",
-	Short:  "Start a stack",
+	Use:    "start [stackName|stackServiceId]",
+	Short:  "Start a stack or one of its services",
 	PreRun: Connect,
 	Run: func(cmd *cobra.Command, args []string) {
 
@@ -22,6 +29,18 @@ var startCmd = &cobra.Command{
 
 		stackId := args[0]
 
+		if strings.Contains(stackId, "-") {
+			operation, err := client.StartStackService(stackId, cascade)
+			if err != nil {
+				fmt.Printf("Error starting %s: %s\n", stackId, err)
+			} else if wait {
+				waitOperation(operation)
+			} else {
+				fmt.Printf("Starting %s (operation %s)\n", stackId, operation.Id)
+			}
+			return
+		}
+
 		stack, err := client.GetStack(stackId)
 		if err != nil {
 			fmt.Printf("Start failed: %s\n", err.Error())
@@ -33,15 +52,29 @@ var startCmd = &cobra.Command{
 			return
 		}
 
-		stack, err = client.StartStack(stackId)
+		if cmd.Flags().Changed("dev") && stack.DevMode != devMode {
+			stack.DevMode = devMode
+			_, err = client.UpdateStack(stack)
+			if err != nil {
+				fmt.Printf("Error setting dev mode for %s: %s\n", stackId, err)
+				return
+			}
+		}
+
+		operation, err := client.StartStack(stackId)
 		if err != nil {
 			fmt.Printf("Error starting %s: %s\n", stackId, err)
+		} else if wait {
+			waitOperation(operation)
 		} else {
-			fmt.Printf("Started %s\n", stackId)
+			fmt.Printf("Starting %s (operation %s)\n", stackId, operation.Id)
 		}
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(startCmd)
+	startCmd.Flags().BoolVar(&cascade, "cascade", false, "Start the stopped services that depend on the service")
+	startCmd.Flags().BoolVar(&wait, "wait", false, "Wait for the stack or service to start, showing the progress of each service")
+	startCmd.Flags().BoolVar(&devMode, "dev", false, "Start in dev mode with the service's developer environment")
 }
@@ -3,32 +3,46 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
+	api "github.com/ndslabs/apiserver/types"
 	"github.com/spf13/cobra"
+	"os"
+	"strings"
 )
 
 // stopCmd represents the stop command
 var stopCmd = &cobra.Command{
-	Use:    "stop",
-	Short:  "Stop a stack",
+	Use:    "stop [stackName|stackServiceId]",
+	Short:  "Stop a stack or one of its services",
 	PreRun: Connect,
 	Run: func(cmd *cobra.Command, args []string) {
-		stackId := args[0]
 
-		stack, err := client.StopStack(stackId)
+		if len(args) == 0 {
+			cmd.Usage()
+			os.Exit(-1)
+		}
+
+		stackId := args[0]
 
+		var operation *api.Operation
+		var err error
+		if strings.Contains(stackId, "-") {
+			operation, err = client.StopStackService(stackId, cascade)
+		} else {
+			operation, err = client.StopStack(stackId)
+		}
 		if err != nil {
 			fmt.Printf("Error stopping %s: %s\n", stackId, err)
+		} else if wait {
+			waitOperation(operation)
 		} else {
-			data, _ := json.MarshalIndent(&stack, "", "    ")
-
-			fmt.Println(string(data))
-			fmt.Printf("Stopped %s\n", stackId)
+			fmt.Printf("Stopping %s (operation %s)\n", stackId, operation.Id)
 		}
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(stopCmd)
+	stopCmd.Flags().BoolVar(&cascade, "cascade", false, "Include the services that depend on the service")
+	stopCmd.Flags().BoolVar(&wait, "wait", false, "Wait for the stack or service to stop, showing the progress of each service")
 }
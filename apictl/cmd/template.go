@@ -0,0 +1,207 @@
+// Copyright © 2016 National Data Service
+
+package cmd
+
+import (
+	"fmt"
+	api "github.com/ndslabs/apiserver/types"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+var (
+	templateName        string
+	templateDescription string
+	templateParams      []string
+	templateValues      []string
+	templateToken       string
+	revoke              bool
+)
+
+func init() {
+	RootCmd.AddCommand(templateCmd)
+	templateCmd.AddCommand(templateListCmd)
+	templateCmd.AddCommand(templateSaveCmd)
+	templateCmd.AddCommand(templateShareCmd)
+	templateCmd.AddCommand(templatePublishCmd)
+	templateCmd.AddCommand(templateCreateCmd)
+	templateCmd.AddCommand(templateDeleteCmd)
+
+	templateSaveCmd.Flags().StringVar(&templateName, "name", "", "Template name (default the stack's name)")
+	templateSaveCmd.Flags().StringVar(&templateDescription, "description", "", "Template description")
+	templateSaveCmd.Flags().StringSliceVar(&templateParams, "param", []string{}, "Config left for users to fill in, as service.NAME (repeatable)")
+	templateShareCmd.Flags().BoolVar(&revoke, "revoke", false, "Stop sharing the template by link")
+	templatePublishCmd.Flags().BoolVar(&revoke, "revoke", false, "Remove the template from the catalog")
+	templateCreateCmd.Flags().StringVar(&templateName, "name", "", "Stack name (default the template's name)")
+	templateCreateCmd.Flags().StringVar(&templateToken, "token", "", "Token of a template shared by link")
+	templateCreateCmd.Flags().StringSliceVar(&templateValues, "set", []string{}, "Parameter value, as service.NAME=value (repeatable)")
+}
+
+var templateCmd = &cobra.Command{
+	Use:   "template",
+	Short: "Save, share and create stacks from stack templates",
+}
+
+var templateListCmd = &cobra.Command{
+	Use:    "list",
+	Short:  "List your templates and those in the catalog",
+	PreRun: Connect,
+	Run: func(cmd *cobra.Command, args []string) {
+		templates, err := client.ListTemplates()
+		if err != nil {
+			fmt.Printf("Error listing templates: %s\n", err)
+			return
+		}
+
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 10, 4, 3, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tOWNER\tPUBLISHED\tPARAMETERS")
+		for _, template := range *templates {
+			params := []string{}
+			for _, parameter := range template.Parameters {
+				params = append(params, parameter.Service+"."+parameter.Name)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\n", template.Id, template.Name, template.Owner,
+				template.Published, strings.Join(params, ","))
+		}
+		w.Flush()
+	},
+	PostRun: RefreshToken,
+}
+
+var templateSaveCmd = &cobra.Command{
+	Use:    "save [stackId]",
+	Short:  "Save a template from a stack",
+	PreRun: Connect,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			cmd.Usage()
+			os.Exit(-1)
+		}
+
+		template := api.StackTemplate{Name: templateName, Description: templateDescription}
+		for _, param := range templateParams {
+			i := strings.Index(param, ".")
+			if i <= 0 {
+				fmt.Printf("Invalid parameter %s, expected service.NAME\n", param)
+				return
+			}
+			template.Parameters = append(template.Parameters,
+				api.TemplateParameter{Service: param[0:i], Name: param[i+1:], Required: true})
+		}
+
+		saved, err := client.SaveStackTemplate(args[0], &template)
+		if err != nil {
+			fmt.Printf("Error saving template: %s\n", err)
+			return
+		}
+		fmt.Printf("Saved template %s (%s)\n", saved.Id, saved.Name)
+	},
+	PostRun: RefreshToken,
+}
+
+var templateShareCmd = &cobra.Command{
+	Use:    "share [templateId]",
+	Short:  "Share a template by link",
+	PreRun: Connect,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			cmd.Usage()
+			os.Exit(-1)
+		}
+
+		template, err := client.ShareTemplate(args[0], revoke)
+		if err != nil {
+			fmt.Printf("Error sharing template: %s\n", err)
+			return
+		}
+		if template.Token == "" {
+			fmt.Printf("Template %s is no longer shared by link\n", template.Id)
+		} else {
+			fmt.Printf("apictl template create %s --token %s\n", template.Id, template.Token)
+		}
+	},
+	PostRun: RefreshToken,
+}
+
+var templatePublishCmd = &cobra.Command{
+	Use:    "publish [templateId]",
+	Short:  "Publish a template in the catalog (curators only)",
+	PreRun: Connect,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			cmd.Usage()
+			os.Exit(-1)
+		}
+
+		template, err := client.PublishTemplate(args[0], revoke)
+		if err != nil {
+			fmt.Printf("Error publishing template: %s\n", err)
+			return
+		}
+		if template.Published {
+			fmt.Printf("Template %s is published\n", template.Id)
+		} else {
+			fmt.Printf("Template %s is no longer published\n", template.Id)
+		}
+	},
+	PostRun: RefreshToken,
+}
+
+var templateCreateCmd = &cobra.Command{
+	Use:    "create [templateId]",
+	Short:  "Create a stack from a template",
+	PreRun: Connect,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			cmd.Usage()
+			os.Exit(-1)
+		}
+
+		instance := api.TemplateInstance{Name: templateName, Token: templateToken,
+			Values: map[string]map[string]string{}}
+		for _, value := range templateValues {
+			i := strings.Index(value, ".")
+			j := strings.Index(value, "=")
+			if i <= 0 || j < i {
+				fmt.Printf("Invalid value %s, expected service.NAME=value\n", value)
+				return
+			}
+			service := value[0:i]
+			if instance.Values[service] == nil {
+				instance.Values[service] = map[string]string{}
+			}
+			instance.Values[service][value[i+1:j]] = value[j+1:]
+		}
+
+		stack, err := client.InstantiateTemplate(args[0], &instance)
+		if err != nil {
+			fmt.Printf("Error creating stack: %s\n", err)
+			return
+		}
+		fmt.Printf("Created stack %s (%s)\n", stack.Id, stack.Name)
+	},
+	PostRun: RefreshToken,
+}
+
+var templateDeleteCmd = &cobra.Command{
+	Use:    "delete [templateId]",
+	Short:  "Delete a template",
+	PreRun: Connect,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			cmd.Usage()
+			os.Exit(-1)
+		}
+
+		err := client.DeleteTemplate(args[0])
+		if err != nil {
+			fmt.Printf("Error deleting template: %s\n", err)
+			return
+		}
+		fmt.Printf("Deleted template %s\n", args[0])
+	},
+	PostRun: RefreshToken,
+}
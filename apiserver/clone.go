@@ -0,0 +1,175 @@
+// Copyright © 2016 National Data Service
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	kube "github.com/ndslabs/apiserver/kube"
+	api "github.com/ndslabs/apiserver/types"
+	volumes "github.com/ndslabs/apiserver/volumes"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/golang/glog"
+)
+
+// Create a stopped copy of the stack with the same services, config,
+// passwords, image tags and mounts. The copy's AppData folders are shared
+// with the stack, copied or new. Other mounts are always shared.
+func (s *Server) CloneStack(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+	sid := r.PathParam("sid")
+
+	stack, _ := s.etcd.GetStack(userId, sid)
+	if stack == nil {
+		rest.NotFound(w, r)
+		return
+	}
+
+	// The body is optional
+	clone := api.StackClone{}
+	err := decodePayload(r, &clone)
+	if err != nil && err != rest.ErrJsonPayloadEmpty {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if clone.Volumes == "" {
+		clone.Volumes = api.CloneVolumesNew
+	}
+	if clone.Volumes != api.CloneVolumesShare && clone.Volumes != api.CloneVolumesCopy && clone.Volumes != api.CloneVolumesNew {
+		w.WriteHeader(http.StatusBadRequest)
+		w.WriteJson(&api.ValidationResult{Valid: false, Errors: []api.ValidationError{
+			{Field: "volumes", Message: "Volumes must be share, copy or new"},
+		}})
+		return
+	}
+	if clone.Volumes == api.CloneVolumesCopy && stack.Status != stackStatus[Stopped] {
+		rest.Error(w, "Stop the stack to copy its data", http.StatusConflict)
+		return
+	}
+
+	if errors := s.validateStackServices(userId, stack, nil); len(errors) > 0 {
+		glog.V(1).Infof("Stack %s uses unavailable services\n", stack.Name)
+		w.WriteHeader(http.StatusBadRequest)
+		w.WriteJson(&api.ValidationResult{Valid: false, Errors: errors})
+		return
+	}
+
+	copy := api.Stack{
+		Id:       s.kube.GenerateName(5),
+		Key:      stack.Key,
+		Name:     clone.Name,
+		Status:   stackStatus[Stopped],
+		DevMode:  stack.DevMode,
+		Services: []api.StackService{},
+	}
+	if stack.Schedule != nil {
+		schedule := *stack.Schedule
+		copy.Schedule = &schedule
+	}
+	if copy.Name == "" {
+		copy.Name = stack.Name + " (copy)"
+	}
+
+	// Folders copied and the secret created for the copy are removed if it
+	// cannot be saved. Its ID is new, so the secret is no other stack's.
+	cleanup := func() {
+		for _, stackService := range copy.Services {
+			for fromPath := range stackService.VolumeMounts {
+				if strings.HasPrefix(fromPath, "AppData/") && clone.Volumes == api.CloneVolumesCopy {
+					os.RemoveAll(s.volDir + "/" + userId + "/" + fromPath)
+				}
+			}
+		}
+		s.kube.DeleteSecret(userId, kube.ConfigSecretName(copy.Id))
+	}
+
+	for _, stackService := range stack.Services {
+		volumeMounts, err := s.cloneVolumes(userId, stackService.VolumeMounts, clone.Volumes)
+		if err != nil {
+			glog.Error(err)
+			cleanup()
+			rest.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		copy.Services = append(copy.Services, api.StackService{
+			Id:             fmt.Sprintf("%s-%s", copy.Id, stackService.Service),
+			Stack:          stackService.Stack,
+			Service:        stackService.Service,
+			ImageTag:       stackService.ImageTag,
+			Config:         stackService.Config,
+			VolumeMounts:   volumeMounts,
+			RepositoryRefs: stackService.RepositoryRefs,
+			Command:        stackService.Command,
+			Args:           stackService.Args,
+		})
+	}
+
+	// Passwords are copied too, so the copy can use the stack's data
+	secret, _ := s.kube.GetSecret(userId, kube.ConfigSecretName(sid))
+	if secret != nil {
+		_, err = s.kube.CreateSecret(userId, kube.ConfigSecretName(copy.Id), secret.Data)
+		if err != nil {
+			glog.Error(err)
+			cleanup()
+			rest.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	err = s.storeStackPasswords(userId, &copy)
+	if err != nil {
+		glog.Error(err)
+		cleanup()
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = s.etcd.PutStack(userId, copy.Id, &copy)
+	if err != nil {
+		glog.Error(err)
+		cleanup()
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	glog.V(4).Infof("Cloned stack %s as %s with %s volumes\n", sid, copy.Id, clone.Volumes)
+
+	s.maskStackPasswords(userId, &copy, false)
+	w.WriteJson(&copy)
+}
+
+// Map the stack service's mounts for a clone. AppData folders are kept,
+// copied or replaced with empty ones.
+func (s *Server) cloneVolumes(userId string, volumeMounts map[string]string, mode api.CloneVolumes) (map[string]string, error) {
+	cloned := map[string]string{}
+	for fromPath, toPath := range volumeMounts {
+		if mode == api.CloneVolumesShare || !strings.HasPrefix(fromPath, "AppData/") {
+			cloned[fromPath] = toPath
+			continue
+		}
+
+		volPath := fmt.Sprintf("AppData/%s", s.kube.RandomString(5))
+		if mode == api.CloneVolumesCopy {
+			src := s.volDir + "/" + userId + "/" + fromPath
+			if _, err := os.Stat(src); err == nil {
+				glog.V(4).Infof("Copying %s to %s\n", fromPath, volPath)
+				err = volumes.CopyDir(src, s.volDir+"/"+userId+"/"+volPath)
+				if err != nil {
+					// Remove this and the previous copies
+					os.RemoveAll(s.volDir + "/" + userId + "/" + volPath)
+					for copied := range cloned {
+						if strings.HasPrefix(copied, "AppData/") {
+							os.RemoveAll(s.volDir + "/" + userId + "/" + copied)
+						}
+					}
+					return nil, err
+				}
+			}
+		}
+		cloned[volPath] = toPath
+	}
+	return cloned, nil
+}
@@ -0,0 +1,405 @@
+// Copyright © 2016 National Data Service
+package compose
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	api "github.com/ndslabs/apiserver/types"
+	"gopkg.in/yaml.v2"
+)
+
+// Service keys that are translated. Anything else is reported.
+var supported = map[string]bool{
+	"image":          true,
+	"command":        true,
+	"entrypoint":     true,
+	"environment":    true,
+	"ports":          true,
+	"expose":         true,
+	"volumes":        true,
+	"depends_on":     true,
+	"links":          true,
+	"container_name": true,
+	"restart":        true,
+}
+
+var invalidKeyChars = regexp.MustCompile("[^-a-z0-9]+")
+
+type converter struct {
+	prefix   string
+	keys     map[string]string
+	volumes  map[string][]string
+	linked   bool
+	warnings []string
+}
+
+// Convert translates a docker-compose file into a set of linked service
+// specs. Service keys are derived from the compose service names, with the
+// optional prefix prepended. Constructs that cannot be translated are
+// returned as warnings.
+func Convert(data []byte, prefix string) (*api.ImportResult, error) {
+	file := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	c := &converter{
+		prefix:  prefix,
+		keys:    map[string]string{},
+		volumes: map[string][]string{},
+	}
+
+	// Version 1 files have services at the top level
+	services := file
+	if _, ok := file["services"]; ok {
+		services = toMap(file["services"])
+		if _, ok := file["networks"]; ok {
+			c.warn("networks are not supported, services share the stack network")
+		}
+	}
+
+	names := []string{}
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No services found")
+	}
+
+	// Assign keys up front so dependencies can be resolved in any order
+	for _, name := range names {
+		fields := toMap(services[name])
+		if _, ok := fields["image"]; !ok {
+			if _, ok := fields["build"]; ok {
+				c.warn("%s: build is not supported, an image is required; skipped", name)
+			} else {
+				c.warn("%s: no image; skipped", name)
+			}
+			continue
+		}
+		c.keys[name] = c.key(name)
+	}
+
+	result := &api.ImportResult{Services: []api.ServiceSpec{}}
+	for _, name := range names {
+		if _, ok := c.keys[name]; !ok {
+			continue
+		}
+		result.Services = append(result.Services, c.convertService(name, toMap(services[name])))
+	}
+
+	volumeNames := []string{}
+	for volume := range c.volumes {
+		volumeNames = append(volumeNames, volume)
+	}
+	sort.Strings(volumeNames)
+	for _, volume := range volumeNames {
+		if users := c.volumes[volume]; len(users) > 1 {
+			c.warn("volume %s is shared by %s; each service gets its own copy", volume, strings.Join(users, ", "))
+		}
+	}
+
+	result.Warnings = c.warnings
+	if result.Warnings == nil {
+		result.Warnings = []string{}
+	}
+	return result, nil
+}
+
+func (c *converter) warn(format string, args ...interface{}) {
+	c.warnings = append(c.warnings, fmt.Sprintf(format, args...))
+}
+
+// Derive a catalog key from a compose service name
+func (c *converter) key(name string) string {
+	key := strings.Trim(invalidKeyChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if key != name {
+		c.warn("%s: renamed to %s", name, key)
+	}
+	if c.prefix != "" {
+		key = c.prefix + "-" + key
+	}
+	return key
+}
+
+func (c *converter) convertService(name string, fields map[string]interface{}) api.ServiceSpec {
+	spec := api.ServiceSpec{
+		Key:    c.keys[name],
+		Label:  name,
+		Access: api.AccessInternal,
+	}
+
+	fieldNames := []string{}
+	for field := range fields {
+		fieldNames = append(fieldNames, field)
+	}
+	sort.Strings(fieldNames)
+	for _, field := range fieldNames {
+		if !supported[field] {
+			c.warn("%s: %s is not supported", name, field)
+		}
+	}
+
+	image := toString(fields["image"])
+	if i := strings.Index(image, "@"); i >= 0 {
+		c.warn("%s: image digest %s is not supported, using latest", name, image[i+1:])
+		image = image[:i]
+	}
+	tag := "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image, tag = image[:i], image[i+1:]
+	}
+	spec.Image = api.ServiceImage{Name: image, Tags: []string{tag}}
+
+	// Compose entrypoint and command map to the container command and args
+	spec.Command = toCommand(fields["entrypoint"])
+	spec.Args = toCommand(fields["command"])
+
+	c.convertEnvironment(name, fields["environment"], &spec)
+	c.convertPorts(name, fields["ports"], true, &spec)
+	c.convertPorts(name, fields["expose"], false, &spec)
+	c.convertVolumes(name, fields["volumes"], &spec)
+
+	deps := toStringList(fields["depends_on"])
+	for _, link := range toStringList(fields["links"]) {
+		parts := strings.SplitN(link, ":", 2)
+		if len(parts) == 2 && parts[1] != parts[0] {
+			c.warn("%s: link alias %s is not supported", name, parts[1])
+		}
+		deps = append(deps, parts[0])
+	}
+	seen := map[string]bool{}
+	for _, dep := range deps {
+		if seen[dep] {
+			continue
+		}
+		seen[dep] = true
+		key, ok := c.keys[dep]
+		if !ok {
+			c.warn("%s: dependency %s was not imported", name, dep)
+			continue
+		}
+		spec.Dependencies = append(spec.Dependencies, api.ServiceDependency{
+			DependencyKey: key,
+			Required:      true,
+		})
+	}
+	if len(spec.Dependencies) > 0 && !c.linked {
+		c.linked = true
+		c.warn("dependencies are reachable through the <KEY>_PORT_<port>_TCP_ADDR environment variables, not by compose service name")
+	}
+
+	return spec
+}
+
+func (c *converter) convertEnvironment(name string, value interface{}, spec *api.ServiceSpec) {
+	env := map[string]string{}
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			parts := strings.SplitN(toString(item), "=", 2)
+			if len(parts) == 2 {
+				env[parts[0]] = parts[1]
+			} else {
+				env[parts[0]] = ""
+			}
+		}
+	case map[interface{}]interface{}:
+		for k, val := range v {
+			env[toString(k)] = toString(val)
+		}
+	}
+
+	names := []string{}
+	for k := range env {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		upper := strings.ToUpper(k)
+		spec.Config = append(spec.Config, api.Config{
+			Name:        k,
+			Value:       env[k],
+			Label:       k,
+			CanOverride: true,
+			IsPassword:  strings.Contains(upper, "PASSWORD") || strings.Contains(upper, "SECRET"),
+		})
+	}
+}
+
+// Published ports are assumed to be user facing http endpoints, exposed
+// ports internal tcp endpoints.
+func (c *converter) convertPorts(name string, value interface{}, published bool, spec *api.ServiceSpec) {
+	items, _ := value.([]interface{})
+	for _, raw := range items {
+		item := toString(raw)
+		if m, ok := raw.(map[interface{}]interface{}); ok {
+			// Long syntax
+			item = toString(m["target"])
+			if published := toString(m["published"]); published != "" {
+				item = published + ":" + item
+			}
+			if protocol := toString(m["protocol"]); protocol != "" {
+				item += "/" + protocol
+			}
+		}
+
+		port := item
+		udp := false
+		if i := strings.Index(port, "/"); i >= 0 {
+			switch port[i+1:] {
+			case "tcp":
+			case "udp":
+				udp = true
+			default:
+				c.warn("%s: port %s is not supported, only tcp and udp ports can be imported", name, item)
+				continue
+			}
+			port = port[:i]
+		}
+
+		// HOST:CONTAINER or IP:HOST:CONTAINER
+		if i := strings.LastIndex(port, ":"); i >= 0 {
+			c.warn("%s: host port mapping %s ignored, ports are assigned by the cluster", name, item)
+			port = port[i+1:]
+		}
+		if strings.Contains(port, "-") {
+			c.warn("%s: port range %s is not supported", name, item)
+			continue
+		}
+
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			c.warn("%s: invalid port %s", name, item)
+			continue
+		}
+
+		protocol := "tcp"
+		if udp {
+			protocol = "udp"
+		} else if published {
+			protocol = "http"
+		}
+		if published {
+			spec.Access = api.AccessExternal
+		}
+
+		duplicate := false
+		for _, p := range spec.Ports {
+			if p.Port == int32(n) && (p.Protocol == "udp") == udp {
+				duplicate = true
+			}
+		}
+		if duplicate {
+			continue
+		}
+
+		spec.Ports = append(spec.Ports, api.Port{Port: int32(n), Protocol: protocol})
+	}
+}
+
+func (c *converter) convertVolumes(name string, value interface{}, spec *api.ServiceSpec) {
+	items, _ := value.([]interface{})
+	for _, item := range items {
+		source, target := "", ""
+		switch v := item.(type) {
+		case string:
+			parts := strings.Split(v, ":")
+			if len(parts) == 1 {
+				target = parts[0]
+			} else {
+				source, target = parts[0], parts[1]
+			}
+		case map[interface{}]interface{}:
+			source, target = toString(v["source"]), toString(v["target"])
+		}
+		if target == "" {
+			c.warn("%s: invalid volume %v", name, item)
+			continue
+		}
+
+		volume := path.Base(target)
+		if source != "" {
+			if strings.HasPrefix(source, "/") || strings.HasPrefix(source, ".") || strings.HasPrefix(source, "~") {
+				c.warn("%s: host path %s is not mounted, %s is backed by the stack volume", name, source, target)
+			} else {
+				volume = source
+				c.volumes[source] = append(c.volumes[source], name)
+			}
+		}
+
+		mountName := strings.Trim(invalidKeyChars.ReplaceAllString(strings.ToLower(volume), "-"), "-")
+		if mountName == "" || mountName == "home" {
+			mountName = "data"
+		}
+		unique := mountName
+		for i := 2; ; i++ {
+			taken := false
+			for _, m := range spec.VolumeMounts {
+				if m.Name == unique {
+					taken = true
+				}
+			}
+			if !taken {
+				break
+			}
+			unique = fmt.Sprintf("%s-%d", mountName, i)
+		}
+
+		spec.VolumeMounts = append(spec.VolumeMounts, api.VolumeMount{Name: unique, MountPath: target})
+		spec.RequiresVolume = true
+	}
+}
+
+func toMap(value interface{}) map[string]interface{} {
+	m := map[string]interface{}{}
+	if v, ok := value.(map[interface{}]interface{}); ok {
+		for k, val := range v {
+			m[toString(k)] = val
+		}
+	}
+	return m
+}
+
+func toString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// Lists may be given as a sequence, or for depends_on as a map of conditions
+func toStringList(value interface{}) []string {
+	list := []string{}
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			list = append(list, toString(item))
+		}
+	case map[interface{}]interface{}:
+		for k := range v {
+			list = append(list, toString(k))
+		}
+		sort.Strings(list)
+	case string:
+		list = append(list, v)
+	}
+	return list
+}
+
+func toCommand(value interface{}) []string {
+	if s, ok := value.(string); ok {
+		return strings.Fields(s)
+	}
+	if value == nil {
+		return nil
+	}
+	return toStringList(value)
+}
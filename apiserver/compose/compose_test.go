@@ -0,0 +1,124 @@
+package compose
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	api "github.com/ndslabs/apiserver/types"
+)
+
+const testComposeFile = `
+version: '2'
+services:
+  web:
+    image: example/web:1.2
+    command: ["serve", "--port", "8080"]
+    environment:
+      - DB_HOST=db
+      - DB_PASSWORD
+    ports:
+      - "80:8080"
+    volumes:
+      - ./src:/app
+      - data:/var/lib/web
+    depends_on:
+      - db
+    networks:
+      - front
+  db:
+    image: postgres
+    expose:
+      - "5432"
+      - "53/udp"
+    volumes:
+      - data:/var/lib/postgresql/data
+  worker:
+    build: .
+networks:
+  front:
+volumes:
+  data:
+`
+
+func TestConvert(t *testing.T) {
+	result, err := Convert([]byte(testComposeFile), "myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Services) != 2 {
+		t.Fatalf("Expected 2 services, got %d", len(result.Services))
+	}
+	db, web := result.Services[0], result.Services[1]
+
+	if db.Key != "myapp-db" || db.Image.Name != "postgres" || !reflect.DeepEqual(db.Image.Tags, []string{"latest"}) {
+		t.Errorf("Unexpected db spec %+v", db)
+	}
+	if !reflect.DeepEqual(db.Ports, []api.Port{{Port: 5432, Protocol: "tcp"}, {Port: 53, Protocol: "udp"}}) || db.Access != api.AccessInternal {
+		t.Errorf("Unexpected db ports %v", db.Ports)
+	}
+
+	if web.Key != "myapp-web" || web.Image.Name != "example/web" || web.Image.Tags[0] != "1.2" {
+		t.Errorf("Unexpected web spec %+v", web)
+	}
+	if !reflect.DeepEqual(web.Args, []string{"serve", "--port", "8080"}) {
+		t.Errorf("Unexpected args %v", web.Args)
+	}
+	if !reflect.DeepEqual(web.Ports, []api.Port{{Port: 8080, Protocol: "http"}}) || web.Access != api.AccessExternal {
+		t.Errorf("Unexpected web ports %v", web.Ports)
+	}
+	expectedConfig := []api.Config{
+		{Name: "DB_HOST", Value: "db", Label: "DB_HOST", CanOverride: true},
+		{Name: "DB_PASSWORD", Label: "DB_PASSWORD", CanOverride: true, IsPassword: true},
+	}
+	if !reflect.DeepEqual(web.Config, expectedConfig) {
+		t.Errorf("Unexpected config %+v", web.Config)
+	}
+	expectedMounts := []api.VolumeMount{
+		{Name: "app", MountPath: "/app"},
+		{Name: "data", MountPath: "/var/lib/web"},
+	}
+	if !reflect.DeepEqual(web.VolumeMounts, expectedMounts) {
+		t.Errorf("Unexpected volume mounts %+v", web.VolumeMounts)
+	}
+	if len(web.Dependencies) != 1 || web.Dependencies[0].DependencyKey != "myapp-db" || !web.Dependencies[0].Required {
+		t.Errorf("Unexpected dependencies %+v", web.Dependencies)
+	}
+
+	warnings := strings.Join(result.Warnings, "\n")
+	for _, expected := range []string{
+		"worker: build is not supported",
+		"web: networks is not supported",
+		"web: host path ./src is not mounted",
+		"web: host port mapping 80:8080 ignored",
+		"volume data is shared by db, web",
+	} {
+		if !strings.Contains(warnings, expected) {
+			t.Errorf("Expected warning %q in:\n%s", expected, warnings)
+		}
+	}
+}
+
+func TestConvertVersion1(t *testing.T) {
+	result, err := Convert([]byte("my_service:\n  image: registry.example.org:5000/tools/app\n  links:\n    - cache:redis\ncache:\n  image: redis:3\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Services) != 2 {
+		t.Fatalf("Expected 2 services, got %d", len(result.Services))
+	}
+	app := result.Services[1]
+	if app.Key != "my-service" || app.Image.Name != "registry.example.org:5000/tools/app" || app.Image.Tags[0] != "latest" {
+		t.Errorf("Unexpected spec %+v", app)
+	}
+	if len(app.Dependencies) != 1 || app.Dependencies[0].DependencyKey != "cache" {
+		t.Errorf("Unexpected dependencies %+v", app.Dependencies)
+	}
+}
+
+func TestConvertInvalid(t *testing.T) {
+	if _, err := Convert([]byte("- not\n- a map\n"), ""); err == nil {
+		t.Error("Expected error for invalid file")
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright © 2016 National Data Service
+package compose
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	k8api "k8s.io/kubernetes/pkg/api"
+)
+
+type composeFile struct {
+	Version  string                       `yaml:"version"`
+	Services map[string]composeService    `yaml:"services"`
+	Volumes  map[string]map[string]string `yaml:"volumes,omitempty"`
+}
+
+type composeService struct {
+	Image       string            `yaml:"image"`
+	Entrypoint  []string          `yaml:"entrypoint,omitempty"`
+	Command     []string          `yaml:"command,omitempty"`
+	Environment map[string]string `yaml:"environment,omitempty"`
+	Ports       []string          `yaml:"ports,omitempty"`
+	Expose      []string          `yaml:"expose,omitempty"`
+	Volumes     []string          `yaml:"volumes,omitempty"`
+	DependsOn   []string          `yaml:"depends_on,omitempty"`
+}
+
+// Export renders the replication controllers and services of a stack as a
+// docker-compose file. Compose services keep the Kubernetes names so that
+// link environment variables resolve the same way. Host paths under homeDir
+// are made relative to the compose file and emptyDir volumes become named
+// volumes. depends maps each controller name to the names it depends on.
+func Export(controllers []*k8api.ReplicationController, services []*k8api.Service, depends map[string][]string, homeDir string) ([]byte, error) {
+	file := composeFile{
+		Version:  "2",
+		Services: map[string]composeService{},
+		Volumes:  map[string]map[string]string{},
+	}
+
+	for _, rc := range controllers {
+		name := rc.Name
+		pod := rc.Spec.Template.Spec
+		if len(pod.Containers) == 0 {
+			continue
+		}
+		container := pod.Containers[0]
+
+		service := composeService{
+			Image:       container.Image,
+			Entrypoint:  container.Command,
+			Command:     container.Args,
+			Environment: map[string]string{},
+			DependsOn:   depends[name],
+		}
+		for _, env := range container.Env {
+			if env.ValueFrom != nil {
+				// Secrets are not exported, take them from the shell
+				service.Environment[env.Name] = "${" + env.Name + "}"
+				continue
+			}
+			service.Environment[env.Name] = env.Value
+		}
+
+		for _, svc := range services {
+			if svc.Name != name {
+				continue
+			}
+			for _, port := range svc.Spec.Ports {
+				suffix := ""
+				if port.Protocol == k8api.ProtocolUDP {
+					suffix = "/udp"
+				}
+				if svc.Spec.Type == k8api.ServiceTypeNodePort {
+					service.Ports = append(service.Ports, fmt.Sprintf("%d:%d%s", port.Port, port.Port, suffix))
+				} else {
+					service.Expose = append(service.Expose, fmt.Sprintf("%d%s", port.Port, suffix))
+				}
+			}
+		}
+
+		volumes := map[string]k8api.Volume{}
+		for _, vol := range pod.Volumes {
+			volumes[vol.Name] = vol
+		}
+		for _, mount := range container.VolumeMounts {
+			vol, ok := volumes[mount.Name]
+			if !ok {
+				continue
+			}
+			if vol.HostPath != nil {
+				source := vol.HostPath.Path
+				if source == homeDir {
+					source = "."
+				} else if strings.HasPrefix(source, homeDir+"/") {
+					source = "./" + strings.TrimPrefix(source, homeDir+"/")
+				}
+				service.Volumes = append(service.Volumes, source+":"+mount.MountPath)
+			} else {
+				volName := name + "-" + mount.Name
+				file.Volumes[volName] = map[string]string{}
+				service.Volumes = append(service.Volumes, volName+":"+mount.MountPath)
+			}
+		}
+
+		file.Services[name] = service
+	}
+
+	if len(file.Volumes) == 0 {
+		file.Volumes = nil
+	}
+	return yaml.Marshal(&file)
+}
@@ -0,0 +1,65 @@
+package compose
+
+import (
+	"strings"
+	"testing"
+
+	k8api "k8s.io/kubernetes/pkg/api"
+)
+
+func TestExport(t *testing.T) {
+	rc := &k8api.ReplicationController{
+		ObjectMeta: k8api.ObjectMeta{Name: "sabcde-web"},
+		Spec: k8api.ReplicationControllerSpec{
+			Template: &k8api.PodTemplateSpec{
+				Spec: k8api.PodSpec{
+					Containers: []k8api.Container{{
+						Image: "example/web:1.2",
+						Args:  []string{"serve"},
+						Env:   []k8api.EnvVar{{Name: "SABCDE-DB_PORT_5432_TCP_ADDR", Value: "sabcde-db"}},
+						VolumeMounts: []k8api.VolumeMount{
+							{Name: "home", MountPath: "/home/demo"},
+							{Name: "data", MountPath: "/data"},
+							{Name: "cache", MountPath: "/cache"},
+						},
+					}},
+					Volumes: []k8api.Volume{
+						{Name: "home", VolumeSource: k8api.VolumeSource{HostPath: &k8api.HostPathVolumeSource{Path: "/volumes/demo"}}},
+						{Name: "data", VolumeSource: k8api.VolumeSource{HostPath: &k8api.HostPathVolumeSource{Path: "/volumes/demo/AppData/web"}}},
+						{Name: "cache", VolumeSource: k8api.VolumeSource{EmptyDir: &k8api.EmptyDirVolumeSource{}}},
+					},
+				},
+			},
+		},
+	}
+	svc := &k8api.Service{
+		ObjectMeta: k8api.ObjectMeta{Name: "sabcde-web"},
+		Spec: k8api.ServiceSpec{
+			Type:  k8api.ServiceTypeNodePort,
+			Ports: []k8api.ServicePort{{Port: 8080}, {Port: 8125, Protocol: k8api.ProtocolUDP}},
+		},
+	}
+
+	data, err := Export([]*k8api.ReplicationController{rc}, []*k8api.Service{svc},
+		map[string][]string{"sabcde-web": {"sabcde-db"}}, "/volumes/demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := string(data)
+	for _, expected := range []string{
+		"image: example/web:1.2",
+		"- serve",
+		"SABCDE-DB_PORT_5432_TCP_ADDR: sabcde-db",
+		"- 8080:8080",
+		"- 8125:8125/udp",
+		"- .:/home/demo",
+		"- ./AppData/web:/data",
+		"- sabcde-web-cache:/cache",
+		"depends_on:\n    - sabcde-db",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in:\n%s", expected, out)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	valid := []string{"* * * * *", "0 8 * * 1-5", "*/15 9-17 * * *", "0 0 1,15 * *", "@daily", "5/10 * * * 7"}
+	invalid := []string{"", "* * * *", "60 * * * *", "0 24 * * *", "0 0 0 * *", "0 0 * 13 *", "5-1 * * * *", "*/0 * * * *", "a * * * *"}
+
+	for _, spec := range valid {
+		if _, err := Parse(spec); err != nil {
+			t.Errorf("Expected %q to parse: %s\n", spec, err)
+		}
+	}
+	for _, spec := range invalid {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Expected %q to fail\n", spec)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// Friday
+	from := time.Date(2016, 9, 30, 17, 30, 15, 0, time.UTC)
+
+	tests := map[string]time.Time{
+		"* * * * *":    time.Date(2016, 9, 30, 17, 31, 0, 0, time.UTC),
+		"0 8 * * 1-5":  time.Date(2016, 10, 3, 8, 0, 0, 0, time.UTC),
+		"*/20 * * * *": time.Date(2016, 9, 30, 17, 40, 0, 0, time.UTC),
+		"0 0 1,15 * *": time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC),
+		"0 18 * * 0":   time.Date(2016, 10, 2, 18, 0, 0, 0, time.UTC),
+		"0 18 * * 7":   time.Date(2016, 10, 2, 18, 0, 0, 0, time.UTC),
+		"0 0 13 * 5":   time.Date(2016, 10, 7, 0, 0, 0, 0, time.UTC),
+		"0 0 */2 * 5":  time.Date(2016, 10, 7, 0, 0, 0, 0, time.UTC),
+		"0 0 29 2 *":   time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC),
+		"@monthly":     time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	for spec, expected := range tests {
+		schedule, err := Parse(spec)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %s\n", spec, err)
+			continue
+		}
+		if next := schedule.Next(from); !next.Equal(expected) {
+			t.Errorf("Expected next %q to be %s, got %s\n", spec, expected, next)
+		}
+	}
+
+	// Hours start on the half hour in absolute time
+	india := time.FixedZone("IST", 5*3600+1800)
+	schedule, _ := Parse("0 9 * * *")
+	expected := time.Date(2016, 10, 1, 9, 0, 0, 0, india)
+	if next := schedule.Next(time.Date(2016, 9, 30, 17, 30, 15, 0, india)); !next.Equal(expected) {
+		t.Errorf("Expected next to be %s, got %s\n", expected, next)
+	}
+}
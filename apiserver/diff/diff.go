@@ -0,0 +1,117 @@
+// Copyright © 2016 National Data Service
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	api "github.com/ndslabs/apiserver/types"
+)
+
+// Specs returns the changes from old to new, sorted by field. Lists are
+// compared element by element. Fields describing where a spec is rather than
+// what it is (catalog, provenance, owner and shares) are ignored. old may be
+// nil, in which case every value is new.
+func Specs(old *api.ServiceSpec, new *api.ServiceSpec) []api.SpecChange {
+	return changes(flatten(old), flatten(new))
+}
+
+// StackServices returns the changes from old to new in the settings a stack
+// service's controller is created from: its image tag, config, volume mounts,
+// repository refs, command and args. Status is ignored.
+func StackServices(old *api.StackService, new *api.StackService) []api.SpecChange {
+	return changes(flattenStackService(old), flattenStackService(new))
+}
+
+func changes(oldValues map[string]interface{}, newValues map[string]interface{}) []api.SpecChange {
+	fields := []string{}
+	for field := range oldValues {
+		fields = append(fields, field)
+	}
+	for field := range newValues {
+		if _, ok := oldValues[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := []api.SpecChange{}
+	for _, field := range fields {
+		oldValue, newValue := oldValues[field], newValues[field]
+		if !reflect.DeepEqual(oldValue, newValue) {
+			changes = append(changes, api.SpecChange{Field: field, Old: oldValue, New: newValue})
+		}
+	}
+	return changes
+}
+
+// Flatten the spec's JSON into values by path, leaving out nulls
+func flatten(spec *api.ServiceSpec) map[string]interface{} {
+	values := map[string]interface{}{}
+	if spec == nil {
+		return values
+	}
+
+	copy := *spec
+	copy.Catalog = ""
+	copy.Provenance = nil
+	copy.Owner = ""
+	copy.SharedWith = nil
+	return flattenJSON(&copy)
+}
+
+// Flatten the settings of the stack service like a spec
+func flattenStackService(stackService *api.StackService) map[string]interface{} {
+	if stackService == nil {
+		return map[string]interface{}{}
+	}
+
+	settings := struct {
+		ImageTag       string            `json:"imageTag,omitempty"`
+		Config         map[string]string `json:"config"`
+		VolumeMounts   map[string]string `json:"volumeMounts"`
+		RepositoryRefs map[string]string `json:"repositoryRefs"`
+		Command        []string          `json:"command"`
+		Args           []string          `json:"args"`
+	}{
+		stackService.ImageTag,
+		stackService.Config,
+		stackService.VolumeMounts,
+		stackService.RepositoryRefs,
+		stackService.Command,
+		stackService.Args,
+	}
+	return flattenJSON(&settings)
+}
+
+// Flatten a value's JSON into values by path, leaving out nulls
+func flattenJSON(value interface{}) map[string]interface{} {
+	values := map[string]interface{}{}
+	var tree interface{}
+	data, _ := json.Marshal(value)
+	json.Unmarshal(data, &tree)
+	flattenValue("", tree, values)
+	return values
+}
+
+func flattenValue(path string, value interface{}, values map[string]interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if path == "" {
+				flattenValue(key, child, values)
+			} else {
+				flattenValue(path+"."+key, child, values)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			flattenValue(fmt.Sprintf("%s[%d]", path, i), child, values)
+		}
+	case nil:
+	default:
+		values[path] = v
+	}
+}
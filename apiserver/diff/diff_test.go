@@ -0,0 +1,69 @@
+package diff
+
+import (
+	"reflect"
+	"testing"
+
+	api "github.com/ndslabs/apiserver/types"
+)
+
+func TestSpecs(t *testing.T) {
+	old := &api.ServiceSpec{
+		Key:     "clowder",
+		Label:   "Clowder",
+		Image:   api.ServiceImage{Name: "ndslabs/clowder", Tags: []string{"1.0"}},
+		Catalog: "system",
+		Ports:   []api.Port{{Port: 9000}},
+	}
+	new := &api.ServiceSpec{
+		Key:        "clowder",
+		Label:      "Clowder",
+		Image:      api.ServiceImage{Name: "ndslabs/clowder", Tags: []string{"1.1", "1.0"}},
+		Catalog:    "user",
+		Provenance: &api.Provenance{Author: "demo", Revision: 1},
+	}
+
+	expected := []api.SpecChange{
+		{Field: "image.tags[0]", Old: "1.0", New: "1.1"},
+		{Field: "image.tags[1]", New: "1.0"},
+		{Field: "ports[0].port", Old: float64(9000)},
+		{Field: "ports[0].protocol", Old: ""},
+	}
+	if changes := Specs(old, new); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected %v, got %v", expected, changes)
+	}
+
+	if changes := Specs(old, old); len(changes) != 0 {
+		t.Errorf("Expected no changes, got %v", changes)
+	}
+
+	for _, change := range Specs(nil, new) {
+		if change.Old != nil {
+			t.Errorf("Expected only new values, got %v", change)
+		}
+	}
+}
+
+func TestStackServices(t *testing.T) {
+	old := &api.StackService{
+		Id:       "s1234-clowder",
+		Service:  "clowder",
+		ImageTag: "1.0",
+		Status:   "ready",
+		Config:   map[string]string{"SMTP_HOST": "smtp.example.com"},
+	}
+	new := &api.StackService{
+		Id:       "s1234-clowder",
+		Service:  "clowder",
+		ImageTag: "1.1",
+		Config:   map[string]string{"SMTP_HOST": "smtp.example.com", "DEBUG": "true"},
+	}
+
+	expected := []api.SpecChange{
+		{Field: "config.DEBUG", New: "true"},
+		{Field: "imageTag", Old: "1.0", New: "1.1"},
+	}
+	if changes := StackServices(old, new); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected %v, got %v", expected, changes)
+	}
+}
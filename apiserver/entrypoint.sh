@@ -32,6 +32,26 @@ if [ "$1" = 'apiserver' ]; then
 		VOLUME_PATH="/volumes"
 	fi
 
+	if [ -z "$SPEC_GIT_REPO" ]; then 
+		SPEC_GIT_REPO=https://github.com/nds-org/ndslabs-specs
+	fi
+
+	if [ -z "$SPEC_GIT_BRANCH" ]; then 
+		SPEC_GIT_BRANCH=master
+	fi
+
+	if [ -z "$SPEC_GIT_INTERVAL" ]; then 
+		SPEC_GIT_INTERVAL="300"
+	fi
+
+	if [ -z "$PIN_IMAGE_DIGESTS" ]; then 
+		PIN_IMAGE_DIGESTS="false"
+	fi
+
+	if [ -z "$STACK_MAX_RUNTIME" ]; then 
+		STACK_MAX_RUNTIME="0"
+	fi
+
 cat << EOF > /apiserver.conf
 [Server]
 Port=30001
@@ -39,6 +59,9 @@ Origin=$CORS_ORIGIN_ADDR
 VolDir=$VOLUME_PATH
 VolumeSource=local
 SpecsDir=/specs
+SpecsRepo=$SPEC_GIT_REPO
+SpecsRef=$SPEC_GIT_BRANCH
+SpecsInterval=$SPEC_GIT_INTERVAL
 Timeout=$TIMEOUT
 Prefix=$PREFIX
 Ingress=$INGRESS
@@ -59,17 +82,25 @@ Address=$ETCD_ADDR
 Address=$KUBERNETES_ADDR
 Username=admin
 Password=admin
-EOF
 
-	if [ -z "$SPEC_GIT_REPO" ]; then 
-		SPEC_GIT_REPO=https://github.com/nds-org/ndslabs-specs
-	fi
+[Registry]
+Username=$REGISTRY_USERNAME
+Password=$REGISTRY_PASSWORD
+PinDigests=$PIN_IMAGE_DIGESTS
 
-	if [ -z "$SPEC_GIT_BRANCH" ]; then 
-		SPEC_GIT_BRANCH=master
-	fi
+[Repositories]
+Image=$REPOSITORY_IMAGE
 
-	git clone -b $SPEC_GIT_BRANCH $SPEC_GIT_REPO /specs
+[Catalog]
+Curators=$CATALOG_CURATORS
+
+[Stacks]
+Workers=$STACK_WORKERS
+StartTimeout=$STACK_START_TIMEOUT
+ServiceTimeout=$STACK_SERVICE_TIMEOUT
+MaxRuntime=$STACK_MAX_RUNTIME
+StopSchedule=$STACK_STOP_SCHEDULE
+EOF
 
 	/apiserver -conf /apiserver.conf -v 4
 
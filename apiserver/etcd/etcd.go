@@ -3,6 +3,7 @@ package etcd
 
 import (
 	"encoding/json"
+	"path"
 	"time"
 
 	api "github.com/ndslabs/apiserver/types"
@@ -125,9 +126,57 @@ func (s *EtcdHelper) GetAllServices(uid string) (*[]api.ServiceSpec, error) {
 			services = append(services, service)
 		}
 	}
+
+	shared, err := s.GetSharedServices(uid)
+	if err != nil {
+		return nil, err
+	}
+	services = append(services, *shared...)
+	return &services, nil
+}
+
+// GetSharedServices returns the specs other accounts shared with the user
+func (s *EtcdHelper) GetSharedServices(uid string) (*[]api.ServiceSpec, error) {
+	services := []api.ServiceSpec{}
+	resp, err := s.etcd.Get(context.Background(), etcdBasePath+"/accounts/"+uid+"/shared", nil)
+	if err != nil {
+		if !client.IsKeyNotFound(err) {
+			return nil, err
+		}
+		return &services, nil
+	}
+
+	for _, node := range resp.Node.Nodes {
+		key := path.Base(node.Key)
+		spec, err := s.GetServiceSpec(uid, key)
+		if err != nil {
+			return nil, err
+		}
+		if spec != nil && spec.Catalog == "shared" {
+			services = append(services, *spec)
+		}
+	}
 	return &services, nil
 }
 
+// PutSharedService shares the owner's spec with the user
+func (s *EtcdHelper) PutSharedService(uid string, key string, owner string) error {
+	_, err := s.etcd.Set(context.Background(), etcdBasePath+"/accounts/"+uid+"/shared/"+key, owner, nil)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	return nil
+}
+
+func (s *EtcdHelper) DeleteSharedService(uid string, key string) error {
+	_, err := s.etcd.Delete(context.Background(), etcdBasePath+"/accounts/"+uid+"/shared/"+key, nil)
+	if err != nil && !client.IsKeyNotFound(err) {
+		return err
+	}
+	return nil
+}
+
 func (s *EtcdHelper) PutGlobalService(key string, service *api.ServiceSpec) error {
 	data, err := json.Marshal(service)
 	if err != nil {
@@ -199,7 +248,8 @@ func (s *EtcdHelper) GetServiceSpec(uid string, key string) (*api.ServiceSpec, e
 		return &service, nil
 	}
 
-	// If not in user catalog, try system catalog
+	// If not in user catalog, try system catalog, which cannot be shadowed by
+	// specs shared with the user
 	resp, err = s.etcd.Get(context.Background(), etcdBasePath+"/services/"+key, nil)
 	if err != nil {
 		if !client.IsKeyNotFound(err) {
@@ -213,6 +263,27 @@ func (s *EtcdHelper) GetServiceSpec(uid string, key string) (*api.ServiceSpec, e
 		service.Catalog = "system"
 		return &service, nil
 	}
+
+	// Then specs shared with the user
+	resp, err = s.etcd.Get(context.Background(), etcdBasePath+"/accounts/"+uid+"/shared/"+key, nil)
+	if err != nil {
+		if !client.IsKeyNotFound(err) {
+			glog.Error(err)
+			return nil, err
+		}
+	} else {
+		owner := resp.Node.Value
+		resp, err = s.etcd.Get(context.Background(), etcdBasePath+"/accounts/"+owner+"/services/"+key, nil)
+		if err == nil {
+			service := api.ServiceSpec{}
+			json.Unmarshal([]byte(resp.Node.Value), &service)
+			service.Catalog = "shared"
+			service.Owner = owner
+			service.SharedWith = nil
+			return &service, nil
+		}
+		glog.Warningf("Spec %s shared with %s by %s not found\n", key, uid, owner)
+	}
 	return nil, nil
 }
 
@@ -328,6 +399,195 @@ func (s *EtcdHelper) GetStacks(uid string) (*[]api.Stack, error) {
 	return &stacks, nil
 }
 
+func (s *EtcdHelper) GetPublications() (*[]api.Publication, error) {
+	publications := []api.Publication{}
+	resp, err := s.etcd.Get(context.Background(), etcdBasePath+"/publications", nil)
+	if err != nil {
+		if !client.IsKeyNotFound(err) {
+			return nil, err
+		}
+	} else {
+		for _, node := range resp.Node.Nodes {
+			publication := api.Publication{}
+			json.Unmarshal([]byte(node.Value), &publication)
+			publications = append(publications, publication)
+		}
+	}
+	return &publications, nil
+}
+
+func (s *EtcdHelper) GetPublication(id string) (*api.Publication, error) {
+	resp, err := s.etcd.Get(context.Background(), etcdBasePath+"/publications/"+id, nil)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		glog.Error(err)
+		return nil, err
+	}
+	publication := api.Publication{}
+	json.Unmarshal([]byte(resp.Node.Value), &publication)
+	return &publication, nil
+}
+
+func (s *EtcdHelper) PutPublication(id string, publication *api.Publication) error {
+	data, err := json.Marshal(publication)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	_, err = s.etcd.Set(context.Background(), etcdBasePath+"/publications/"+id, string(data), nil)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	return nil
+}
+
+func (s *EtcdHelper) GetTemplates() (*[]api.StackTemplate, error) {
+	templates := []api.StackTemplate{}
+	resp, err := s.etcd.Get(context.Background(), etcdBasePath+"/templates", nil)
+	if err != nil {
+		if !client.IsKeyNotFound(err) {
+			return nil, err
+		}
+	} else {
+		for _, node := range resp.Node.Nodes {
+			template := api.StackTemplate{}
+			json.Unmarshal([]byte(node.Value), &template)
+			templates = append(templates, template)
+		}
+	}
+	return &templates, nil
+}
+
+func (s *EtcdHelper) GetTemplate(id string) (*api.StackTemplate, error) {
+	resp, err := s.etcd.Get(context.Background(), etcdBasePath+"/templates/"+id, nil)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		glog.Error(err)
+		return nil, err
+	}
+	template := api.StackTemplate{}
+	json.Unmarshal([]byte(resp.Node.Value), &template)
+	return &template, nil
+}
+
+func (s *EtcdHelper) PutTemplate(id string, template *api.StackTemplate) error {
+	data, err := json.Marshal(template)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	_, err = s.etcd.Set(context.Background(), etcdBasePath+"/templates/"+id, string(data), nil)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	return nil
+}
+
+func (s *EtcdHelper) DeleteTemplate(id string) error {
+	_, err := s.etcd.Delete(context.Background(), etcdBasePath+"/templates/"+id, nil)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *EtcdHelper) GetOperations(uid string) (*[]api.Operation, error) {
+	operations := []api.Operation{}
+	resp, err := s.etcd.Get(context.Background(), etcdBasePath+"/accounts/"+uid+"/operations", nil)
+	if err != nil {
+		if !client.IsKeyNotFound(err) {
+			return nil, err
+		}
+	} else {
+		for _, node := range resp.Node.Nodes {
+			operation := api.Operation{}
+			json.Unmarshal([]byte(node.Value), &operation)
+			operations = append(operations, operation)
+		}
+	}
+	return &operations, nil
+}
+
+func (s *EtcdHelper) GetOperation(uid string, id string) (*api.Operation, error) {
+	resp, err := s.etcd.Get(context.Background(), etcdBasePath+"/accounts/"+uid+"/operations/"+id, nil)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		glog.Error(err)
+		return nil, err
+	}
+	operation := api.Operation{}
+	json.Unmarshal([]byte(resp.Node.Value), &operation)
+	return &operation, nil
+}
+
+// PutOperation stores the operation. Completed operations expire after ttl,
+// zero keeps them.
+func (s *EtcdHelper) PutOperation(uid string, operation *api.Operation, ttl time.Duration) error {
+	data, err := json.Marshal(operation)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	_, err = s.etcd.Set(context.Background(), etcdBasePath+"/accounts/"+uid+"/operations/"+operation.Id, string(data),
+		&client.SetOptions{TTL: ttl})
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	return nil
+}
+
+func (s *EtcdHelper) GetNotices(uid string) (*[]api.Notice, error) {
+	notices := []api.Notice{}
+	resp, err := s.etcd.Get(context.Background(), etcdBasePath+"/accounts/"+uid+"/notices", nil)
+	if err != nil {
+		if !client.IsKeyNotFound(err) {
+			return nil, err
+		}
+	} else {
+		for _, node := range resp.Node.Nodes {
+			notice := api.Notice{}
+			json.Unmarshal([]byte(node.Value), &notice)
+			notices = append(notices, notice)
+		}
+	}
+	return &notices, nil
+}
+
+func (s *EtcdHelper) PutNotice(uid string, notice *api.Notice) error {
+	data, err := json.Marshal(notice)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	_, err = s.etcd.Set(context.Background(), etcdBasePath+"/accounts/"+uid+"/notices/"+notice.Id, string(data), nil)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	return nil
+}
+
+// DeleteNotice returns false if the notice does not exist
+func (s *EtcdHelper) DeleteNotice(uid string, id string) (bool, error) {
+	_, err := s.etcd.Delete(context.Background(), etcdBasePath+"/accounts/"+uid+"/notices/"+id, nil)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
 func (s *EtcdHelper) PutVocabulary(name string, vocabulary *api.Vocabulary) error {
 	data, err := json.Marshal(vocabulary)
 	if err != nil {
@@ -356,3 +616,33 @@ func (s *EtcdHelper) GetVocabulary(name string) (*api.Vocabulary, error) {
 	}
 	return nil, nil
 }
+
+// GetSyncedSpecs returns the keys of system catalog specs loaded from the
+// specs directory, mapped to the checksum of the loaded spec
+func (s *EtcdHelper) GetSyncedSpecs() (map[string]string, error) {
+	synced := map[string]string{}
+	resp, err := s.etcd.Get(context.Background(), etcdBasePath+"/synced/specs", nil)
+	if err != nil {
+		if !client.IsKeyNotFound(err) {
+			glog.Error(err)
+			return nil, err
+		}
+	} else {
+		json.Unmarshal([]byte(resp.Node.Value), &synced)
+	}
+	return synced, nil
+}
+
+func (s *EtcdHelper) PutSyncedSpecs(synced map[string]string) error {
+	data, err := json.Marshal(synced)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	_, err = s.etcd.Set(context.Background(), etcdBasePath+"/synced/specs", string(data), nil)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,437 @@
+// Copyright © 2016 National Data Service
+package fsm
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/ndslabs/apiserver/graph"
+)
+
+// StackState is the status of a stack
+type StackState string
+
+const (
+	StackStopped  StackState = "stopped"
+	StackStarting StackState = "starting"
+	StackStarted  StackState = "started"
+	StackStopping StackState = "stopping"
+	StackError    StackState = "error"
+)
+
+// ServiceState is the status of a service in a stack
+type ServiceState string
+
+const (
+	ServiceWaiting  ServiceState = "waiting"
+	ServiceStarting ServiceState = "starting"
+	ServiceReady    ServiceState = "ready"
+	ServiceError    ServiceState = "error"
+	ServiceStopping ServiceState = "stopping"
+	ServiceStopped  ServiceState = "stopped"
+)
+
+var stackTransitions = map[StackState][]StackState{
+	StackStopped:  {StackStarting, StackStopping},
+	StackStarting: {StackStarted, StackError, StackStopping},
+	StackStarted:  {StackError, StackStopping},
+	StackError:    {StackStopping},
+	StackStopping: {StackStopped},
+}
+
+var serviceTransitions = map[ServiceState][]ServiceState{
+	ServiceWaiting:  {ServiceStarting, ServiceStopped},
+	ServiceStarting: {ServiceReady, ServiceError, ServiceStopping},
+	ServiceReady:    {ServiceError, ServiceStopping},
+	ServiceError:    {ServiceStopping},
+	ServiceStopping: {ServiceStopped},
+	ServiceStopped:  {ServiceStarting, ServiceStopping},
+}
+
+// CanTransition returns true if a stack can go from one state to the other
+func CanTransition(from StackState, to StackState) bool {
+	for _, state := range stackTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// CanTransitionService returns true if a service can go from one state to
+// the other
+func CanTransitionService(from ServiceState, to ServiceState) bool {
+	for _, state := range serviceTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Actions carries out the machine's decisions. StartService and StopService
+// run on the worker pool and return true if the service is already ready or
+// stopped, otherwise the outcome is reported through ServiceEvent. Update
+// records a change of state, with an optional message for services, and is
+// called from the machine's goroutine.
+type Actions interface {
+	StartService(key string) (bool, error)
+	StopService(key string) (bool, error)
+	UpdateStack(state StackState)
+	UpdateService(key string, state ServiceState, message string)
+}
+
+// Timeouts bound how long a service may take to become ready or stop, and
+// how long the whole stack may take to start. Zero means no limit.
+type Timeouts struct {
+	Service time.Duration
+	Stack   time.Duration
+}
+
+type event struct {
+	key     string
+	state   ServiceState
+	message string
+}
+
+// Machine starts or stops the services of one stack in dependency order,
+// driven by service events rather than polling. A machine runs once.
+type Machine struct {
+	graph     *graph.Graph
+	actions   Actions
+	pool      *Pool
+	timeouts  Timeouts
+	state     StackState
+	services  map[string]ServiceState
+	deadlines map[string]time.Time
+	mutex     sync.Mutex
+	events    []event
+	notify    chan struct{}
+	cancel    chan struct{}
+	done      chan struct{}
+	once      sync.Once
+	cancelled sync.Once
+}
+
+// New creates the machine for a stack of the services in the graph
+func New(g *graph.Graph, actions Actions, pool *Pool, timeouts Timeouts) *Machine {
+	return &Machine{
+		graph:     g,
+		actions:   actions,
+		pool:      pool,
+		timeouts:  timeouts,
+		state:     StackStopped,
+		services:  map[string]ServiceState{},
+		deadlines: map[string]time.Time{},
+		notify:    make(chan struct{}, 1),
+		cancel:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start starts the services, each once its dependencies are ready, and
+// returns when all are ready, one fails or times out, or the start is
+// cancelled and the services are stopped again.
+func (m *Machine) Start() StackState {
+	m.run(func() {
+		m.setState(StackStarting)
+		for _, key := range m.graph.Keys() {
+			m.services[key] = ServiceWaiting
+			m.actions.UpdateService(key, ServiceWaiting, "")
+		}
+		m.loop()
+	})
+	return m.state
+}
+
+// Stop stops the services, each once its dependents are stopped
+func (m *Machine) Stop() StackState {
+	m.run(func() {
+		for _, key := range m.graph.Keys() {
+			m.services[key] = ServiceReady
+		}
+		m.stop()
+		m.loop()
+	})
+	return m.state
+}
+
+// Close finishes a machine that is not needed without running it
+func (m *Machine) Close() {
+	m.run(func() {})
+}
+
+// Cancel asks a starting machine to stop the stack instead. The machine
+// stops as soon as it runs if it has not yet.
+func (m *Machine) Cancel() {
+	m.cancelled.Do(func() { close(m.cancel) })
+}
+
+// Done is closed when the machine has finished
+func (m *Machine) Done() <-chan struct{} {
+	return m.done
+}
+
+// ServiceEvent reports a change in the state of a service, usually from the
+// pod and replication controller watches. It does not block. Events that do
+// not apply to the current state, or arrive after the machine has finished,
+// are ignored.
+func (m *Machine) ServiceEvent(key string, state ServiceState, message string) {
+	m.mutex.Lock()
+	m.events = append(m.events, event{key: key, state: state, message: message})
+	m.mutex.Unlock()
+
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Machine) takeEvents() []event {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	events := m.events
+	m.events = nil
+	return events
+}
+
+func (m *Machine) run(f func()) {
+	ran := false
+	m.once.Do(func() {
+		ran = true
+		f()
+		close(m.done)
+	})
+	if !ran {
+		<-m.done
+	}
+}
+
+func (m *Machine) loop() {
+	var stackDeadline <-chan time.Time
+	if m.state == StackStarting && m.timeouts.Stack > 0 {
+		timer := time.NewTimer(m.timeouts.Stack)
+		defer timer.Stop()
+		stackDeadline = timer.C
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	cancel := m.cancel
+	if m.state == StackStarting {
+		select {
+		case <-cancel:
+			cancel = nil
+			m.stop()
+		default:
+			m.startReady()
+			if m.allServices(ServiceReady) {
+				m.setState(StackStarted)
+			}
+		}
+	}
+	for !m.finished() {
+		select {
+		case <-m.notify:
+			for _, e := range m.takeEvents() {
+				if !m.finished() {
+					m.handle(e)
+				}
+			}
+		case <-cancel:
+			cancel = nil
+			if m.state == StackStarting {
+				glog.V(4).Infoln("Start cancelled, stopping")
+				m.stop()
+			}
+		case <-stackDeadline:
+			if m.state == StackStarting {
+				m.fail("", fmt.Sprintf("Stack did not start within %s", m.timeouts.Stack))
+			}
+		case now := <-ticker.C:
+			m.checkDeadlines(now)
+		}
+	}
+}
+
+// The machine finishes when the stack is started, stopped or in error
+func (m *Machine) finished() bool {
+	return m.state == StackStarted || m.state == StackStopped || m.state == StackError
+}
+
+func (m *Machine) handle(e event) {
+	current, ok := m.services[e.key]
+	if !ok {
+		return
+	}
+
+	switch m.state {
+	case StackStarting:
+		if current == e.state {
+			return
+		}
+		switch e.state {
+		case ServiceReady:
+			if current != ServiceStarting {
+				return
+			}
+			m.setService(e.key, ServiceReady, e.message)
+			if m.allServices(ServiceReady) {
+				m.setState(StackStarted)
+			} else {
+				m.startReady()
+			}
+		case ServiceError:
+			if current == ServiceStarting || current == ServiceReady {
+				m.fail(e.key, e.message)
+			}
+		}
+	case StackStopping:
+		if e.state == ServiceStopped && current == ServiceStopping {
+			m.setService(e.key, ServiceStopped, e.message)
+			m.stopReady()
+		}
+	}
+}
+
+// Start the waiting services whose dependencies are ready
+func (m *Machine) startReady() {
+	for _, key := range m.graph.Keys() {
+		if m.services[key] != ServiceWaiting {
+			continue
+		}
+		ready := true
+		for _, dep := range m.graph.Dependencies(key) {
+			if m.services[dep] != ServiceReady {
+				ready = false
+			}
+		}
+		if !ready {
+			continue
+		}
+
+		m.setService(key, ServiceStarting, "")
+		key := key
+		m.pool.Submit(func() {
+			running, err := m.actions.StartService(key)
+			if err != nil {
+				m.ServiceEvent(key, ServiceError, err.Error())
+			} else if running {
+				m.ServiceEvent(key, ServiceReady, "")
+			}
+		})
+	}
+}
+
+// Switch to stopping and stop the services that nothing depends on
+func (m *Machine) stop() {
+	m.setState(StackStopping)
+	for key, state := range m.services {
+		if state == ServiceWaiting {
+			m.setService(key, ServiceStopped, "")
+		}
+	}
+	m.stopReady()
+}
+
+// Stop the services whose dependents have stopped
+func (m *Machine) stopReady() {
+	for _, key := range m.graph.Keys() {
+		state := m.services[key]
+		if state == ServiceStopped || state == ServiceStopping {
+			continue
+		}
+		ready := true
+		for _, dependent := range m.graph.Dependents(key) {
+			if m.services[dependent] != ServiceStopped {
+				ready = false
+			}
+		}
+		if !ready {
+			continue
+		}
+
+		m.setService(key, ServiceStopping, "")
+		key := key
+		m.pool.Submit(func() {
+			stopped, err := m.actions.StopService(key)
+			if err != nil {
+				glog.Error(err)
+				m.ServiceEvent(key, ServiceStopped, err.Error())
+			} else if stopped {
+				m.ServiceEvent(key, ServiceStopped, "")
+			}
+		})
+	}
+
+	if m.allServices(ServiceStopped) {
+		m.setState(StackStopped)
+	}
+}
+
+// Services that take too long to start fail the stack, services that take
+// too long to stop are taken as stopped
+func (m *Machine) checkDeadlines(now time.Time) {
+	for key, deadline := range m.deadlines {
+		if now.Before(deadline) {
+			continue
+		}
+		switch m.services[key] {
+		case ServiceStarting:
+			m.fail(key, fmt.Sprintf("Service did not become ready within %s", m.timeouts.Service))
+		case ServiceStopping:
+			m.setService(key, ServiceStopped, fmt.Sprintf("Service did not stop within %s", m.timeouts.Service))
+			m.stopReady()
+		}
+	}
+}
+
+// A failed service leaves the stack in error, with the services that are
+// running left for the user to inspect and stop
+func (m *Machine) fail(key string, message string) {
+	if key != "" {
+		m.setService(key, ServiceError, message)
+	} else {
+		glog.Warningln(message)
+	}
+	for key, state := range m.services {
+		if state == ServiceWaiting {
+			m.setService(key, ServiceStopped, "")
+		}
+	}
+	m.setState(StackError)
+}
+
+func (m *Machine) allServices(state ServiceState) bool {
+	for _, current := range m.services {
+		if current != state {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Machine) setState(state StackState) {
+	if !CanTransition(m.state, state) {
+		glog.Warningf("Invalid stack transition from %s to %s\n", m.state, state)
+		return
+	}
+	m.state = state
+	m.actions.UpdateStack(state)
+}
+
+func (m *Machine) setService(key string, state ServiceState, message string) {
+	if !CanTransitionService(m.services[key], state) {
+		glog.Warningf("Invalid transition of service %s from %s to %s\n", key, m.services[key], state)
+		return
+	}
+	m.services[key] = state
+
+	delete(m.deadlines, key)
+	if (state == ServiceStarting || state == ServiceStopping) && m.timeouts.Service > 0 {
+		m.deadlines[key] = time.Now().Add(m.timeouts.Service)
+	}
+	m.actions.UpdateService(key, state, message)
+}
@@ -0,0 +1,170 @@
+package fsm
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ndslabs/apiserver/graph"
+	api "github.com/ndslabs/apiserver/types"
+)
+
+// Actions that report services ready or stopped shortly after they are
+// started or stopped, unless told otherwise
+type testActions struct {
+	mutex   sync.Mutex
+	machine *Machine
+	started []string
+	stopped []string
+	fail    map[string]bool
+	hang    map[string]bool
+	states  map[string]ServiceState
+}
+
+func (a *testActions) StartService(key string) (bool, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.started = append(a.started, key)
+	if a.fail[key] {
+		go a.machine.ServiceEvent(key, ServiceError, "Reason=Failed")
+	} else if !a.hang[key] {
+		go a.machine.ServiceEvent(key, ServiceReady, "")
+	}
+	return false, nil
+}
+
+func (a *testActions) StopService(key string) (bool, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.stopped = append(a.stopped, key)
+	go a.machine.ServiceEvent(key, ServiceStopped, "")
+	return false, nil
+}
+
+func (a *testActions) UpdateStack(state StackState) {}
+
+func (a *testActions) UpdateService(key string, state ServiceState, message string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.states[key] = state
+}
+
+// clowder depends on mongo and rabbitmq, image-preview on rabbitmq
+func newTestMachine(t *testing.T, timeouts Timeouts) (*Machine, *testActions) {
+	deps := map[string][]string{
+		"clowder":       {"mongo", "rabbitmq"},
+		"mongo":         {},
+		"rabbitmq":      {},
+		"image-preview": {"rabbitmq"},
+	}
+	lookup := func(key string) *api.ServiceSpec {
+		spec := &api.ServiceSpec{Key: key}
+		for _, dep := range deps[key] {
+			spec.Dependencies = append(spec.Dependencies, api.ServiceDependency{DependencyKey: dep})
+		}
+		return spec
+	}
+	g, err := graph.New([]string{"clowder", "mongo", "rabbitmq", "image-preview"}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := &testActions{fail: map[string]bool{}, hang: map[string]bool{}, states: map[string]ServiceState{}}
+	actions.machine = New(g, actions, NewPool(2), timeouts)
+	return actions.machine, actions
+}
+
+func indexOf(keys []string, key string) int {
+	for i := range keys {
+		if keys[i] == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestStart(t *testing.T) {
+	m, actions := newTestMachine(t, Timeouts{})
+	if state := m.Start(); state != StackStarted {
+		t.Fatalf("Expected started, got %s", state)
+	}
+	if len(actions.started) != 4 || indexOf(actions.started, "clowder") < indexOf(actions.started, "mongo") ||
+		indexOf(actions.started, "image-preview") < indexOf(actions.started, "rabbitmq") {
+		t.Errorf("Services started out of order: %v", actions.started)
+	}
+	for key, state := range actions.states {
+		if state != ServiceReady {
+			t.Errorf("Expected %s to be ready, got %s", key, state)
+		}
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	m, actions := newTestMachine(t, Timeouts{})
+	actions.fail["mongo"] = true
+	if state := m.Start(); state != StackError {
+		t.Fatalf("Expected error, got %s", state)
+	}
+	if indexOf(actions.started, "clowder") >= 0 {
+		t.Errorf("Expected clowder not to start, got %v", actions.started)
+	}
+	if actions.states["mongo"] != ServiceError {
+		t.Errorf("Expected mongo in error, got %s", actions.states["mongo"])
+	}
+}
+
+func TestServiceTimeout(t *testing.T) {
+	m, actions := newTestMachine(t, Timeouts{Service: time.Second})
+	actions.hang["rabbitmq"] = true
+
+	done := make(chan StackState)
+	go func() { done <- m.Start() }()
+	select {
+	case state := <-done:
+		if state != StackError || actions.states["rabbitmq"] != ServiceError {
+			t.Errorf("Expected timeout error, got %s %s", state, actions.states["rabbitmq"])
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Start did not time out")
+	}
+}
+
+func TestCancel(t *testing.T) {
+	m, actions := newTestMachine(t, Timeouts{})
+	actions.hang["clowder"] = true
+
+	done := make(chan StackState)
+	go func() { done <- m.Start() }()
+	for {
+		actions.mutex.Lock()
+		starting := actions.states["clowder"] == ServiceStarting
+		actions.mutex.Unlock()
+		if starting {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.Cancel()
+
+	if state := <-done; state != StackStopped {
+		t.Fatalf("Expected stopped, got %s", state)
+	}
+	if indexOf(actions.stopped, "mongo") < indexOf(actions.stopped, "clowder") ||
+		indexOf(actions.stopped, "rabbitmq") < indexOf(actions.stopped, "image-preview") {
+		t.Errorf("Services stopped out of order: %v", actions.stopped)
+	}
+	<-m.Done()
+}
+
+func TestTransitions(t *testing.T) {
+	if !CanTransition(StackStarting, StackStopping) || CanTransition(StackStopped, StackStarted) {
+		t.Error("Unexpected stack transitions")
+	}
+	if !CanTransitionService(ServiceWaiting, ServiceStarting) || CanTransitionService(ServiceWaiting, ServiceReady) {
+		t.Error("Unexpected service transitions")
+	}
+	if !reflect.DeepEqual(stackTransitions[StackStopping], []StackState{StackStopped}) {
+		t.Error("Stopping can only end in stopped")
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright © 2016 National Data Service
+package fsm
+
+import (
+	"sync"
+)
+
+// Pool runs jobs on a fixed number of workers. Jobs are queued without limit,
+// so submitting never blocks the machines.
+type Pool struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	jobs  []func()
+}
+
+// NewPool starts a pool with the given number of workers, at least one
+func NewPool(workers int) *Pool {
+	p := &Pool{}
+	p.cond = sync.NewCond(&p.mutex)
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Submit queues a job
+func (p *Pool) Submit(job func()) {
+	p.mutex.Lock()
+	p.jobs = append(p.jobs, job)
+	p.mutex.Unlock()
+	p.cond.Signal()
+}
+
+func (p *Pool) work() {
+	for {
+		p.mutex.Lock()
+		for len(p.jobs) == 0 {
+			p.cond.Wait()
+		}
+		job := p.jobs[0]
+		p.jobs = p.jobs[1:]
+		p.mutex.Unlock()
+
+		job()
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright © 2016 National Data Service
+package graph
+
+import (
+	"fmt"
+	"strings"
+
+	api "github.com/ndslabs/apiserver/types"
+)
+
+// SpecLookup returns the catalog spec with the given key or nil if none exists
+type SpecLookup func(key string) *api.ServiceSpec
+
+// CycleError is returned when the dependencies of a set of services form a
+// cycle. Cycle lists the keys along the loop, starting and ending with the
+// same key.
+type CycleError struct {
+	Cycle []string
+}
+
+func (e *CycleError) Error() string {
+	return "Dependency cycle: " + strings.Join(e.Cycle, " -> ")
+}
+
+// MissingError is returned when a service, or one of its dependencies, is
+// not in the catalog.
+type MissingError struct {
+	Key    string
+	Parent string
+}
+
+func (e *MissingError) Error() string {
+	if e.Parent == "" {
+		return fmt.Sprintf("No such service %s", e.Key)
+	}
+	return fmt.Sprintf("Service %s depends on unknown service %s", e.Parent, e.Key)
+}
+
+// Graph holds a set of services and the dependencies between them.
+// Dependencies on services outside of the set are ignored, so a graph built
+// from the services of a stack only orders the services in that stack.
+type Graph struct {
+	keys       []string
+	deps       map[string][]string
+	dependents map[string][]string
+}
+
+// New builds the graph for the given services. Keys are kept in the order
+// given, which determines the order of otherwise independent services.
+func New(keys []string, lookup SpecLookup) (*Graph, error) {
+	g := &Graph{
+		deps:       map[string][]string{},
+		dependents: map[string][]string{},
+	}
+
+	members := map[string]bool{}
+	for _, key := range keys {
+		if !members[key] {
+			members[key] = true
+			g.keys = append(g.keys, key)
+		}
+	}
+
+	for _, key := range g.keys {
+		spec := lookup(key)
+		if spec == nil {
+			return nil, &MissingError{Key: key}
+		}
+		for _, dep := range spec.Dependencies {
+			if members[dep.DependencyKey] {
+				g.deps[key] = append(g.deps[key], dep.DependencyKey)
+				g.dependents[dep.DependencyKey] = append(g.dependents[dep.DependencyKey], key)
+			}
+		}
+	}
+	return g, nil
+}
+
+// Keys returns the services in the graph
+func (g *Graph) Keys() []string {
+	return g.keys
+}
+
+// Dependencies returns the services in the graph that key depends on
+func (g *Graph) Dependencies(key string) []string {
+	return g.deps[key]
+}
+
+// Dependents returns the services in the graph that depend on key
+func (g *Graph) Dependents(key string) []string {
+	return g.dependents[key]
+}
+
+// StartOrder returns the services ordered so that each service comes after
+// all of its dependencies.
+func (g *Graph) StartOrder() ([]string, error) {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	path := []string{}
+	order := []string{}
+
+	var visit func(key string) error
+	visit = func(key string) error {
+		switch state[key] {
+		case visited:
+			return nil
+		case visiting:
+			for i := range path {
+				if path[i] == key {
+					cycle := append([]string{}, path[i:]...)
+					return &CycleError{Cycle: append(cycle, key)}
+				}
+			}
+		}
+
+		state[key] = visiting
+		path = append(path, key)
+		for _, dep := range g.deps[key] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[key] = visited
+		order = append(order, key)
+		return nil
+	}
+
+	for _, key := range g.keys {
+		if err := visit(key); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// StopOrder returns the services ordered so that each service comes before
+// all of its dependencies.
+func (g *Graph) StopOrder() ([]string, error) {
+	order, err := g.StartOrder()
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	return order, nil
+}
+
+// Closure returns key followed by every service reachable through its
+// dependencies. If requiredOnly is set, optional dependencies are not
+// followed. Missing services are skipped and the first one found is
+// returned as a MissingError along with the rest of the closure.
+func Closure(key string, lookup SpecLookup, requiredOnly bool) ([]string, error) {
+	var missing error
+	seen := map[string]bool{key: true}
+	keys := []string{}
+
+	if lookup(key) == nil {
+		return keys, &MissingError{Key: key}
+	}
+	queue := []string{key}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		keys = append(keys, current)
+
+		spec := lookup(current)
+		for _, dep := range spec.Dependencies {
+			if (requiredOnly && !dep.Required) || seen[dep.DependencyKey] {
+				continue
+			}
+			seen[dep.DependencyKey] = true
+			if lookup(dep.DependencyKey) == nil {
+				if missing == nil {
+					missing = &MissingError{Key: dep.DependencyKey, Parent: current}
+				}
+				continue
+			}
+			queue = append(queue, dep.DependencyKey)
+		}
+	}
+	return keys, missing
+}
+
+// FindCycle returns the first dependency cycle reachable from key, or nil
+func FindCycle(key string, lookup SpecLookup) []string {
+	keys, _ := Closure(key, lookup, false)
+	g, err := New(keys, lookup)
+	if err != nil {
+		return nil
+	}
+	if _, err := g.StartOrder(); err != nil {
+		if cycle, ok := err.(*CycleError); ok {
+			return cycle.Cycle
+		}
+	}
+	return nil
+}
+
+// Resolve computes the dependency graph of a service: the services it
+// requires, the optional services that can be added with it, and the order
+// in which all of them are started and stopped.
+func Resolve(key string, lookup SpecLookup) (*api.ServiceGraph, error) {
+	spec := lookup(key)
+	if spec == nil {
+		return nil, &MissingError{Key: key}
+	}
+	if cycle := FindCycle(key, lookup); cycle != nil {
+		return nil, &CycleError{Cycle: cycle}
+	}
+
+	required, err := Closure(key, lookup, true)
+	if err != nil {
+		return nil, err
+	}
+	included := map[string]bool{}
+	for _, k := range required {
+		included[k] = true
+	}
+
+	// Adding an optional service also adds the services it requires
+	optional := []string{}
+	for _, dep := range spec.Dependencies {
+		if dep.Required {
+			continue
+		}
+		keys, err := Closure(dep.DependencyKey, lookup, true)
+		if err != nil {
+			if missing, ok := err.(*MissingError); ok && missing.Parent == "" {
+				missing.Parent = key
+			}
+			return nil, err
+		}
+		for _, k := range keys {
+			if !included[k] {
+				included[k] = true
+				optional = append(optional, k)
+			}
+		}
+	}
+
+	g, err := New(append(append([]string{}, required...), optional...), lookup)
+	if err != nil {
+		return nil, err
+	}
+	start, err := g.StartOrder()
+	if err != nil {
+		return nil, err
+	}
+	stop, _ := g.StopOrder()
+
+	return &api.ServiceGraph{
+		Key:        key,
+		Required:   required[1:],
+		Optional:   optional,
+		StartOrder: start,
+		StopOrder:  stop,
+	}, nil
+}
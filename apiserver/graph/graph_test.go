@@ -0,0 +1,107 @@
+package graph
+
+import (
+	"reflect"
+	"testing"
+
+	api "github.com/ndslabs/apiserver/types"
+)
+
+type dep struct {
+	key      string
+	required bool
+}
+
+func catalog(specs map[string][]dep) SpecLookup {
+	return func(key string) *api.ServiceSpec {
+		deps, ok := specs[key]
+		if !ok {
+			return nil
+		}
+		spec := &api.ServiceSpec{Key: key}
+		for _, d := range deps {
+			spec.Dependencies = append(spec.Dependencies, api.ServiceDependency{DependencyKey: d.key, Required: d.required})
+		}
+		return spec
+	}
+}
+
+func TestResolve(t *testing.T) {
+	lookup := catalog(map[string][]dep{
+		"clowder":       {{"mongo", true}, {"rabbitmq", true}, {"image-preview", false}},
+		"mongo":         {},
+		"rabbitmq":      {},
+		"image-preview": {{"rabbitmq", true}, {"imagemagick", true}},
+		"imagemagick":   {},
+	})
+
+	g, err := Resolve("clowder", lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &api.ServiceGraph{
+		Key:        "clowder",
+		Required:   []string{"mongo", "rabbitmq"},
+		Optional:   []string{"image-preview", "imagemagick"},
+		StartOrder: []string{"mongo", "rabbitmq", "imagemagick", "image-preview", "clowder"},
+		StopOrder:  []string{"clowder", "image-preview", "imagemagick", "rabbitmq", "mongo"},
+	}
+	if !reflect.DeepEqual(g, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, g)
+	}
+}
+
+func TestResolveMissing(t *testing.T) {
+	lookup := catalog(map[string][]dep{
+		"clowder": {{"mongo", true}},
+	})
+
+	_, err := Resolve("clowder", lookup)
+	missing, ok := err.(*MissingError)
+	if !ok || missing.Key != "mongo" || missing.Parent != "clowder" {
+		t.Errorf("Expected missing mongo, got %v", err)
+	}
+}
+
+func TestCycle(t *testing.T) {
+	lookup := catalog(map[string][]dep{
+		"a": {{"b", true}},
+		"b": {{"c", false}},
+		"c": {{"a", true}},
+	})
+
+	cycle := FindCycle("a", lookup)
+	if !reflect.DeepEqual(cycle, []string{"a", "b", "c", "a"}) {
+		t.Errorf("Unexpected cycle %v", cycle)
+	}
+
+	_, err := Resolve("a", lookup)
+	if _, ok := err.(*CycleError); !ok {
+		t.Errorf("Expected cycle error, got %v", err)
+	}
+}
+
+func TestStackGraph(t *testing.T) {
+	// Dependencies outside of the stack are ignored
+	lookup := catalog(map[string][]dep{
+		"clowder":       {{"mongo", true}, {"image-preview", false}},
+		"mongo":         {},
+		"image-preview": {},
+	})
+
+	g, err := New([]string{"clowder", "mongo"}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g.Dependencies("clowder"), []string{"mongo"}) {
+		t.Errorf("Unexpected dependencies %v", g.Dependencies("clowder"))
+	}
+	if !reflect.DeepEqual(g.Dependents("mongo"), []string{"clowder"}) {
+		t.Errorf("Unexpected dependents %v", g.Dependents("mongo"))
+	}
+	order, _ := g.StopOrder()
+	if !reflect.DeepEqual(order, []string{"clowder", "mongo"}) {
+		t.Errorf("Unexpected stop order %v", order)
+	}
+}
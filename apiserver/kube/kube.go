@@ -17,7 +17,9 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/ndslabs/apiserver/events"
+	"github.com/ndslabs/apiserver/registry"
 	ndsapi "github.com/ndslabs/apiserver/types"
+	"github.com/ndslabs/apiserver/vcs"
 	"golang.org/x/net/websocket"
 	"k8s.io/kubernetes/pkg/api"
 	"k8s.io/kubernetes/pkg/api/resource"
@@ -34,11 +36,17 @@ import (
 var apiBase = "/api/v1"
 var extBase = "/apis/extensions/v1beta1"
 
+const (
+	initContainersAnnotation        = "pod.alpha.kubernetes.io/init-containers"
+	initContainerStatusesAnnotation = "pod.alpha.kubernetes.io/init-container-statuses"
+)
+
 type ServiceAddrPort struct {
 	Name     string
 	Host     string
 	Port     int32
 	NodePort int32
+	Protocol api.Protocol
 }
 
 type KubeHelper struct {
@@ -726,11 +734,14 @@ func (k *KubeHelper) CreateServiceTemplate(name string, stack string, spec *ndsa
 	if len(spec.Ports) > 0 {
 		for _, port := range spec.Ports {
 			k8port := api.ServicePort{
-				Name: fmt.Sprintf("%d", port.Port),
-				Port: port.Port,
+				Name:     fmt.Sprintf("%d", port.Port),
+				Port:     port.Port,
+				Protocol: PortProtocol(port),
+			}
+			// Port names must be unique when a port is both TCP and UDP
+			if k8port.Protocol == api.ProtocolUDP {
+				k8port.Name += "-udp"
 			}
-			// For now, assume all ports are TCP
-			k8port.Protocol = api.ProtocolTCP
 			k8svc.Spec.Ports = append(k8svc.Spec.Ports, k8port)
 		}
 	}
@@ -738,7 +749,163 @@ func (k *KubeHelper) CreateServiceTemplate(name string, stack string, spec *ndsa
 	return &k8svc
 }
 
-func (k *KubeHelper) CreateControllerTemplate(ns string, name string, stack string, stackService *ndsapi.StackService, spec *ndsapi.ServiceSpec, links *map[string]ServiceAddrPort, sharedEnv *map[string]string) *api.ReplicationController {
+// PortProtocol returns the Kubernetes protocol of a spec port. Protocols other
+// than udp, such as http, are carried over TCP.
+func PortProtocol(port ndsapi.Port) api.Protocol {
+	if strings.ToLower(port.Protocol) == "udp" {
+		return api.ProtocolUDP
+	}
+	return api.ProtocolTCP
+}
+
+// Create a sidecar or init container. Containers get the namespace and their
+// own config as environment, but not the service's links or config.
+func createContainer(ns string, container *ndsapi.Container) api.Container {
+	env := []api.EnvVar{{Name: "NAMESPACE", Value: ns}}
+	for _, config := range container.Config {
+		env = append(env, api.EnvVar{Name: config.Name, Value: config.Value})
+	}
+
+	k8volMounts := []api.VolumeMount{}
+	for _, vol := range container.VolumeMounts {
+		k8volMounts = append(k8volMounts, api.VolumeMount{Name: vol.Name, MountPath: vol.MountPath})
+	}
+
+	tag := "latest"
+	if len(container.Image.Tags) > 0 {
+		tag = container.Image.Tags[0]
+	}
+
+	return api.Container{
+		Name:         container.Name,
+		Image:        registry.ImageRef(container.Image, tag, ""),
+		Env:          env,
+		VolumeMounts: k8volMounts,
+		Args:         container.Args,
+		Command:      container.Command,
+		Resources:    createResourceRequirements(container.ResourceLimits),
+	}
+}
+
+// Create a Kubernetes probe, or nil if the probe has no type
+func createProbe(probe ndsapi.ReadyProbe) *api.Probe {
+	k8probe := &api.Probe{
+		InitialDelaySeconds: probe.InitialDelay,
+		TimeoutSeconds:      probe.Timeout,
+		PeriodSeconds:       probe.Period,
+		SuccessThreshold:    probe.SuccessThreshold,
+		FailureThreshold:    probe.FailureThreshold,
+	}
+	switch probe.Type {
+	case "http":
+		k8probe.HTTPGet = &api.HTTPGetAction{
+			Path:   probe.Path,
+			Port:   intstr.FromInt(probe.Port),
+			Scheme: api.URISchemeHTTP,
+		}
+	case "tcp":
+		k8probe.TCPSocket = &api.TCPSocketAction{
+			Port: intstr.FromInt(probe.Port),
+		}
+	case "exec":
+		k8probe.Exec = &api.ExecAction{
+			Command: probe.Command,
+		}
+	default:
+		return nil
+	}
+	return k8probe
+}
+
+func createResourceRequirements(limits ndsapi.ResourceLimits) api.ResourceRequirements {
+	k8rq := api.ResourceRequirements{}
+	if limits.CPUMax > 0 && limits.MemoryMax > 0 {
+		k8rq.Limits = api.ResourceList{
+			api.ResourceCPU:    resource.MustParse(fmt.Sprintf("%dm", limits.CPUMax)),
+			api.ResourceMemory: resource.MustParse(fmt.Sprintf("%dM", limits.MemoryMax)),
+		}
+		k8rq.Requests = api.ResourceList{
+			api.ResourceCPU:    resource.MustParse(fmt.Sprintf("%dm", limits.CPUMax)),
+			api.ResourceMemory: resource.MustParse(fmt.Sprintf("%dM", limits.MemoryMax)),
+		}
+	}
+	return k8rq
+}
+
+// InitContainerStatuses returns the status of the pod's init containers,
+// which this API version reports in an annotation
+func InitContainerStatuses(pod *api.Pod) []api.ContainerStatus {
+	statuses := []api.ContainerStatus{}
+	data, ok := pod.Annotations[initContainerStatusesAnnotation]
+	if ok {
+		json.Unmarshal([]byte(data), &statuses)
+	}
+	return statuses
+}
+
+// Password config values for a stack are kept in a secret rather than etcd
+func ConfigSecretName(stack string) string {
+	return stack + "-config"
+}
+
+// The key of a password config value in the stack's config secret
+func ConfigSecretKey(service string, name string) string {
+	return service + "." + name
+}
+
+// The key of the values generated by {{ random N }} for a config value, kept
+// in the stack's config secret so they stay the same from start to start
+func RandomSecretKey(service string, name string) string {
+	return service + "." + name + RandomSecretSuffix
+}
+
+const RandomSecretSuffix = ".random"
+
+// The key of an evaluated config value that contains a password or random
+// value, so it is not passed to the pod in clear text
+func ValueSecretKey(service string, name string) string {
+	return service + "." + name + ValueSecretSuffix
+}
+
+const ValueSecretSuffix = ".value"
+
+func secretEnvVar(stack string, name string, key string) api.EnvVar {
+	return api.EnvVar{
+		Name: name,
+		ValueFrom: &api.EnvVarSource{
+			SecretKeyRef: &api.SecretKeySelector{
+				LocalObjectReference: api.LocalObjectReference{Name: ConfigSecretName(stack)},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+// The stack's config secret with the placeholder as the value of each key,
+// for exports that leave out the values
+func (k *KubeHelper) CreateSecretTemplate(stack string, keys []string, placeholder string) *api.Secret {
+	secret := api.Secret{
+		TypeMeta: unversioned.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: api.ObjectMeta{
+			Name: ConfigSecretName(stack),
+			Labels: map[string]string{
+				"stack": stack,
+			},
+		},
+		Data: map[string][]byte{},
+	}
+	for _, key := range keys {
+		secret.Data[key] = []byte(placeholder)
+	}
+	return &secret
+}
+
+// sharedSecrets maps environment variables shared by dependencies to keys in
+// the stack's config secret
+func (k *KubeHelper) CreateControllerTemplate(ns string, name string, stack string, stackService *ndsapi.StackService, spec *ndsapi.ServiceSpec, links *map[string]ServiceAddrPort, sharedEnv *map[string]string, sharedSecrets *map[string]string) *api.ReplicationController {
 
 	k8rc := api.ReplicationController{}
 	// Replication controller
@@ -771,27 +938,46 @@ func (k *KubeHelper) CreateControllerTemplate(ns string, name string, stack stri
 			continue
 		}
 
+		protocol := api.ProtocolTCP
+		if addrPort.Protocol != "" {
+			protocol = addrPort.Protocol
+		}
+
 		env = append(env,
 			api.EnvVar{
-				Name:  fmt.Sprintf("%s_PORT_%d_TCP_ADDR", strings.ToUpper(name), addrPort.Port),
+				Name:  fmt.Sprintf("%s_PORT_%d_%s_ADDR", strings.ToUpper(name), addrPort.Port, protocol),
 				Value: addrPort.Host,
 			})
 
 		env = append(env,
 			api.EnvVar{
-				Name:  fmt.Sprintf("%s_PORT_%d_TCP_PORT", strings.ToUpper(name), addrPort.Port),
+				Name:  fmt.Sprintf("%s_PORT_%d_%s_PORT", strings.ToUpper(name), addrPort.Port, protocol),
 				Value: fmt.Sprintf("%d", addrPort.Port),
 			})
 	}
 
+	passwords := map[string]bool{}
+	for _, config := range spec.Config {
+		if config.IsPassword {
+			passwords[config.Name] = true
+			env = append(env, secretEnvVar(stack, config.Name, ConfigSecretKey(spec.Key, config.Name)))
+		}
+	}
+
 	for name, value := range stackService.Config {
-		env = append(env, api.EnvVar{Name: name, Value: value})
+		if !passwords[name] {
+			env = append(env, api.EnvVar{Name: name, Value: value})
+		}
 	}
 
 	for name, value := range *sharedEnv {
 		env = append(env, api.EnvVar{Name: name, Value: value})
 	}
 
+	for name, key := range *sharedSecrets {
+		env = append(env, secretEnvVar(stack, name, key))
+	}
+
 	k8volMounts := []api.VolumeMount{}
 
 	// Mount the home directory
@@ -810,21 +996,13 @@ func (k *KubeHelper) CreateControllerTemplate(ns string, name string, stack stri
 		for _, port := range spec.Ports {
 			k8cp := api.ContainerPort{}
 			k8cp.ContainerPort = port.Port
+			k8cp.Protocol = PortProtocol(port)
 			k8cps = append(k8cps, k8cp)
 		}
 	}
 
-	k8rq := api.ResourceRequirements{}
-	if spec.ResourceLimits.CPUMax > 0 && spec.ResourceLimits.MemoryMax > 0 {
-		k8rq.Limits = api.ResourceList{
-			api.ResourceCPU:    resource.MustParse(fmt.Sprintf("%dm", spec.ResourceLimits.CPUMax)),
-			api.ResourceMemory: resource.MustParse(fmt.Sprintf("%dM", spec.ResourceLimits.MemoryMax)),
-		}
-		k8rq.Requests = api.ResourceList{
-			api.ResourceCPU:    resource.MustParse(fmt.Sprintf("%dm", spec.ResourceLimits.CPUMax)),
-			api.ResourceMemory: resource.MustParse(fmt.Sprintf("%dM", spec.ResourceLimits.MemoryMax)),
-		}
-	} else {
+	k8rq := createResourceRequirements(spec.ResourceLimits)
+	if len(k8rq.Limits) == 0 {
 		glog.Warningf("No resource requirements specified for service %s\n", spec.Label)
 	}
 
@@ -844,7 +1022,7 @@ func (k *KubeHelper) CreateControllerTemplate(ns string, name string, stack stri
 			Containers: []api.Container{
 				api.Container{
 					Name:         spec.Key,
-					Image:        spec.Image.Name + ":" + tag,
+					Image:        registry.ImageRef(spec.Image, tag, stackService.ImageDigest),
 					Env:          env,
 					VolumeMounts: k8volMounts,
 					Ports:        k8cps,
@@ -859,32 +1037,41 @@ func (k *KubeHelper) CreateControllerTemplate(ns string, name string, stack stri
 		},
 	}
 
-	if spec.ReadyProbe.Path != "" {
-		if spec.ReadyProbe.Type == "http" {
-			k8probe := &api.Probe{
-				Handler: api.Handler{
-					HTTPGet: &api.HTTPGetAction{
-						Path:   spec.ReadyProbe.Path,
-						Port:   intstr.FromInt(spec.ReadyProbe.Port),
-						Scheme: api.URISchemeHTTP,
-					},
-				},
-				InitialDelaySeconds: spec.ReadyProbe.InitialDelay,
-				TimeoutSeconds:      spec.ReadyProbe.Timeout,
-			}
-			k8template.Spec.Containers[0].ReadinessProbe = k8probe
-		} else if spec.ReadyProbe.Type == "tcp" {
-			k8probe := &api.Probe{
-				Handler: api.Handler{
-					TCPSocket: &api.TCPSocketAction{
-						Port: intstr.FromInt(spec.ReadyProbe.Port),
-					},
-				},
-				InitialDelaySeconds: spec.ReadyProbe.InitialDelay,
-				TimeoutSeconds:      spec.ReadyProbe.Timeout,
-			}
-			k8template.Spec.Containers[0].ReadinessProbe = k8probe
+	k8template.Spec.Containers[0].ReadinessProbe = createProbe(spec.ReadyProbe)
+	k8template.Spec.Containers[0].LivenessProbe = createProbe(spec.LiveProbe)
+
+	for _, container := range spec.Containers {
+		k8template.Spec.Containers = append(k8template.Spec.Containers, createContainer(ns, &container))
+	}
+
+	// Repositories with a path are checked out into the service's volumes
+	// before the spec's own init containers run
+	for i, repo := range spec.Repositories {
+		if repo.Path == "" {
+			continue
+		}
+		script, err := vcs.Script(repo, stackService.RepositoryRefs[repo.URL])
+		if err != nil {
+			glog.Warningf("Not checking out %s for service %s: %s\n", repo.URL, spec.Key, err)
+			continue
 		}
+		k8template.Spec.InitContainers = append(k8template.Spec.InitContainers, api.Container{
+			Name:         vcs.ContainerName(i),
+			Image:        vcs.Image,
+			Command:      []string{"/bin/sh", "-c", script},
+			VolumeMounts: k8volMounts,
+		})
+	}
+
+	for _, container := range spec.InitContainers {
+		k8template.Spec.InitContainers = append(k8template.Spec.InitContainers, createContainer(ns, &container))
+	}
+
+	if len(k8template.Spec.InitContainers) > 0 {
+		// InitContainers is not serialized in this API version, so it is
+		// passed to Kubernetes as an annotation
+		data, _ := json.Marshal(k8template.Spec.InitContainers)
+		k8template.Annotations = map[string]string{initContainersAnnotation: string(data)}
 	}
 
 	k8rcs := api.ReplicationControllerSpec{
@@ -1146,9 +1333,13 @@ func (k *KubeHelper) Exec(pid string, pod string, container string, kube *KubeHe
 	return &wsHandler
 }
 
-func (k *KubeHelper) CreateIngress(pid string, host string, service string, port int, secretName string) (*extensions.Ingress, error) {
+func (k *KubeHelper) CreateIngressTemplate(pid string, host string, service string, port int, secretName string) *extensions.Ingress {
 
-	ingress := extensions.Ingress{
+	return &extensions.Ingress{
+		TypeMeta: unversioned.TypeMeta{
+			APIVersion: "extensions/v1beta1",
+			Kind:       "Ingress",
+		},
 		ObjectMeta: api.ObjectMeta{
 			Name:      service + "-ingress",
 			Namespace: pid,
@@ -1180,6 +1371,11 @@ func (k *KubeHelper) CreateIngress(pid string, host string, service string, port
 			},
 		},
 	}
+}
+
+func (k *KubeHelper) CreateIngress(pid string, host string, service string, port int, secretName string) (*extensions.Ingress, error) {
+
+	ingress := k.CreateIngressTemplate(pid, host, service, port, secretName)
 
 	data, err := json.Marshal(ingress)
 	if err != nil {
@@ -1203,8 +1399,8 @@ func (k *KubeHelper) CreateIngress(pid string, host string, service string, port
 				return nil, err
 			}
 
-			json.Unmarshal(data, &ingress)
-			return &ingress, nil
+			json.Unmarshal(data, ingress)
+			return ingress, nil
 		} else if httpresp.StatusCode == http.StatusConflict {
 			return nil, fmt.Errorf("Ingress exists for namespace %s: %s\n", pid, httpresp.Status)
 		} else {
@@ -1245,25 +1441,29 @@ func (k *KubeHelper) DeleteIngress(pid string, name string) (*extensions.Ingress
 }
 
 func (k *KubeHelper) CreateTLSSecret(pid string, secretName string, tlsCert []byte, tlsKey []byte) (*api.Secret, error) {
+	return k.CreateSecret(pid, secretName, map[string][]byte{
+		"tls.crt": tlsCert,
+		"tls.key": tlsKey,
+	})
+}
+
+func (k *KubeHelper) CreateSecret(pid string, secretName string, data map[string][]byte) (*api.Secret, error) {
 
 	secret := api.Secret{
 		ObjectMeta: api.ObjectMeta{
 			Name:      secretName,
 			Namespace: pid,
 		},
-		Data: map[string][]byte{
-			"tls.crt": tlsCert,
-			"tls.key": tlsKey,
-		},
+		Data: data,
 	}
 
-	data, err := json.Marshal(secret)
+	body, err := json.Marshal(secret)
 	if err != nil {
 		return nil, err
 	}
 	url := k.kubeBase + apiBase + "/namespaces/" + pid + "/secrets"
 	glog.V(4).Infoln(url)
-	request, _ := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	request, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Authorization", k.getAuthHeader())
 	httpresp, httperr := k.client.Do(request)
@@ -1289,6 +1489,46 @@ func (k *KubeHelper) CreateTLSSecret(pid string, secretName string, tlsCert []by
 	return nil, nil
 }
 
+func (k *KubeHelper) UpdateSecret(pid string, secretName string, data map[string][]byte) (*api.Secret, error) {
+
+	secret := api.Secret{
+		ObjectMeta: api.ObjectMeta{
+			Name:      secretName,
+			Namespace: pid,
+		},
+		Data: data,
+	}
+
+	body, err := json.Marshal(secret)
+	if err != nil {
+		return nil, err
+	}
+	url := k.kubeBase + apiBase + "/namespaces/" + pid + "/secrets/" + secretName
+	glog.V(4).Infoln(url)
+	request, _ := http.NewRequest("PUT", url, bytes.NewBuffer(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", k.getAuthHeader())
+	httpresp, httperr := k.client.Do(request)
+	if httperr != nil {
+		glog.Error(httperr)
+		return nil, httperr
+	} else {
+		if httpresp.StatusCode == http.StatusOK {
+			glog.V(2).Infof("Updated secret %s %s\n", pid, secretName)
+			data, err := ioutil.ReadAll(httpresp.Body)
+			if err != nil {
+				return nil, err
+			}
+
+			json.Unmarshal(data, &secret)
+			return &secret, nil
+		} else {
+			return nil, fmt.Errorf("Error updating secret %s for account %s: %s\n", secretName, pid, httpresp.Status)
+		}
+	}
+	return nil, nil
+}
+
 func (k *KubeHelper) DeleteSecret(pid string, name string) (*api.Secret, error) {
 
 	url := k.kubeBase + apiBase + "/namespaces/" + pid + "/secrets/" + name
@@ -0,0 +1,42 @@
+package rest
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+// ContentTypeCheckerMiddleware replaces the go-json-rest checker of the same
+// name, accepting YAML request bodies as well as JSON.
+type ContentTypeCheckerMiddleware struct{}
+
+func (mw *ContentTypeCheckerMiddleware) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFunc {
+
+	return func(w rest.ResponseWriter, r *rest.Request) {
+
+		mediatype, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		charset, ok := params["charset"]
+		if !ok {
+			charset = "UTF-8"
+		}
+
+		if r.ContentLength > 0 &&
+			!((mediatype == "application/json" || IsYaml(mediatype)) && strings.ToUpper(charset) == "UTF-8") {
+
+			rest.Error(w,
+				"Bad Content-Type or charset, expected 'application/json' or 'application/x-yaml'",
+				http.StatusUnsupportedMediaType,
+			)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// IsYaml returns true for the media types commonly used for YAML
+func IsYaml(mediatype string) bool {
+	return mediatype == "application/x-yaml" || mediatype == "application/yaml" || mediatype == "text/yaml"
+}
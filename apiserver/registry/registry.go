@@ -0,0 +1,217 @@
+// Copyright © 2016 National Data Service
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	api "github.com/ndslabs/apiserver/types"
+)
+
+// Images without a registry are pulled from Docker Hub
+const DefaultRegistry = "registry-1.docker.io"
+
+var manifestTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+var ErrNotFound = errors.New("Not found")
+
+var challengeRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// RegistryHelper talks to Docker Registry v2 APIs. The credentials, if any,
+// are sent to registries and token services that ask for them.
+type RegistryHelper struct {
+	client   *http.Client
+	username string
+	password string
+}
+
+func NewRegistryHelper(username string, password string, timeout time.Duration) *RegistryHelper {
+	return &RegistryHelper{
+		client:   &http.Client{Timeout: timeout},
+		username: username,
+		password: password,
+	}
+}
+
+// ImageName returns the name Kubernetes pulls the image by, including the
+// registry if the spec sets one.
+func ImageName(image api.ServiceImage) string {
+	if image.Registry == "" {
+		return image.Name
+	}
+	registry := strings.TrimPrefix(strings.TrimPrefix(image.Registry, "https://"), "http://")
+	return strings.TrimSuffix(registry, "/") + "/" + image.Name
+}
+
+// ImageRef returns the image pinned to the digest if there is one, otherwise
+// the image at the tag.
+func ImageRef(image api.ServiceImage, tag string, digest string) string {
+	if digest != "" {
+		return ImageName(image) + "@" + digest
+	}
+	return ImageName(image) + ":" + tag
+}
+
+// Tags lists the tags of the image repository, sorted
+func (r *RegistryHelper) Tags(image api.ServiceImage) ([]string, error) {
+	base, name := repository(image)
+	resp, err := r.do("GET", base+"/v2/"+name+"/tags/list", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error listing tags for %s: %s", name, resp.Status)
+	}
+
+	list := struct {
+		Tags []string `json:"tags"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(list.Tags)
+	return list.Tags, nil
+}
+
+// Digest resolves the tag to the digest of its manifest
+func (r *RegistryHelper) Digest(image api.ServiceImage, tag string) (string, error) {
+	base, name := repository(image)
+	header := http.Header{"Accept": manifestTypes}
+	resp, err := r.do("HEAD", base+"/v2/"+name+"/manifests/"+tag, header)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrNotFound
+	} else if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Error resolving %s:%s: %s", name, tag, resp.Status)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("No digest for %s:%s", name, tag)
+	}
+	return digest, nil
+}
+
+// Returns the registry URL and repository name for the image. The registry
+// may also be given as the first component of the image name, as in docker
+// pull. Official Docker Hub images live under library/.
+func repository(image api.ServiceImage) (string, string) {
+	registry := image.Registry
+	name := image.Name
+	if registry == "" {
+		parts := strings.SplitN(name, "/", 2)
+		if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+			registry, name = parts[0], parts[1]
+		}
+	}
+
+	if registry == "" || registry == "docker.io" || registry == "index.docker.io" {
+		registry = DefaultRegistry
+		if !strings.Contains(name, "/") {
+			name = "library/" + name
+		}
+	}
+	if !strings.HasPrefix(registry, "http://") && !strings.HasPrefix(registry, "https://") {
+		registry = "https://" + registry
+	}
+	return strings.TrimSuffix(registry, "/"), name
+}
+
+// Send the request, answering a Bearer or Basic authentication challenge
+func (r *RegistryHelper) do(method string, url string, header http.Header) (*http.Response, error) {
+	request, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+
+	resp, err := r.client.Do(request)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if strings.HasPrefix(challenge, "Bearer ") {
+		token, err := r.token(challenge)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	} else if strings.HasPrefix(challenge, "Basic ") && r.username != "" {
+		request.SetBasicAuth(r.username, r.password)
+	} else {
+		return nil, fmt.Errorf("Not authorized to access %s", url)
+	}
+	return r.client.Do(request)
+}
+
+// Get a token from the service named in the challenge
+func (r *RegistryHelper) token(challenge string) (string, error) {
+	params := map[string]string{}
+	for _, match := range challengeRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("Invalid authentication challenge %s", challenge)
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	request, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if r.username != "" {
+		request.SetBasicAuth(r.username, r.password)
+	}
+	resp, err := r.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Error getting registry token: %s", resp.Status)
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", err
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
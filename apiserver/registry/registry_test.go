@@ -0,0 +1,126 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	api "github.com/ndslabs/apiserver/types"
+)
+
+const testDigest = "sha256:4bf5e3f8e1d8b8cbb4d5fbd1d1f3f0a7b1e8d4c2a5a6c7d8e9f0a1b2c3d4e5f6"
+
+// A registry stand-in serving ndslabs/clowder with tags 1.0 and latest,
+// requiring a bearer token from its own token service
+func newTestRegistry() *httptest.Server {
+	mux := http.NewServeMux()
+	var server *httptest.Server
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("scope") != "repository:ndslabs/clowder:pull" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"token": "secret"}`)
+	})
+
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+				`Bearer realm="%s/token",service="test",scope="repository:ndslabs/clowder:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v2/ndslabs/clowder/tags/list":
+			fmt.Fprint(w, `{"name": "ndslabs/clowder", "tags": ["latest", "1.0"]}`)
+		case "/v2/ndslabs/clowder/manifests/1.0":
+			w.Header().Set("Docker-Content-Digest", testDigest)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	server = httptest.NewServer(mux)
+	return server
+}
+
+func TestTags(t *testing.T) {
+	server := newTestRegistry()
+	defer server.Close()
+
+	helper := NewRegistryHelper("", "", time.Second*5)
+	image := api.ServiceImage{Registry: server.URL, Name: "ndslabs/clowder"}
+
+	tags, err := helper.Tags(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, []string{"1.0", "latest"}) {
+		t.Errorf("Unexpected tags %v", tags)
+	}
+
+	_, err = helper.Tags(api.ServiceImage{Registry: server.URL, Name: "ndslabs/missing"})
+	if err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	server := newTestRegistry()
+	defer server.Close()
+
+	helper := NewRegistryHelper("", "", time.Second*5)
+	image := api.ServiceImage{Registry: server.URL, Name: "ndslabs/clowder"}
+
+	digest, err := helper.Digest(image, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != testDigest {
+		t.Errorf("Unexpected digest %s", digest)
+	}
+
+	if _, err = helper.Digest(image, "2.0"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestImageRef(t *testing.T) {
+	for _, test := range []struct {
+		image    api.ServiceImage
+		tag      string
+		digest   string
+		expected string
+	}{
+		{api.ServiceImage{Name: "mongo"}, "3.2", "", "mongo:3.2"},
+		{api.ServiceImage{Registry: "https://registry.example.org:5000/", Name: "tools/app"}, "1.0", "", "registry.example.org:5000/tools/app:1.0"},
+		{api.ServiceImage{Name: "ndslabs/clowder"}, "latest", testDigest, "ndslabs/clowder@" + testDigest},
+	} {
+		if ref := ImageRef(test.image, test.tag, test.digest); ref != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, ref)
+		}
+	}
+}
+
+func TestRepository(t *testing.T) {
+	for _, test := range []struct {
+		image    api.ServiceImage
+		registry string
+		name     string
+	}{
+		{api.ServiceImage{Name: "mongo"}, "https://" + DefaultRegistry, "library/mongo"},
+		{api.ServiceImage{Name: "ndslabs/clowder"}, "https://" + DefaultRegistry, "ndslabs/clowder"},
+		{api.ServiceImage{Name: "registry.example.org:5000/tools/app"}, "https://registry.example.org:5000", "tools/app"},
+		{api.ServiceImage{Registry: "http://localhost:5000", Name: "app"}, "http://localhost:5000", "app"},
+	} {
+		registry, name := repository(test.image)
+		if registry != test.registry || name != test.name {
+			t.Errorf("Expected %s %s, got %s %s", test.registry, test.name, registry, name)
+		}
+	}
+}
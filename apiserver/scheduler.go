@@ -0,0 +1,132 @@
+// Copyright © 2016 National Data Service
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	cron "github.com/ndslabs/apiserver/cron"
+	api "github.com/ndslabs/apiserver/types"
+
+	"github.com/golang/glog"
+)
+
+// Schedules are checked once a minute
+const scheduleInterval = time.Minute
+
+// Start and stop stacks on their schedules and stop stacks that have run for
+// longer than their maximum runtime. Each check covers the minutes since the
+// previous one, so a slow check does not skip a scheduled time.
+func (s *Server) scheduleStacks() {
+	last := time.Now()
+	for now := range time.Tick(scheduleInterval) {
+		s.checkSchedules(last, now)
+		last = now
+	}
+}
+
+func (s *Server) checkSchedules(last time.Time, now time.Time) {
+	accounts, err := s.etcd.GetAccounts()
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+
+	for _, account := range *accounts {
+		stacks, err := s.etcd.GetStacks(account.Namespace)
+		if err != nil {
+			glog.Error(err)
+			continue
+		}
+		for i := range *stacks {
+			stack := &(*stacks)[i]
+			if reason := s.stopReason(stack, last, now); reason != "" {
+				s.scheduledStop(account.Namespace, stack, reason)
+			} else if stack.Status == stackStatus[Stopped] && stack.Schedule != nil &&
+				scheduleDue(stack.Schedule.Start, last, now) {
+				s.scheduledStart(account.Namespace, stack)
+			}
+		}
+	}
+}
+
+// Why the stack should be stopped now, or "" if it should not. The stack's
+// schedule and maximum runtime take precedence over the server's defaults.
+func (s *Server) stopReason(stack *api.Stack, last time.Time, now time.Time) string {
+	if stack.Status == stackStatus[Stopped] || stack.Status == stackStatus[Stopping] {
+		return ""
+	}
+
+	schedule := api.StackSchedule{}
+	if stack.Schedule != nil {
+		schedule = *stack.Schedule
+	}
+
+	if schedule.Stop != "" {
+		if scheduleDue(schedule.Stop, last, now) {
+			return "Stopped by schedule"
+		}
+	} else if s.stopSchedule != nil && due(s.stopSchedule, last, now) {
+		return "Stopped by the default schedule"
+	}
+
+	maxRuntime := schedule.MaxRuntime
+	if maxRuntime == 0 {
+		maxRuntime = s.maxRuntime
+	}
+	if maxRuntime > 0 && stack.StartedTime > 0 && int(now.Unix())-stack.StartedTime >= maxRuntime {
+		return fmt.Sprintf("Stopped after the maximum runtime of %s", time.Duration(maxRuntime)*time.Second)
+	}
+	return ""
+}
+
+// True if the cron expression includes a minute after last and up to now
+func scheduleDue(spec string, last time.Time, now time.Time) bool {
+	if spec == "" {
+		return false
+	}
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		glog.Error(err)
+		return false
+	}
+	return due(schedule, last, now)
+}
+
+func due(schedule *cron.Schedule, last time.Time, now time.Time) bool {
+	next := schedule.Next(last)
+	return !next.IsZero() && !next.After(now)
+}
+
+func (s *Server) scheduledStart(userId string, stack *api.Stack) {
+	if errors := s.validateStackConfig(userId, stack, true); len(errors) > 0 {
+		glog.V(1).Infof("Scheduled start of stack %s %s failed config validation\n", userId, stack.Id)
+		return
+	}
+	if retired := s.retiredServices(userId, stack); len(retired) > 0 {
+		glog.V(1).Infof("Scheduled start of stack %s %s uses retired services: %s\n", userId, stack.Id, strings.Join(retired, ", "))
+		return
+	}
+	if !s.transitionStack(userId, stack.Id, stackStatus[Stopped], stackStatus[Starting]) {
+		return
+	}
+	stack.Status = stackStatus[Starting]
+
+	glog.V(4).Infof("Starting stack %s %s by schedule\n", userId, stack.Id)
+	operation := s.newOperation(stack.Id, "", api.OperationStart)
+	s.startOperation(userId, operation, func() (*api.Stack, error) {
+		return s.startStack(userId, stack)
+	})
+}
+
+func (s *Server) scheduledStop(userId string, stack *api.Stack, reason string) {
+	glog.V(4).Infof("Stopping stack %s %s: %s\n", userId, stack.Id, reason)
+	s.setStopReason(userId, stack.Id, reason)
+
+	sid := stack.Id
+	operation := s.newOperation(sid, "", api.OperationStop)
+	s.startOperation(userId, operation, func() (*api.Stack, error) {
+		return s.stopStack(userId, sid)
+	})
+}
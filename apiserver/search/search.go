@@ -0,0 +1,122 @@
+// Copyright © 2016 National Data Service
+package search
+
+import (
+	"sort"
+	"strings"
+
+	api "github.com/ndslabs/apiserver/types"
+)
+
+// Query selects services from the catalog. Text matches the key, label,
+// description, maintainer and tags. All tags must match, by term id or name.
+// A limit of 0 returns all matching services.
+type Query struct {
+	Text       string
+	Tags       []string
+	Maintainer string
+	Offset     int
+	Limit      int
+}
+
+// Services returns the services matching the query, sorted by key, along with
+// the number of matching services for each tag term. The vocabulary may be
+// nil, in which case tags are matched and counted by id only.
+func Services(services []api.ServiceSpec, query Query, vocab *api.Vocabulary) *api.SearchResult {
+	terms := map[string]string{}
+	if vocab != nil {
+		for _, term := range vocab.Terms {
+			terms[term.Id] = term.Name
+		}
+	}
+
+	matches := []api.ServiceSpec{}
+	for _, service := range services {
+		if matchesQuery(&service, query, terms) {
+			matches = append(matches, service)
+		}
+	}
+	sort.Sort(api.ServiceSorter(matches))
+
+	counts := map[string]int{}
+	for _, service := range matches {
+		for _, tag := range service.Tags {
+			counts[tag]++
+		}
+	}
+	facets := []api.Facet{}
+	for id, count := range counts {
+		facets = append(facets, api.Facet{Id: id, Name: terms[id], Count: count})
+	}
+	sort.Sort(facetSorter(facets))
+
+	result := &api.SearchResult{
+		Total:    len(matches),
+		Offset:   query.Offset,
+		Limit:    query.Limit,
+		Services: []api.ServiceSpec{},
+		Facets:   facets,
+	}
+	if query.Offset < len(matches) {
+		end := len(matches)
+		if query.Limit > 0 && query.Offset+query.Limit < end {
+			end = query.Offset + query.Limit
+		}
+		result.Services = matches[query.Offset:end]
+	}
+	return result
+}
+
+func matchesQuery(service *api.ServiceSpec, query Query, terms map[string]string) bool {
+	for _, tag := range query.Tags {
+		found := false
+		for _, id := range service.Tags {
+			if strings.EqualFold(tag, id) || strings.EqualFold(tag, terms[id]) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if query.Maintainer != "" && !contains(service.Maintainer, query.Maintainer) {
+		return false
+	}
+
+	if query.Text == "" {
+		return true
+	}
+	fields := []string{service.Key, service.Label, service.Description, service.Maintainer}
+	for _, id := range service.Tags {
+		fields = append(fields, id, terms[id])
+	}
+	for _, word := range strings.Fields(query.Text) {
+		found := false
+		for _, field := range fields {
+			if contains(field, word) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(s string, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// Most used tags first
+type facetSorter []api.Facet
+
+func (s facetSorter) Len() int      { return len(s) }
+func (s facetSorter) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s facetSorter) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Id < s[j].Id
+}
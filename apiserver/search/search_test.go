@@ -0,0 +1,59 @@
+package search
+
+import (
+	"fmt"
+	"testing"
+
+	api "github.com/ndslabs/apiserver/types"
+)
+
+var testServices = []api.ServiceSpec{
+	{Key: "postgres", Label: "PostgreSQL", Description: "Relational database", Tags: []string{"1"}},
+	{Key: "mongo", Label: "MongoDB", Description: "Document database", Maintainer: "Jane Doe", Tags: []string{"1", "2"}},
+	{Key: "clowder", Label: "Clowder", Description: "Research data management", Maintainer: "Jane Doe", Tags: []string{"2"}},
+}
+
+var testVocab = &api.Vocabulary{
+	Name:  "tags",
+	Terms: []api.Term{{Id: "1", Name: "Database"}, {Id: "2", Name: "Data management"}},
+}
+
+func keys(result *api.SearchResult) []string {
+	keys := []string{}
+	for _, service := range result.Services {
+		keys = append(keys, service.Key)
+	}
+	return keys
+}
+
+func TestSearch(t *testing.T) {
+	for _, test := range []struct {
+		query    Query
+		expected string
+	}{
+		{Query{}, "[clowder mongo postgres]"},
+		{Query{Text: "database"}, "[mongo postgres]"},
+		{Query{Text: "data jane"}, "[clowder mongo]"},
+		{Query{Tags: []string{"database"}}, "[mongo postgres]"},
+		{Query{Tags: []string{"1", "2"}}, "[mongo]"},
+		{Query{Maintainer: "jane"}, "[clowder mongo]"},
+		{Query{Offset: 1, Limit: 1}, "[mongo]"},
+		{Query{Offset: 5}, "[]"},
+	} {
+		result := Services(testServices, test.query, testVocab)
+		if actual := fmt.Sprint(keys(result)); actual != test.expected {
+			t.Errorf("%+v: expected %s, got %s", test.query, test.expected, actual)
+		}
+	}
+}
+
+func TestFacets(t *testing.T) {
+	result := Services(testServices, Query{Text: "database", Limit: 1}, testVocab)
+	if result.Total != 2 || len(result.Services) != 1 {
+		t.Errorf("Expected 1 of 2 services, got %d of %d", len(result.Services), result.Total)
+	}
+	expected := []api.Facet{{Id: "1", Name: "Database", Count: 2}, {Id: "2", Name: "Data management", Count: 1}}
+	if len(result.Facets) != 2 || result.Facets[0] != expected[0] || result.Facets[1] != expected[1] {
+		t.Errorf("Expected facets %v, got %v", expected, result.Facets)
+	}
+}
@@ -2,58 +2,92 @@
 package main
 
 import (
-	"encoding/json"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	compose "github.com/ndslabs/apiserver/compose"
+	cron "github.com/ndslabs/apiserver/cron"
+	diff "github.com/ndslabs/apiserver/diff"
 	etcd "github.com/ndslabs/apiserver/etcd"
+	fsm "github.com/ndslabs/apiserver/fsm"
+	graph "github.com/ndslabs/apiserver/graph"
 	kube "github.com/ndslabs/apiserver/kube"
 	mw "github.com/ndslabs/apiserver/middleware"
+	registry "github.com/ndslabs/apiserver/registry"
+	search "github.com/ndslabs/apiserver/search"
+	templates "github.com/ndslabs/apiserver/templates"
 	api "github.com/ndslabs/apiserver/types"
+	validation "github.com/ndslabs/apiserver/validation"
+	vcs "github.com/ndslabs/apiserver/vcs"
 	gcfg "gopkg.in/gcfg.v1"
 	k8api "k8s.io/kubernetes/pkg/api"
 	"k8s.io/kubernetes/pkg/watch"
 
 	"github.com/StephanDollberg/go-json-rest-middleware-jwt"
 	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
 )
 
 type Server struct {
-	etcd           *etcd.EtcdHelper
-	kube           *kube.KubeHelper
-	Namespace      string
-	local          bool
-	volDir         string
-	hostname       string
-	jwt            *jwt.JWTMiddleware
-	prefix         string
-	ingress        IngressType
-	domain         string
-	cpuMax         int
-	cpuDefault     int
-	memMax         int
-	memDefault     int
-	storageDefault int
+	etcd            *etcd.EtcdHelper
+	kube            *kube.KubeHelper
+	Namespace       string
+	local           bool
+	volDir          string
+	hostname        string
+	jwt             *jwt.JWTMiddleware
+	prefix          string
+	ingress         IngressType
+	domain          string
+	cpuMax          int
+	cpuDefault      int
+	memMax          int
+	memDefault      int
+	storageDefault  int
+	specsDir        string
+	specsRepo       string
+	specsRef        string
+	specsMutex      sync.Mutex
+	registry        *registry.RegistryHelper
+	pinDigests      bool
+	curators        map[string]bool
+	pool            *fsm.Pool
+	timeouts        fsm.Timeouts
+	machines        map[string]*fsm.Machine
+	machinesMutex   sync.Mutex
+	stacksMutex     sync.Mutex
+	operations      map[string]chan struct{}
+	operationsMutex sync.Mutex
+	maxRuntime      int
+	stopSchedule    *cron.Schedule
+	startedTime     int
 }
 
 type Config struct {
 	Server struct {
-		Port         string
-		Origin       string
-		VolDir       string
-		SpecsDir     string
-		VolumeSource string
-		Timeout      int
-		Prefix       string
-		Domain       string
-		Ingress      IngressType
+		Port          string
+		Origin        string
+		VolDir        string
+		SpecsDir      string
+		SpecsRepo     string
+		SpecsRef      string
+		SpecsInterval int
+		VolumeSource  string
+		Timeout       int
+		Prefix        string
+		Domain        string
+		Ingress       IngressType
 	}
 	DefaultLimits struct {
 		CpuMax         int
@@ -71,6 +105,25 @@ type Config struct {
 		Username  string
 		Password  string
 	}
+	Registry struct {
+		Username   string
+		Password   string
+		Timeout    int
+		PinDigests bool
+	}
+	Repositories struct {
+		Image string
+	}
+	Catalog struct {
+		Curators string
+	}
+	Stacks struct {
+		Workers        int
+		StartTimeout   int
+		ServiceTimeout int
+		MaxRuntime     int
+		StopSchedule   string
+	}
 }
 
 type IngressType string
@@ -120,6 +173,18 @@ func main() {
 	if cfg.DefaultLimits.StorageDefault <= 0 {
 		cfg.DefaultLimits.StorageDefault = 10
 	}
+	if cfg.Registry.Timeout <= 0 {
+		cfg.Registry.Timeout = 10
+	}
+	if cfg.Stacks.Workers <= 0 {
+		cfg.Stacks.Workers = 10
+	}
+	if cfg.Stacks.StartTimeout <= 0 {
+		cfg.Stacks.StartTimeout = 1800
+	}
+	if cfg.Stacks.ServiceTimeout <= 0 {
+		cfg.Stacks.ServiceTimeout = 600
+	}
 
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -141,6 +206,7 @@ func main() {
 
 	server := Server{}
 	server.hostname = hostname
+	server.startedTime = int(time.Now().Unix())
 	if cfg.Server.Ingress == IngressTypeLoadBalancer {
 		if len(cfg.Server.Domain) > 0 {
 			server.domain = cfg.Server.Domain
@@ -150,6 +216,32 @@ func main() {
 	}
 	server.etcd = etcd
 	server.kube = kube
+	server.registry = registry.NewRegistryHelper(cfg.Registry.Username, cfg.Registry.Password,
+		time.Second*time.Duration(cfg.Registry.Timeout))
+	server.pinDigests = cfg.Registry.PinDigests
+	if cfg.Repositories.Image != "" {
+		vcs.Image = cfg.Repositories.Image
+	}
+	server.curators = map[string]bool{}
+	for _, curator := range strings.Split(cfg.Catalog.Curators, ",") {
+		if curator = strings.TrimSpace(curator); curator != "" {
+			server.curators[curator] = true
+		}
+	}
+	server.pool = fsm.NewPool(cfg.Stacks.Workers)
+	server.timeouts = fsm.Timeouts{
+		Service: time.Second * time.Duration(cfg.Stacks.ServiceTimeout),
+		Stack:   time.Second * time.Duration(cfg.Stacks.StartTimeout),
+	}
+	server.machines = map[string]*fsm.Machine{}
+	server.operations = map[string]chan struct{}{}
+	server.maxRuntime = cfg.Stacks.MaxRuntime
+	if cfg.Stacks.StopSchedule != "" {
+		server.stopSchedule, err = cron.Parse(cfg.Stacks.StopSchedule)
+		if err != nil {
+			glog.Fatalf("Invalid stop schedule: %s\n", err)
+		}
+	}
 	server.volDir = cfg.Server.VolDir
 	server.cpuMax = cfg.DefaultLimits.CpuMax
 	server.cpuDefault = cfg.DefaultLimits.CpuDefault
@@ -181,7 +273,13 @@ func (s *Server) start(cfg Config, adminPasswd string) {
 	os.MkdirAll(cfg.Server.VolDir, 0700)
 
 	api := rest.NewApi()
-	api.Use(rest.DefaultDevStack...)
+	for _, m := range rest.DefaultDevStack {
+		// Replaced below to also accept YAML
+		if _, ok := m.(*rest.ContentTypeCheckerMiddleware); !ok {
+			api.Use(m)
+		}
+	}
+	api.Use(&mw.ContentTypeCheckerMiddleware{})
 	api.Use(&mw.NoCacheMiddleware{})
 
 	glog.Infof("prefix %s", s.prefix)
@@ -253,9 +351,14 @@ func (s *Server) start(cfg Config, adminPasswd string) {
 		Condition: func(request *rest.Request) bool {
 			return strings.HasPrefix(request.URL.Path, s.prefix+"accounts") ||
 				strings.HasPrefix(request.URL.Path, s.prefix+"services") ||
+				strings.HasPrefix(request.URL.Path, s.prefix+"publications") ||
+				strings.HasPrefix(request.URL.Path, s.prefix+"notices") ||
 				strings.HasPrefix(request.URL.Path, s.prefix+"stacks") ||
+				strings.HasPrefix(request.URL.Path, s.prefix+"templates") ||
 				strings.HasPrefix(request.URL.Path, s.prefix+"start") ||
 				strings.HasPrefix(request.URL.Path, s.prefix+"stop") ||
+				strings.HasPrefix(request.URL.Path, s.prefix+"restart") ||
+				strings.HasPrefix(request.URL.Path, s.prefix+"operations") ||
 				strings.HasPrefix(request.URL.Path, s.prefix+"logs") ||
 				strings.HasPrefix(request.URL.Path, s.prefix+"volumes") ||
 				strings.HasPrefix(request.URL.Path, s.prefix+"configs") ||
@@ -283,17 +386,46 @@ func (s *Server) start(cfg Config, adminPasswd string) {
 		rest.Delete(s.prefix+"accounts/:userId", s.DeleteAccount),
 		rest.Get(s.prefix+"services", s.GetAllServices),
 		rest.Post(s.prefix+"services", s.PostService),
+		rest.Get(s.prefix+"services/search", s.SearchServices),
+		rest.Post(s.prefix+"services/validate", s.ValidateService),
+		rest.Post(s.prefix+"services/import/compose", s.ImportCompose),
 		rest.Put(s.prefix+"services/:key", s.PutService),
 		rest.Get(s.prefix+"services/:key", s.GetService),
 		rest.Delete(s.prefix+"services/:key", s.DeleteService),
+		rest.Get(s.prefix+"services/:key/graph", s.GetServiceGraph),
+		rest.Get(s.prefix+"services/:key/tags", s.GetServiceTags),
+		rest.Put(s.prefix+"services/:key/status", s.PutServiceStatus),
+		rest.Put(s.prefix+"services/:key/share", s.ShareService),
+		rest.Post(s.prefix+"services/:key/publish", s.PublishService),
+		rest.Get(s.prefix+"publications", s.GetPublications),
+		rest.Get(s.prefix+"publications/:id", s.GetPublication),
+		rest.Get(s.prefix+"publications/:id/diff", s.GetPublicationDiff),
+		rest.Put(s.prefix+"publications/:id/approve", s.ApprovePublication),
+		rest.Put(s.prefix+"publications/:id/reject", s.RejectPublication),
+		rest.Get(s.prefix+"notices", s.GetNotices),
+		rest.Delete(s.prefix+"notices/:id", s.DeleteNotice),
 		rest.Get(s.prefix+"configs", s.GetConfigs),
 		rest.Get(s.prefix+"stacks", s.GetAllStacks),
 		rest.Post(s.prefix+"stacks", s.PostStack),
 		rest.Put(s.prefix+"stacks/:sid", s.PutStack),
 		rest.Get(s.prefix+"stacks/:sid", s.GetStack),
 		rest.Delete(s.prefix+"stacks/:sid", s.DeleteStack),
+		rest.Get(s.prefix+"stacks/:sid/export", s.ExportStack),
+		rest.Post(s.prefix+"stacks/:sid/clone", s.CloneStack),
+		rest.Post(s.prefix+"stacks/:sid/template", s.PostStackTemplate),
+		rest.Get(s.prefix+"templates", s.GetTemplates),
+		rest.Post(s.prefix+"templates", s.PostTemplate),
+		rest.Get(s.prefix+"templates/:id", s.GetTemplate),
+		rest.Put(s.prefix+"templates/:id", s.PutTemplate),
+		rest.Delete(s.prefix+"templates/:id", s.DeleteTemplate),
+		rest.Put(s.prefix+"templates/:id/share", s.ShareTemplate),
+		rest.Put(s.prefix+"templates/:id/publish", s.PublishTemplate),
+		rest.Post(s.prefix+"templates/:id/instantiate", s.InstantiateTemplate),
 		rest.Get(s.prefix+"start/:sid", s.StartStack),
 		rest.Get(s.prefix+"stop/:sid", s.StopStack),
+		rest.Get(s.prefix+"restart/:sid", s.RestartStack),
+		rest.Get(s.prefix+"operations", s.GetOperations),
+		rest.Get(s.prefix+"operations/:id", s.GetOperation),
 		rest.Get(s.prefix+"logs/:ssid", s.GetLogs),
 		rest.Get(s.prefix+"console", s.GetConsole),
 		rest.Get(s.prefix+"check_console", s.CheckConsole),
@@ -308,15 +440,11 @@ func (s *Server) start(cfg Config, adminPasswd string) {
 	api.SetApp(router)
 
 	if len(cfg.Server.SpecsDir) > 0 {
-		glog.Infof("Loading service specs from %s\n", cfg.Server.SpecsDir)
-		err = s.loadSpecs(cfg.Server.SpecsDir)
-		if err != nil {
-			glog.Warningf("Error loading specs: %s\n", err)
-		}
-		s.addVocabulary(cfg.Server.SpecsDir + "/vocab/tags.json")
+		s.initSpecs(cfg)
 	}
 
 	go s.initExistingAccounts()
+	go s.scheduleStacks()
 
 	go s.kube.WatchEvents(s)
 	go s.kube.WatchPods(s)
@@ -378,6 +506,8 @@ func (s *Server) initExistingAccounts() {
 			}
 		}
 
+		s.failInterruptedOperations(account.Namespace)
+
 		stacks, err := s.etcd.GetStacks(account.Namespace)
 		if err != nil {
 			glog.Error(err)
@@ -437,9 +567,9 @@ func (s *Server) GetAllAccounts(w rest.ResponseWriter, r *rest.Request) {
 	if err != nil {
 		glog.Error(err)
 		rest.Error(w, err.Error(), http.StatusInternalServerError)
-		w.WriteJson(&err)
+		writeEntity(w, r, &err)
 	} else {
-		w.WriteJson(&accounts)
+		writeEntity(w, r, &accounts)
 	}
 }
 
@@ -452,6 +582,45 @@ func (s *Server) getUser(r *rest.Request) string {
 	}
 }
 
+// Decode a JSON or YAML request body, depending on the Content-Type
+func decodePayload(r *rest.Request, v interface{}) error {
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !mw.IsYaml(mediatype) {
+		return r.DecodeJsonPayload(v)
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return rest.ErrJsonPayloadEmpty
+	}
+	return yaml.Unmarshal(data, v)
+}
+
+// Write the response as YAML if the client prefers it, otherwise JSON
+func writeEntity(w rest.ResponseWriter, r *rest.Request, v interface{}) {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediatype, _, _ := mime.ParseMediaType(accept)
+		if mediatype == "application/json" {
+			break
+		}
+		if mw.IsYaml(mediatype) {
+			data, err := yaml.Marshal(v)
+			if err != nil {
+				rest.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-yaml")
+			w.(http.ResponseWriter).Write(data)
+			return
+		}
+	}
+	w.WriteJson(v)
+}
+
 func (s *Server) IsAdmin(r *rest.Request) bool {
 	payload := r.Env["JWT_PAYLOAD"].(map[string]interface{})
 	if payload["admin"] == true {
@@ -461,6 +630,13 @@ func (s *Server) IsAdmin(r *rest.Request) bool {
 	}
 }
 
+// Curators review specs submitted for the system catalog. The admin is
+// always a curator.
+func (s *Server) IsCurator(r *rest.Request) bool {
+	payload := r.Env["JWT_PAYLOAD"].(map[string]interface{})
+	return s.IsAdmin(r) || s.curators[payload["user"].(string)]
+}
+
 func (s *Server) GetAccount(w rest.ResponseWriter, r *rest.Request) {
 	userId := r.PathParam("userId")
 
@@ -489,7 +665,7 @@ func (s *Server) GetAccount(w rest.ResponseWriter, r *rest.Request) {
 				MemoryPct: fmt.Sprintf("%f", float64(quota.Items[0].Status.Used.Memory().Value())/float64(quota.Items[0].Status.Hard.Memory().Value())),
 			}
 		}
-		w.WriteJson(account)
+		writeEntity(w, r, account)
 	}
 }
 
@@ -503,7 +679,7 @@ func (s *Server) PostAccount(w rest.ResponseWriter, r *rest.Request) {
 	*/
 
 	account := api.Account{}
-	err := r.DecodeJsonPayload(&account)
+	err := decodePayload(r, &account)
 	if err != nil {
 		glog.Error(err)
 		rest.Error(w, err.Error(), http.StatusInternalServerError)
@@ -580,7 +756,7 @@ func (s *Server) PutAccount(w rest.ResponseWriter, r *rest.Request) {
 	}
 
 	account := api.Account{}
-	err := r.DecodeJsonPayload(&account)
+	err := decodePayload(r, &account)
 	if err != nil {
 		glog.Error(err)
 		rest.Error(w, err.Error(), http.StatusInternalServerError)
@@ -639,31 +815,95 @@ func (s *Server) GetAllServices(w rest.ResponseWriter, r *rest.Request) {
 	userId := s.getUser(r)
 	catalog := r.Request.FormValue("catalog")
 
+	var services *[]api.ServiceSpec
+	var err error
 	if catalog == "system" {
-		services, err := s.etcd.GetGlobalServices()
-		if err != nil {
-			glog.Error(err)
-			rest.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.WriteJson(&services)
+		services, err = s.etcd.GetGlobalServices()
 	} else if catalog == "all" {
-		services, err := s.etcd.GetAllServices(userId)
-		if err != nil {
-			glog.Error(err)
-			rest.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		services, err = s.etcd.GetAllServices(userId)
+	} else if catalog == "shared" {
+		services, err = s.etcd.GetSharedServices(userId)
+	} else {
+		services, err = s.etcd.GetServices(userId)
+	}
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeEntity(w, r, filterStatus(services, r.Request.FormValue("status"), s.IsAdmin(r)))
+}
+
+// Filter services by lifecycle status. By default only the services that can
+// be added to new stacks are listed, "all" lists every status. Drafts in the
+// system catalog are only listed for the admin.
+func filterStatus(services *[]api.ServiceSpec, status string, admin bool) *[]api.ServiceSpec {
+	filtered := []api.ServiceSpec{}
+	for _, spec := range *services {
+		if spec.Status == api.SpecDraft && spec.Catalog == "system" && !admin {
+			continue
+		}
+		switch status {
+		case "":
+			if validation.Available(&spec) != nil {
+				continue
+			}
+		case "all":
+		case string(api.SpecPublished):
+			if spec.Status != "" && spec.Status != api.SpecPublished {
+				continue
+			}
+		default:
+			if string(spec.Status) != status {
+				continue
+			}
 		}
-		w.WriteJson(&services)
+		filtered = append(filtered, spec)
+	}
+	return &filtered
+}
+
+// Search the catalog by text, tags and maintainer. Facets count the tags of
+// all matching services, not just the returned page.
+func (s *Server) SearchServices(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+	catalog := r.Request.FormValue("catalog")
+
+	var services *[]api.ServiceSpec
+	var err error
+	if catalog == "system" {
+		services, err = s.etcd.GetGlobalServices()
+	} else if catalog == "user" {
+		services, err = s.etcd.GetServices(userId)
 	} else {
-		services, err := s.etcd.GetServices(userId)
-		if err != nil {
-			glog.Error(err)
-			rest.Error(w, err.Error(), http.StatusInternalServerError)
+		services, err = s.etcd.GetAllServices(userId)
+	}
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	query := search.Query{
+		Text:       r.Request.FormValue("q"),
+		Tags:       r.Request.Form["tag"],
+		Maintainer: r.Request.FormValue("maintainer"),
+	}
+	for name, value := range map[string]*int{"offset": &query.Offset, "limit": &query.Limit} {
+		param := r.Request.FormValue(name)
+		if param == "" {
+			continue
+		}
+		*value, err = strconv.Atoi(param)
+		if err != nil || *value < 0 {
+			rest.Error(w, "Invalid "+name, http.StatusBadRequest)
 			return
 		}
-		w.WriteJson(&services)
 	}
+
+	services = filterStatus(services, r.Request.FormValue("status"), s.IsAdmin(r))
+	vocab, _ := s.etcd.GetVocabulary("tags")
+	writeEntity(w, r, search.Services(*services, query, vocab))
 }
 
 func (s *Server) GetService(w rest.ResponseWriter, r *rest.Request) {
@@ -683,7 +923,7 @@ func (s *Server) GetService(w rest.ResponseWriter, r *rest.Request) {
 			rest.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		} else {
-			w.WriteJson(&spec)
+			writeEntity(w, r, &spec)
 		}
 	} else {
 
@@ -696,7 +936,7 @@ func (s *Server) GetService(w rest.ResponseWriter, r *rest.Request) {
 			rest.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		} else {
-			w.WriteJson(&spec)
+			writeEntity(w, r, &spec)
 		}
 	}
 }
@@ -706,18 +946,26 @@ func (s *Server) PostService(w rest.ResponseWriter, r *rest.Request) {
 	catalog := r.Request.FormValue("catalog")
 
 	service := api.ServiceSpec{}
-	err := r.DecodeJsonPayload(&service)
+	err := decodePayload(r, &service)
 	if err != nil {
 		glog.Error(err)
 		rest.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if s.serviceExists(userId, service.Key) {
+	// The user's own spec takes the place of one shared with them
+	if existing, _ := s.etcd.GetServiceSpec(userId, service.Key); existing != nil && existing.Catalog != "shared" {
 		rest.Error(w, "Service exists with key", http.StatusConflict)
 		return
 	}
 
+	if errors := s.validateServiceSpec(userId, catalog, &service); len(errors) > 0 {
+		glog.V(1).Infof("Service spec %s failed validation\n", service.Key)
+		w.WriteHeader(http.StatusBadRequest)
+		w.WriteJson(&api.ValidationResult{Valid: false, Errors: errors})
+		return
+	}
+
 	if catalog == "system" {
 		if !s.IsAdmin(r) {
 			rest.Error(w, "", http.StatusUnauthorized)
@@ -750,13 +998,24 @@ func (s *Server) PutService(w rest.ResponseWriter, r *rest.Request) {
 	catalog := r.Request.FormValue("catalog")
 
 	service := api.ServiceSpec{}
-	err := r.DecodeJsonPayload(&service)
+	err := decodePayload(r, &service)
 	if err != nil {
 		glog.Error(err)
 		rest.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	errors := s.validateServiceSpec(userId, catalog, &service)
+	if service.Key != key {
+		errors = append(errors, api.ValidationError{Field: "key", Message: "Key does not match the service being updated"})
+	}
+	if len(errors) > 0 {
+		glog.V(1).Infof("Service spec %s failed validation\n", key)
+		w.WriteHeader(http.StatusBadRequest)
+		w.WriteJson(&api.ValidationResult{Valid: false, Errors: errors})
+		return
+	}
+
 	if catalog == "system" {
 		if !s.IsAdmin(r) {
 			rest.Error(w, "", http.StatusUnauthorized)
@@ -784,6 +1043,13 @@ func (s *Server) PutService(w rest.ResponseWriter, r *rest.Request) {
 			return
 		}
 
+		// Shares are changed through services/:key/share
+		service.SharedWith = nil
+		existing, _ := s.etcd.GetServiceSpec(userId, key)
+		if existing != nil && existing.Catalog == "user" {
+			service.SharedWith = existing.SharedWith
+		}
+
 		err = s.etcd.PutService(userId, key, &service)
 		if err != nil {
 			glog.Error(err)
@@ -796,6 +1062,126 @@ func (s *Server) PutService(w rest.ResponseWriter, r *rest.Request) {
 	w.WriteJson(&service)
 }
 
+// Convert a docker-compose file to service specs. The specs are returned,
+// not added to the catalog, along with anything that could not be translated
+// and any validation errors in the result.
+func (s *Server) ImportCompose(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+	prefix := r.Request.FormValue("prefix")
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := compose.Convert(data, prefix)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Imported specs may depend on each other or on the catalog
+	catalog := s.specLookup(userId)
+	lookup := func(key string) *api.ServiceSpec {
+		for i := range result.Services {
+			if result.Services[i].Key == key {
+				return &result.Services[i]
+			}
+		}
+		return catalog(key)
+	}
+	for i := range result.Services {
+		spec := &result.Services[i]
+		if s.serviceExists(userId, spec.Key) {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s: service already exists", spec.Key))
+		}
+		for _, e := range validation.ValidateServiceSpec(spec, lookup) {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s: %s: %s", spec.Key, e.Field, e.Message))
+		}
+	}
+
+	w.WriteJson(&result)
+}
+
+func (s *Server) ValidateService(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+	catalog := r.Request.FormValue("catalog")
+
+	service := api.ServiceSpec{}
+	err := decodePayload(r, &service)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	errors := s.validateServiceSpec(userId, catalog, &service)
+	w.WriteJson(&api.ValidationResult{Valid: len(errors) == 0, Errors: errors})
+}
+
+// Validate a spec against the catalog it is being written to and the tags
+// vocabulary. System specs may only depend on other system specs.
+func (s *Server) validateServiceSpec(userId string, catalog string, service *api.ServiceSpec) []api.ValidationError {
+	if catalog == "system" {
+		userId = ""
+	}
+	errors := validation.ValidateServiceSpec(service, s.specLookup(userId))
+	vocab, _ := s.etcd.GetVocabulary("tags")
+	return append(errors, validation.ValidateTags(service, vocab)...)
+}
+
+// Look up specs visible to the user, falling back to the system catalog
+func (s *Server) specLookup(userId string) graph.SpecLookup {
+	return func(key string) *api.ServiceSpec {
+		spec, _ := s.etcd.GetServiceSpec(userId, key)
+		return spec
+	}
+}
+
+func (s *Server) GetServiceGraph(w rest.ResponseWriter, r *rest.Request) {
+	key := r.PathParam("key")
+	userId := s.getUser(r)
+
+	if !s.serviceExists(userId, key) {
+		rest.NotFound(w, r)
+		return
+	}
+
+	serviceGraph, err := graph.Resolve(key, s.specLookup(userId))
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeEntity(w, r, &serviceGraph)
+}
+
+// List the tags available in the registry for the service's image
+func (s *Server) GetServiceTags(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+	key := r.PathParam("key")
+
+	spec, _ := s.etcd.GetServiceSpec(userId, key)
+	if spec == nil {
+		rest.NotFound(w, r)
+		return
+	}
+
+	tags, err := s.registry.Tags(spec.Image)
+	if err == registry.ErrNotFound {
+		rest.Error(w, "No such image "+spec.Image.Name, http.StatusNotFound)
+		return
+	} else if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeEntity(w, r, &tags)
+}
+
 func (s *Server) DeleteService(w rest.ResponseWriter, r *rest.Request) {
 	key := r.PathParam("key")
 	catalog := r.Request.FormValue("catalog")
@@ -822,7 +1208,7 @@ func (s *Server) DeleteService(w rest.ResponseWriter, r *rest.Request) {
 
 		if s.serviceInUse(key) > 0 {
 			glog.Warningf("Cannot delete system service spec %s because it is in use by one or more accounts\n", key)
-			rest.Error(w, "Service is in use", http.StatusConflict)
+			rest.Error(w, "Service is in use, retire it instead", http.StatusConflict)
 			return
 		}
 
@@ -849,7 +1235,7 @@ func (s *Server) DeleteService(w rest.ResponseWriter, r *rest.Request) {
 
 		if s.serviceInUse(key) > 0 {
 			glog.Warningf("Cannot delete user service spec %s because it is in use by one or more accounts\n", key)
-			rest.Error(w, "Service is in use", http.StatusConflict)
+			rest.Error(w, "Service is in use, retire it instead", http.StatusConflict)
 			return
 		}
 
@@ -860,100 +1246,607 @@ func (s *Server) DeleteService(w rest.ResponseWriter, r *rest.Request) {
 			return
 		}
 
-	}
-	w.WriteHeader(http.StatusOK)
-}
-
-func (s *Server) serviceInUse(sid string) int {
-	inUse := 0
-	accounts, _ := s.etcd.GetAccounts()
-	for _, account := range *accounts {
-		stacks, _ := s.etcd.GetStacks(account.Namespace)
-		for _, stack := range *stacks {
-			for _, service := range stack.Services {
-				if service.Service == sid {
-					inUse++
-				}
-			}
+		for _, account := range service.SharedWith {
+			s.etcd.DeleteSharedService(account, key)
 		}
+
 	}
-	return inUse
+	w.WriteHeader(http.StatusOK)
 }
 
-func (s *Server) GetAllStacks(w rest.ResponseWriter, r *rest.Request) {
+// Change the lifecycle status of a spec. Unlike other changes, this is
+// allowed while the spec is in use, except for returning it to draft. Users
+// of the stacks affected by retiring a spec are sent a notice.
+func (s *Server) PutServiceStatus(w rest.ResponseWriter, r *rest.Request) {
 	userId := s.getUser(r)
+	key := r.PathParam("key")
+	catalog := r.Request.FormValue("catalog")
 
-	stacks, err := s.getStacks(userId)
+	lifecycle := api.SpecLifecycle{}
+	err := decodePayload(r, &lifecycle)
 	if err != nil {
 		glog.Error(err)
-		rest.Error(w, err.Error(), http.StatusInternalServerError)
-		w.WriteJson(&err)
-	} else {
-		w.WriteJson(&stacks)
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-}
-
-func (s *Server) getStacks(userId string) (*[]api.Stack, error) {
 
-	stacks := []api.Stack{}
-	stks, err := s.etcd.GetStacks(userId)
-	if err == nil {
-		for _, stack := range *stks {
-			stack, _ := s.getStackWithStatus(userId, stack.Id)
-			stacks = append(stacks, *stack)
+	var service *api.ServiceSpec
+	if catalog == "system" {
+		if !s.IsAdmin(r) {
+			rest.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		service, err = s.getSystemSpec(key)
+	} else {
+		service, err = s.etcd.GetServiceSpec(userId, key)
+		if service != nil && service.Catalog != "user" {
+			service = nil
 		}
 	}
-	return &stacks, nil
-}
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if service == nil {
+		rest.Error(w, "No such service", http.StatusNotFound)
+		return
+	}
 
-func (s *Server) isStackStopped(userId string, ssid string) bool {
-	sid := ssid[0:strings.LastIndex(ssid, "-")]
-	stack, _ := s.etcd.GetStack(userId, sid)
+	previous := service.Status
+	service.Status = lifecycle.Status
+	service.ReplacedBy = lifecycle.ReplacedBy
+	if errors := s.validateServiceSpec(userId, catalog, service); len(errors) > 0 {
+		glog.V(1).Infof("Service spec %s failed validation\n", key)
+		w.WriteHeader(http.StatusBadRequest)
+		w.WriteJson(&api.ValidationResult{Valid: false, Errors: errors})
+		return
+	}
 
-	if stack != nil && stack.Status == stackStatus[Stopped] {
-		return true
-	} else {
-		return false
+	if service.Status == api.SpecDraft && previous != api.SpecDraft && s.serviceInUse(key) > 0 {
+		glog.Warningf("Cannot return service spec %s to draft because it is in use by one or more accounts\n", key)
+		rest.Error(w, "Service is in use", http.StatusConflict)
+		return
 	}
-}
 
-func (s *Server) getStackService(userId string, ssid string) *api.StackService {
-	if strings.Index(ssid, "-") < 0 {
-		return nil
+	owner := ""
+	if catalog == "system" {
+		err = s.etcd.PutGlobalService(key, service)
+	} else {
+		owner = userId
+		err = s.etcd.PutService(userId, key, service)
 	}
-	sid := ssid[0:strings.LastIndex(ssid, "-")]
-	stack, _ := s.etcd.GetStack(userId, sid)
-	if stack == nil {
-		return nil
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	glog.V(1).Infof("Service %s status changed from %q to %q\n", key, previous, service.Status)
 
-	for _, stackService := range stack.Services {
-		if ssid == stackService.Id {
-			return &stackService
-		}
+	if service.Status == api.SpecRetired && previous != api.SpecRetired {
+		s.noticeRetired(owner, service)
 	}
-	return nil
+	w.WriteJson(service)
 }
 
-func (s *Server) accountExists(userId string) bool {
-	accounts, _ := s.etcd.GetAccounts()
-	if accounts == nil {
-		return false
+// Send a notice to each account with stacks using the retired spec. The owner
+// is the account whose catalog has the spec, or empty for the system catalog.
+func (s *Server) noticeRetired(owner string, spec *api.ServiceSpec) {
+	accounts, err := s.etcd.GetAccounts()
+	if err != nil {
+		glog.Warningf("Error sending retirement notices for %s: %s\n", spec.Key, err)
+		return
 	}
 
-	exists := false
 	for _, account := range *accounts {
-		if account.Namespace == userId {
-			exists = true
-			break
+		resolved, _ := s.etcd.GetServiceSpec(account.Namespace, spec.Key)
+		if resolved == nil || specOwner(account.Namespace, resolved) != owner {
+			continue
 		}
-	}
-	return exists
-}
 
-func (s *Server) stackServiceExists(userId string, id string) bool {
-	stacks, _ := s.getStacks(userId)
-	if stacks == nil {
+		stacks, _ := s.etcd.GetStacks(account.Namespace)
+		notice := api.Notice{
+			Id:          s.kube.RandomString(8),
+			Service:     spec.Key,
+			ReplacedBy:  spec.ReplacedBy,
+			Stacks:      []string{},
+			CreatedTime: int(time.Now().Unix()),
+		}
+		names := []string{}
+		for _, stack := range *stacks {
+			for _, stackService := range stack.Services {
+				if stackService.Service == spec.Key {
+					notice.Stacks = append(notice.Stacks, stack.Id)
+					names = append(names, stack.Name)
+					break
+				}
+			}
+		}
+		if len(notice.Stacks) == 0 {
+			continue
+		}
+
+		notice.Message = fmt.Sprintf("Service %s has been retired and can no longer be started. Affected stacks: %s",
+			spec.Label, strings.Join(names, ", "))
+		if spec.ReplacedBy != "" {
+			notice.Message += fmt.Sprintf(". Use %s instead.", spec.ReplacedBy)
+		}
+		err = s.etcd.PutNotice(account.Namespace, &notice)
+		if err != nil {
+			glog.Warningf("Error sending retirement notice for %s to %s: %s\n", spec.Key, account.Namespace, err)
+			continue
+		}
+		glog.V(1).Infof("Sent retirement notice for %s to %s\n", spec.Key, account.Namespace)
+	}
+}
+
+// The account whose catalog has the spec as seen by the user, or empty for
+// the system catalog
+func specOwner(userId string, spec *api.ServiceSpec) string {
+	switch spec.Catalog {
+	case "user":
+		return userId
+	case "shared":
+		return spec.Owner
+	}
+	return ""
+}
+
+func (s *Server) GetNotices(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+
+	notices, err := s.etcd.GetNotices(userId)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeEntity(w, r, notices)
+}
+
+// Dismiss a notice
+func (s *Server) DeleteNotice(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+
+	found, err := s.etcd.DeleteNotice(userId, r.PathParam("id"))
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		rest.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Share a user catalog spec with the accounts in the request body, replacing
+// any previous shares. Shared specs are read-only for the other accounts and
+// follow the owner's updates.
+func (s *Server) ShareService(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+	key := r.PathParam("key")
+
+	accounts := []string{}
+	err := decodePayload(r, &accounts)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	service, _ := s.etcd.GetServiceSpec(userId, key)
+	if service == nil || service.Catalog != "user" {
+		rest.Error(w, "No such service", http.StatusNotFound)
+		return
+	}
+
+	shared := map[string]bool{}
+	for _, account := range accounts {
+		if account == userId || !s.accountExists(account) {
+			rest.Error(w, "Unknown account "+account, http.StatusBadRequest)
+			return
+		}
+		shared[account] = true
+	}
+
+	// Stacks of an account keep using the shared spec, so it cannot be
+	// unshared until they no longer do
+	inUse := []string{}
+	for _, account := range service.SharedWith {
+		if !shared[account] && s.sharedServiceInUse(account, key) {
+			inUse = append(inUse, account)
+		}
+	}
+	if len(inUse) > 0 {
+		glog.Warningf("Cannot unshare service %s because it is in use by %s\n", key, strings.Join(inUse, ", "))
+		rest.Error(w, "Service is in use by "+strings.Join(inUse, ", "), http.StatusConflict)
+		return
+	}
+
+	for _, account := range service.SharedWith {
+		if !shared[account] {
+			err = s.etcd.DeleteSharedService(account, key)
+			if err != nil {
+				glog.Error(err)
+				rest.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	for _, account := range accounts {
+		err = s.etcd.PutSharedService(account, key, userId)
+		if err != nil {
+			glog.Error(err)
+			rest.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	service.SharedWith = accounts
+	err = s.etcd.PutService(userId, key, service)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	glog.V(1).Infof("User %s shared service %s with %v\n", userId, key, accounts)
+	w.WriteJson(service)
+}
+
+// Submit a user catalog spec for the system catalog. Resubmitting replaces
+// the author's pending publication of the spec.
+func (s *Server) PublishService(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+	key := r.PathParam("key")
+
+	service, _ := s.etcd.GetServiceSpec(userId, key)
+	if service == nil || service.Catalog != "user" {
+		rest.Error(w, "No such service", http.StatusNotFound)
+		return
+	}
+
+	if errors := s.validateServiceSpec(userId, "system", service); len(errors) > 0 {
+		glog.V(1).Infof("Service spec %s failed validation for publication\n", key)
+		w.WriteHeader(http.StatusBadRequest)
+		w.WriteJson(&api.ValidationResult{Valid: false, Errors: errors})
+		return
+	}
+
+	publications, err := s.etcd.GetPublications()
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	publication := api.Publication{Id: s.kube.GenerateName(5)}
+	for _, existing := range *publications {
+		if existing.Key == key && existing.Author == userId && existing.Status == api.PublicationPending {
+			publication.Id = existing.Id
+		}
+	}
+	publication.Key = key
+	publication.Author = userId
+	publication.Spec = *service
+	publication.Spec.SharedWith = nil
+	publication.Status = api.PublicationPending
+	publication.SubmittedTime = int(time.Now().Unix())
+
+	err = s.etcd.PutPublication(publication.Id, &publication)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	glog.V(1).Infof("User %s submitted service %s for publication\n", userId, key)
+	w.WriteJson(&publication)
+}
+
+// Curators see all publications, optionally by status, others their own
+func (s *Server) GetPublications(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+	status := r.Request.FormValue("status")
+
+	publications, err := s.etcd.GetPublications()
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	visible := []api.Publication{}
+	for _, publication := range *publications {
+		if !s.IsCurator(r) && publication.Author != userId {
+			continue
+		}
+		if status != "" && string(publication.Status) != status {
+			continue
+		}
+		visible = append(visible, publication)
+	}
+	writeEntity(w, r, &visible)
+}
+
+func (s *Server) GetPublication(w rest.ResponseWriter, r *rest.Request) {
+	publication := s.getPublication(w, r)
+	if publication != nil {
+		writeEntity(w, r, publication)
+	}
+}
+
+// The changes the publication makes to the system catalog spec
+func (s *Server) GetPublicationDiff(w rest.ResponseWriter, r *rest.Request) {
+	publication := s.getPublication(w, r)
+	if publication == nil {
+		return
+	}
+
+	current, err := s.getSystemSpec(publication.Key)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeEntity(w, r, diff.Specs(current, &publication.Spec))
+}
+
+// Promote the spec to the system catalog, recording its provenance
+func (s *Server) ApprovePublication(w rest.ResponseWriter, r *rest.Request) {
+	publication, review := s.reviewPublication(w, r)
+	if publication == nil {
+		return
+	}
+
+	if errors := s.validateServiceSpec("", "system", &publication.Spec); len(errors) > 0 {
+		glog.V(1).Infof("Publication %s failed validation\n", publication.Id)
+		w.WriteHeader(http.StatusBadRequest)
+		w.WriteJson(&api.ValidationResult{Valid: false, Errors: errors})
+		return
+	}
+
+	current, err := s.getSystemSpec(publication.Key)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	revision := 1
+	if current != nil {
+		if s.serviceInUse(publication.Key) > 0 {
+			glog.Warningf("Cannot publish service spec %s because it is in use by one or more accounts\n", publication.Key)
+			rest.Error(w, "Service is in use", http.StatusConflict)
+			return
+		}
+		if current.Provenance != nil {
+			revision = current.Provenance.Revision + 1
+		}
+	}
+
+	publication.Status = api.PublicationApproved
+	publication.Curator = review.Curator
+	publication.Comment = review.Comment
+	publication.ReviewedTime = int(time.Now().Unix())
+
+	spec := publication.Spec
+	spec.Provenance = &api.Provenance{
+		Author:        publication.Author,
+		Revision:      revision,
+		Curator:       publication.Curator,
+		PublishedTime: publication.ReviewedTime,
+	}
+	err = s.etcd.PutGlobalService(spec.Key, &spec)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = s.etcd.PutPublication(publication.Id, publication)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	glog.V(1).Infof("Published service %s revision %d from %s\n", spec.Key, revision, publication.Author)
+	w.WriteJson(publication)
+}
+
+func (s *Server) RejectPublication(w rest.ResponseWriter, r *rest.Request) {
+	publication, review := s.reviewPublication(w, r)
+	if publication == nil {
+		return
+	}
+
+	publication.Status = api.PublicationRejected
+	publication.Curator = review.Curator
+	publication.Comment = review.Comment
+	publication.ReviewedTime = int(time.Now().Unix())
+
+	err := s.etcd.PutPublication(publication.Id, publication)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	glog.V(1).Infof("Rejected publication %s of service %s\n", publication.Id, publication.Key)
+	w.WriteJson(publication)
+}
+
+// Get the publication for its author or a curator, writing the error if it
+// cannot be returned
+func (s *Server) getPublication(w rest.ResponseWriter, r *rest.Request) *api.Publication {
+	publication, err := s.etcd.GetPublication(r.PathParam("id"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if publication == nil || (!s.IsCurator(r) && publication.Author != s.getUser(r)) {
+		rest.NotFound(w, r)
+		return nil
+	}
+	return publication
+}
+
+// Get a pending publication for a curator to review, along with the
+// curator's comment from the request body, if any
+func (s *Server) reviewPublication(w rest.ResponseWriter, r *rest.Request) (*api.Publication, *api.Publication) {
+	if !s.IsCurator(r) {
+		rest.Error(w, "", http.StatusUnauthorized)
+		return nil, nil
+	}
+
+	review := api.Publication{}
+	if r.ContentLength > 0 {
+		err := decodePayload(r, &review)
+		if err != nil {
+			rest.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, nil
+		}
+	}
+	payload := r.Env["JWT_PAYLOAD"].(map[string]interface{})
+	review.Curator = payload["user"].(string)
+
+	publication := s.getPublication(w, r)
+	if publication == nil {
+		return nil, nil
+	}
+	if publication.Status != api.PublicationPending {
+		rest.Error(w, "Publication is "+string(publication.Status), http.StatusConflict)
+		return nil, nil
+	}
+	return publication, &review
+}
+
+// Get the system catalog spec, or nil if there is none
+func (s *Server) getSystemSpec(key string) (*api.ServiceSpec, error) {
+	spec, err := s.etcd.GetServiceSpec("", key)
+	if spec != nil && spec.Catalog != "system" {
+		spec = nil
+	}
+	return spec, err
+}
+
+func (s *Server) serviceInUse(sid string) int {
+	inUse := 0
+	accounts, _ := s.etcd.GetAccounts()
+	for _, account := range *accounts {
+		stacks, _ := s.etcd.GetStacks(account.Namespace)
+		for _, stack := range *stacks {
+			for _, service := range stack.Services {
+				if service.Service == sid {
+					inUse++
+				}
+			}
+		}
+	}
+	return inUse
+}
+
+// True if stacks of the account use the spec shared with it, rather than
+// one of its own or a system spec with the same key
+func (s *Server) sharedServiceInUse(userId string, key string) bool {
+	spec, _ := s.etcd.GetServiceSpec(userId, key)
+	if spec == nil || spec.Catalog != "shared" {
+		return false
+	}
+	stacks, _ := s.etcd.GetStacks(userId)
+	if stacks == nil {
+		return false
+	}
+	for _, stack := range *stacks {
+		for _, service := range stack.Services {
+			if service.Service == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Server) GetAllStacks(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+
+	reveal, ok := s.revealPasswords(w, r)
+	if !ok {
+		return
+	}
+
+	stacks, err := s.getStacks(userId)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		writeEntity(w, r, &err)
+	} else {
+		for i := range *stacks {
+			s.maskStackPasswords(userId, &(*stacks)[i], reveal)
+		}
+		writeEntity(w, r, &stacks)
+	}
+}
+
+func (s *Server) getStacks(userId string) (*[]api.Stack, error) {
+
+	stacks := []api.Stack{}
+	stks, err := s.etcd.GetStacks(userId)
+	if err == nil {
+		for _, stack := range *stks {
+			stack, _ := s.getStackWithStatus(userId, stack.Id)
+			stacks = append(stacks, *stack)
+		}
+	}
+	return &stacks, nil
+}
+
+func (s *Server) isStackStopped(userId string, ssid string) bool {
+	sid := ssid[0:strings.LastIndex(ssid, "-")]
+	stack, _ := s.etcd.GetStack(userId, sid)
+
+	if stack != nil && stack.Status == stackStatus[Stopped] {
+		return true
+	} else {
+		return false
+	}
+}
+
+func (s *Server) getStackService(userId string, ssid string) *api.StackService {
+	if strings.Index(ssid, "-") < 0 {
+		return nil
+	}
+	sid := ssid[0:strings.LastIndex(ssid, "-")]
+	stack, _ := s.etcd.GetStack(userId, sid)
+	if stack == nil {
+		return nil
+	}
+
+	for _, stackService := range stack.Services {
+		if ssid == stackService.Id {
+			return &stackService
+		}
+	}
+	return nil
+}
+
+func (s *Server) accountExists(userId string) bool {
+	accounts, _ := s.etcd.GetAccounts()
+	if accounts == nil {
+		return false
+	}
+
+	exists := false
+	for _, account := range *accounts {
+		if account.Namespace == userId {
+			exists = true
+			break
+		}
+	}
+	return exists
+}
+
+func (s *Server) stackServiceExists(userId string, id string) bool {
+	stacks, _ := s.getStacks(userId)
+	if stacks == nil {
 		return false
 	}
 
@@ -1024,6 +1917,11 @@ func (s *Server) GetStack(w rest.ResponseWriter, r *rest.Request) {
 	userId := s.getUser(r)
 	sid := r.PathParam("sid")
 
+	reveal, ok := s.revealPasswords(w, r)
+	if !ok {
+		return
+	}
+
 	stack, err := s.getStackWithStatus(userId, sid)
 	if stack == nil {
 		rest.NotFound(w, r)
@@ -1035,38 +1933,98 @@ func (s *Server) GetStack(w rest.ResponseWriter, r *rest.Request) {
 		rest.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	} else {
-		w.WriteJson(&stack)
+		s.maskStackPasswords(userId, stack, reveal)
+		writeEntity(w, r, &stack)
+	}
+}
+
+// Password config values are only returned to the owner of the stack, and
+// only when asked for with reveal=true
+func (s *Server) revealPasswords(w rest.ResponseWriter, r *rest.Request) (bool, bool) {
+	if r.Request.FormValue("reveal") != "true" {
+		return false, true
 	}
+	if s.IsAdmin(r) {
+		rest.Error(w, "Only the stack owner can reveal passwords", http.StatusForbidden)
+		return false, false
+	}
+	return true, true
 }
 
 func (s *Server) PostStack(w rest.ResponseWriter, r *rest.Request) {
 	userId := s.getUser(r)
 
 	stack := api.Stack{}
-	err := r.DecodeJsonPayload(&stack)
+	err := decodePayload(r, &stack)
 	if err != nil {
 		glog.Error(err)
 		rest.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if !s.createStack(w, userId, &stack) {
+		return
+	}
+	s.maskStackPasswords(userId, &stack, false)
+	w.WriteJson(&stack)
+}
+
+// Validate and store a new stack in the user's account, writing the error
+// response if it cannot be created
+func (s *Server) createStack(w rest.ResponseWriter, userId string, stack *api.Stack) bool {
 	glog.V(4).Infof("Adding stack %s %s\n", stack.Key, stack.Name)
 
-	_, err = s.etcd.GetServiceSpec(userId, stack.Key)
+	_, err := s.etcd.GetServiceSpec(userId, stack.Key)
 	if err != nil {
 		glog.V(4).Infof("Service %s not found for user %s\n", stack.Key, userId)
 
 		w.WriteHeader(http.StatusNotFound)
-		return
+		return false
+	}
+
+	err = s.validateImageTags(userId, stack)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	if errors := s.validateStackConfig(userId, stack, false); len(errors) > 0 {
+		glog.V(1).Infof("Stack %s failed config validation\n", stack.Name)
+		w.WriteHeader(http.StatusBadRequest)
+		w.WriteJson(&api.ValidationResult{Valid: false, Errors: errors})
+		return false
+	}
+
+	if errors := validation.ValidateSchedule(stack.Schedule); len(errors) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.WriteJson(&api.ValidationResult{Valid: false, Errors: errors})
+		return false
+	}
+
+	if errors := s.validateStackServices(userId, stack, nil); len(errors) > 0 {
+		glog.V(1).Infof("Stack %s uses unavailable services\n", stack.Name)
+		w.WriteHeader(http.StatusBadRequest)
+		w.WriteJson(&api.ValidationResult{Valid: false, Errors: errors})
+		return false
+	}
+
+	err = s.applyDevMode(userId, stack)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return false
 	}
 
 	sid := s.kube.GenerateName(5)
 	stack.Id = sid
 	stack.Status = stackStatus[Stopped]
+	stack.StartedTime = 0
+	stack.StopReason = ""
 
 	for i := range stack.Services {
 		stackService := &stack.Services[i]
 		stackService.Id = fmt.Sprintf("%s-%s", sid, stackService.Service)
+		// Digests are only pinned by the server
+		stackService.ImageDigest = ""
 		spec, _ := s.etcd.GetServiceSpec(userId, stackService.Service)
 		if spec != nil {
 			for _, mount := range spec.VolumeMounts {
@@ -1095,73 +2053,436 @@ func (s *Server) PostStack(w rest.ResponseWriter, r *rest.Request) {
 		}
 	}
 
-	err = s.etcd.PutStack(userId, stack.Id, &stack)
-	if err != nil {
-		glog.Error(err)
-		rest.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	err = s.storeStackPasswords(userId, stack)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	err = s.etcd.PutStack(userId, stack.Id, stack)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func (s *Server) PutStack(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+	sid := r.PathParam("sid")
+
+	stack := api.Stack{}
+
+	err := decodePayload(r, &stack)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = s.validateImageTags(userId, &stack)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if errors := s.validateStackConfig(userId, &stack, false); len(errors) > 0 {
+		glog.V(1).Infof("Stack %s failed config validation\n", stack.Name)
+		w.WriteHeader(http.StatusBadRequest)
+		w.WriteJson(&api.ValidationResult{Valid: false, Errors: errors})
+		return
+	}
+
+	if errors := validation.ValidateSchedule(stack.Schedule); len(errors) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.WriteJson(&api.ValidationResult{Valid: false, Errors: errors})
+		return
+	}
+
+	existing, _ := s.etcd.GetStack(userId, sid)
+	running := existing != nil && existing.Status != stackStatus[Stopped]
+	if running && existing.Status != stackStatus[Started] && existing.Status != string(fsm.StackError) {
+		rest.Error(w, fmt.Sprintf("Stack %s is %s", sid, existing.Status), http.StatusConflict)
+		return
+	}
+
+	if errors := s.validateStackServices(userId, &stack, existing); len(errors) > 0 {
+		glog.V(1).Infof("Stack %s uses unavailable services\n", stack.Name)
+		w.WriteHeader(http.StatusBadRequest)
+		w.WriteJson(&api.ValidationResult{Valid: false, Errors: errors})
+		return
+	}
+
+	err = s.applyDevMode(userId, &stack)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for i := range stack.Services {
+		stackService := &stack.Services[i]
+		// Create the stack service ID
+		stackService.Id = fmt.Sprintf("%s-%s", sid, stackService.Service)
+		// Digests are only pinned by the server. A running stack keeps its own.
+		stackService.ImageDigest = ""
+
+		spec, _ := s.etcd.GetServiceSpec(userId, stackService.Service)
+		if spec != nil {
+			for _, mount := range spec.VolumeMounts {
+
+				found := 0
+				for fromPath, toPath := range stackService.VolumeMounts {
+					if toPath == mount.MountPath && len(toPath) > 0 {
+						found++
+					}
+
+					if len(fromPath) == 0 {
+						volPath := fmt.Sprintf("AppData/%s", s.kube.RandomString(5))
+						stackService.VolumeMounts[volPath] = mount.MountPath
+					}
+				}
+
+				if found > 1 {
+					glog.Error(fmt.Sprintf("Two volume mounts cannot refer to the same to path\n"))
+					w.WriteHeader(http.StatusConflict)
+					return
+				}
+
+				if found == 0 {
+					// Create a new temporary folder
+					volPath := fmt.Sprintf("AppData/%s", s.kube.RandomString(5))
+					stackService.VolumeMounts[volPath] = mount.MountPath
+				}
+			}
+		}
+	}
+
+	stack.Id = sid
+	if running && !sameServices(existing, &stack) {
+		rest.Error(w, "Services cannot be added to or removed from a running stack", http.StatusConflict)
+		return
+	}
+
+	changes := map[string][]api.SpecChange{}
+	if running {
+		changes = s.passwordChanges(userId, &stack)
+	}
+
+	err = s.storeStackPasswords(userId, &stack)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	stack.Status = stackStatus[Stopped]
+	stack.StartedTime, stack.StopReason = 0, ""
+	keys := []string{}
+	conflict := ""
+	if existing == nil {
+		err = s.etcd.PutStack(userId, sid, &stack)
+	} else {
+		// Merge with the stack as it is when written, so that a stop or pod
+		// event since it was read is not lost
+		err = s.updateStack(userId, sid, func(current *api.Stack) {
+			if current.Status != existing.Status || (running && !sameServices(current, &stack)) {
+				conflict = fmt.Sprintf("Stack %s is %s", sid, current.Status)
+				return
+			}
+			stack.Status = current.Status
+			stack.StartedTime, stack.StopReason = current.StartedTime, current.StopReason
+			if running {
+				keys = s.mergeRunningStack(userId, current, &stack, changes)
+			}
+			*current = stack
+		})
+	}
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if conflict != "" {
+		rest.Error(w, conflict, http.StatusConflict)
+		return
+	}
+
+	if len(keys) > 0 {
+		// Replace the controllers of the changed services, with the rest of
+		// the stack left running
+		glog.V(4).Infof("Updating services %s of stack %s\n", strings.Join(keys, ", "), sid)
+		operation := s.newOperation(sid, "", api.OperationUpdate)
+		operation.Changes = changes
+		s.startOperation(userId, operation, func() (*api.Stack, error) {
+			return s.runStackServices(userId, sid, keys, api.OperationRestart)
+		})
+		s.writeOperation(w, operation)
+		return
+	}
+
+	s.maskStackPasswords(userId, &stack, false)
+	w.WriteJson(&stack)
+}
+
+// Check that services added to the stack are available for new stacks.
+// Services the existing stack already uses stay, even if deprecated.
+func (s *Server) validateStackServices(userId string, stack *api.Stack, existing *api.Stack) []api.ValidationError {
+	errors := []api.ValidationError{}
+	used := map[string]bool{}
+	if existing != nil {
+		for _, stackService := range existing.Services {
+			used[stackService.Service] = true
+		}
+	}
+
+	for i, stackService := range stack.Services {
+		if used[stackService.Service] {
+			continue
+		}
+		spec, _ := s.etcd.GetServiceSpec(userId, stackService.Service)
+		if spec == nil {
+			continue
+		}
+		if err := validation.Available(spec); err != nil {
+			errors = append(errors, api.ValidationError{Field: fmt.Sprintf("services[%d].service", i), Message: err.Error()})
+		}
+	}
+	return errors
+}
+
+// Services of the stack whose specs are retired
+func (s *Server) retiredServices(userId string, stack *api.Stack) []string {
+	retired := []string{}
+	for _, stackService := range stack.Services {
+		spec, _ := s.etcd.GetServiceSpec(userId, stackService.Service)
+		if spec != nil && spec.Status == api.SpecRetired {
+			retired = append(retired, stackService.Service)
+		}
+	}
+	return retired
+}
+
+// Add the developer environment of the stack's service to a stack in dev
+// mode, or remove it when dev mode is turned off. Commands can only be
+// overridden in dev mode.
+func (s *Server) applyDevMode(userId string, stack *api.Stack) error {
+	if !stack.DevMode {
+		for _, stackService := range stack.Services {
+			if len(stackService.Command) > 0 || len(stackService.Args) > 0 {
+				return fmt.Errorf("Command of service %s can only be overridden in dev mode", stackService.Service)
+			}
+		}
+	}
+
+	spec, _ := s.etcd.GetServiceSpec(userId, stack.Key)
+	if spec == nil || spec.DeveloperEnvironment == "" {
+		if stack.DevMode {
+			return fmt.Errorf("Service %s has no developer environment", stack.Key)
+		}
+		return nil
+	}
+
+	idx := -1
+	for i, stackService := range stack.Services {
+		if stackService.Service == spec.DeveloperEnvironment {
+			idx = i
+		}
+	}
+
+	if stack.DevMode && idx < 0 {
+		if !s.serviceExists(userId, spec.DeveloperEnvironment) {
+			return fmt.Errorf("Developer environment %s not found", spec.DeveloperEnvironment)
+		}
+		glog.V(4).Infof("Adding developer environment %s to stack %s\n", spec.DeveloperEnvironment, stack.Name)
+		stack.Services = append(stack.Services, api.StackService{
+			Service:      spec.DeveloperEnvironment,
+			VolumeMounts: map[string]string{},
+		})
+	} else if !stack.DevMode && idx >= 0 {
+		glog.V(4).Infof("Removing developer environment %s from stack %s\n", spec.DeveloperEnvironment, stack.Name)
+		stack.Services = append(stack.Services[:idx], stack.Services[idx+1:]...)
+	}
+	return nil
+}
+
+// Move password config values out of the stack and into the stack's config
+// secret, so they are not kept in etcd. Empty or masked values keep the value
+// already in the secret, falling back to the spec default or a generated
+// value.
+func (s *Server) storeStackPasswords(userId string, stack *api.Stack) error {
+	secretName := kube.ConfigSecretName(stack.Id)
+	secret, _ := s.kube.GetSecret(userId, secretName)
+
+	data := map[string][]byte{}
+	if secret != nil {
+		// Keep the generated and evaluated values of config templates
+		for key, value := range secret.Data {
+			if strings.HasSuffix(key, kube.RandomSecretSuffix) || strings.HasSuffix(key, kube.ValueSecretSuffix) {
+				data[key] = value
+			}
+		}
+	}
+	for i := range stack.Services {
+		stackService := &stack.Services[i]
+		spec, _ := s.etcd.GetServiceSpec(userId, stackService.Service)
+		if spec == nil {
+			continue
+		}
+		for _, config := range spec.Config {
+			if !config.IsPassword {
+				continue
+			}
+			key := kube.ConfigSecretKey(spec.Key, config.Name)
+			value := stackService.Config[config.Name]
+			delete(stackService.Config, config.Name)
+
+			if value != "" && value != api.PasswordMask && config.CanOverride {
+				data[key] = []byte(value)
+			} else if secret != nil && len(secret.Data[key]) > 0 {
+				data[key] = secret.Data[key]
+			} else if config.Value != "" {
+				data[key] = []byte(config.Value)
+			} else {
+				glog.V(4).Infof("Generating %s for stack %s\n", config.Name, stack.Id)
+				password, err := templates.Random(16)
+				if err != nil {
+					return err
+				}
+				data[key] = []byte(password)
+			}
+		}
+	}
+
+	var err error
+	if secret != nil {
+		_, err = s.kube.UpdateSecret(userId, secretName, data)
+	} else if len(data) > 0 {
+		_, err = s.kube.CreateSecret(userId, secretName, data)
 	}
-	w.WriteJson(&stack)
+	return err
 }
 
-func (s *Server) PutStack(w rest.ResponseWriter, r *rest.Request) {
-	userId := s.getUser(r)
-	sid := r.PathParam("sid")
-
-	stack := api.Stack{}
-
-	err := r.DecodeJsonPayload(&stack)
-	if err != nil {
-		glog.Error(err)
-		rest.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// Add the password config values to the stack, masked unless revealed
+func (s *Server) maskStackPasswords(userId string, stack *api.Stack, reveal bool) {
+	var secret *k8api.Secret
+	if reveal {
+		secret, _ = s.kube.GetSecret(userId, kube.ConfigSecretName(stack.Id))
 	}
 
 	for i := range stack.Services {
 		stackService := &stack.Services[i]
-		// Create the stack service ID
-		stackService.Id = fmt.Sprintf("%s-%s", sid, stackService.Service)
-
 		spec, _ := s.etcd.GetServiceSpec(userId, stackService.Service)
-		if spec != nil {
-			for _, mount := range spec.VolumeMounts {
-
-				found := 0
-				for fromPath, toPath := range stackService.VolumeMounts {
-					if toPath == mount.MountPath && len(toPath) > 0 {
-						found++
-					}
+		if spec == nil {
+			continue
+		}
+		for _, config := range spec.Config {
+			if !config.IsPassword {
+				continue
+			}
+			if stackService.Config == nil {
+				stackService.Config = map[string]string{}
+			}
+			if secret != nil {
+				stackService.Config[config.Name] = string(secret.Data[kube.ConfigSecretKey(spec.Key, config.Name)])
+			} else {
+				stackService.Config[config.Name] = api.PasswordMask
+			}
+		}
+	}
+}
 
-					if len(fromPath) == 0 {
-						volPath := fmt.Sprintf("AppData/%s", s.kube.RandomString(5))
-						stackService.VolumeMounts[volPath] = mount.MountPath
-					}
-				}
+// Validate stack service config values against their specs, and repository
+// refs. Required values are only checked when the stack is started, since
+// stacks are usually configured after they are added.
+func (s *Server) validateStackConfig(userId string, stack *api.Stack, required bool) []api.ValidationError {
+	errors := []api.ValidationError{}
+	for i, stackService := range stack.Services {
+		spec, _ := s.etcd.GetServiceSpec(userId, stackService.Service)
+		if spec == nil {
+			continue
+		}
+		field := fmt.Sprintf("services[%d].config", i)
+		errors = append(errors, validation.ValidateStackConfig(field, spec, stackService.Config, required)...)
+		for url, ref := range stackService.RepositoryRefs {
+			if err := vcs.CheckRef(ref); err != nil {
+				errors = append(errors, api.ValidationError{
+					Field:   fmt.Sprintf("services[%d].repositoryRefs[%s]", i, url),
+					Message: err.Error(),
+				})
+			}
+		}
+	}
+	return errors
+}
 
-				if found > 1 {
-					glog.Error(fmt.Sprintf("Two volume mounts cannot refer to the same to path\n"))
-					w.WriteHeader(http.StatusConflict)
-					return
-				}
+// Image tags chosen for stack services must be listed in the spec or exist
+// in the registry
+func (s *Server) validateImageTags(userId string, stack *api.Stack) error {
+	for _, stackService := range stack.Services {
+		if stackService.ImageTag == "" {
+			continue
+		}
+		spec, _ := s.etcd.GetServiceSpec(userId, stackService.Service)
+		if spec == nil {
+			continue
+		}
+		found := false
+		for _, tag := range spec.Image.Tags {
+			if tag == stackService.ImageTag {
+				found = true
+			}
+		}
+		if found {
+			continue
+		}
 
-				if found == 0 {
-					// Create a new temporary folder
-					volPath := fmt.Sprintf("AppData/%s", s.kube.RandomString(5))
-					stackService.VolumeMounts[volPath] = mount.MountPath
-				}
+		tags, err := s.registry.Tags(spec.Image)
+		if err != nil {
+			glog.Warningf("Unable to list tags for %s: %s\n", spec.Image.Name, err)
+			return fmt.Errorf("Unable to verify tag %s for service %s", stackService.ImageTag, stackService.Service)
+		}
+		for _, tag := range tags {
+			if tag == stackService.ImageTag {
+				found = true
 			}
 		}
+		if !found {
+			return fmt.Errorf("Unknown tag %s for service %s", stackService.ImageTag, stackService.Service)
+		}
+	}
+	return nil
+}
+
+// Pin each stack service to the digest its tag currently points to, so all
+// pods started for this run use the same image. Services whose digest cannot
+// be resolved fall back to the tag.
+func (s *Server) pinImageDigests(userId string, stack *api.Stack) {
+	for i := range stack.Services {
+		s.pinImageDigest(userId, &stack.Services[i])
 	}
+}
 
-	stack.Status = stackStatus[Stopped]
-	err = s.etcd.PutStack(userId, sid, &stack)
-	if err != nil {
-		glog.Error(err)
-		rest.Error(w, err.Error(), http.StatusInternalServerError)
+func (s *Server) pinImageDigest(userId string, stackService *api.StackService) {
+	stackService.ImageDigest = ""
+
+	spec, _ := s.etcd.GetServiceSpec(userId, stackService.Service)
+	if spec == nil || len(spec.Image.Tags) == 0 {
 		return
 	}
+	tag := spec.Image.Tags[0]
+	if stackService.ImageTag != "" {
+		tag = stackService.ImageTag
+	}
 
-	w.WriteJson(&stack)
+	digest, err := s.registry.Digest(spec.Image, tag)
+	if err != nil {
+		glog.Warningf("Unable to resolve %s:%s, not pinning: %s\n", spec.Image.Name, tag, err)
+		return
+	}
+	glog.V(4).Infof("Pinning %s to %s\n", stackService.Id, digest)
+	stackService.ImageDigest = digest
 }
 
 func (s *Server) DeleteStack(w rest.ResponseWriter, r *rest.Request) {
@@ -1189,54 +2510,21 @@ func (s *Server) DeleteStack(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-}
-
-func (s *Server) startStackService(serviceKey string, userId string, stack *api.Stack, addrPortMap *map[string]kube.ServiceAddrPort) {
-
-	service, _ := s.etcd.GetServiceSpec(userId, serviceKey)
-	for _, dep := range service.Dependencies {
-		if dep.Required {
-			glog.V(4).Infof("Starting required dependency %s\n", dep.DependencyKey)
-			s.startController(userId, dep.DependencyKey, stack, addrPortMap)
-		} else {
-			s.startStackService(dep.DependencyKey, userId, stack, addrPortMap)
-		}
-	}
-}
-
-func (s *Server) startController(userId string, serviceKey string, stack *api.Stack, addrPortMap *map[string]kube.ServiceAddrPort) (bool, error) {
-
-	var stackService *api.StackService
-	found := false
-	for i := range stack.Services {
-		ss := &stack.Services[i]
-		if ss.Service == serviceKey {
-			stackService = ss
-			found = true
-		}
-	}
-	if !found {
-		return false, nil
-	}
-
-	pods, _ := s.kube.GetPods(userId, "name", fmt.Sprintf("%s-%s", stack.Id, serviceKey))
-	running := false
-	for _, pod := range pods {
-		if pod.Status.Phase == "Running" {
-			running = true
-		}
+	// Stacks without passwords have no config secret
+	_, err = s.kube.DeleteSecret(userId, kube.ConfigSecretName(sid))
+	if err != nil {
+		glog.V(4).Info(err)
 	}
 
-	if running {
-		glog.V(4).Infof("Controller %s already running\n", serviceKey)
-		return true, nil
-	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	glog.V(4).Infof("Starting controller for %s\n", serviceKey)
-	spec, _ := s.etcd.GetServiceSpec(userId, serviceKey)
+// Build the replication controller for a stack service, including volumes
+// for the home directory, user mounts and the docker socket
+func (s *Server) createControllerTemplate(userId string, stack *api.Stack, stackService *api.StackService, spec *api.ServiceSpec, addrPortMap *map[string]kube.ServiceAddrPort, configs *stackConfig) *k8api.ReplicationController {
 
 	sharedEnv := make(map[string]string)
+	sharedSecrets := make(map[string]string)
 	// Hack to allow for sharing configuration information between dependent services
 	for _, depends := range spec.Dependencies {
 		if depends.ShareConfig {
@@ -1245,17 +2533,44 @@ func (s *Server) startController(userId string, serviceKey string, stack *api.St
 				ss := &stack.Services[i]
 				if ss.Service == depends.DependencyKey {
 					// Found it. Now get it's config
-					for key, value := range ss.Config {
+					for key, value := range configs.values[ss.Service] {
+						if secretKey, ok := configs.secrets[ss.Service][key]; ok {
+							sharedSecrets[key] = secretKey
+							continue
+						}
 						sharedEnv[key] = value
 						glog.V(4).Infof("Adding env from %s  %s=%s\n", ss.Service, key, value)
 					}
+					// Passwords are shared by reference to the config secret
+					dep, _ := s.etcd.GetServiceSpec(userId, ss.Service)
+					if dep == nil {
+						continue
+					}
+					for _, config := range dep.Config {
+						if config.IsPassword {
+							delete(sharedEnv, config.Name)
+							sharedSecrets[config.Name] = kube.ConfigSecretKey(dep.Key, config.Name)
+						}
+					}
 				}
 			}
 		}
 	}
 
+	// Use the evaluated config rather than the stored templates. Values
+	// kept in the config secret are passed by reference.
+	evaluated := *stackService
+	evaluated.Config = map[string]string{}
+	for name, value := range configs.values[spec.Key] {
+		if secretKey, ok := configs.secrets[spec.Key][name]; ok {
+			sharedSecrets[name] = secretKey
+			continue
+		}
+		evaluated.Config[name] = value
+	}
+
 	name := fmt.Sprintf("%s-%s", stack.Id, spec.Key)
-	template := s.kube.CreateControllerTemplate(userId, name, stack.Id, stackService, spec, addrPortMap, &sharedEnv)
+	template := s.kube.CreateControllerTemplate(userId, name, stack.Id, &evaluated, spec, addrPortMap, &sharedEnv, &sharedSecrets)
 
 	k8vols := make([]k8api.Volume, 0)
 
@@ -1333,79 +2648,299 @@ func (s *Server) startController(userId string, serviceKey string, stack *api.St
 			}
 		}
 	}
+
+	if stack.DevMode {
+		container := &template.Spec.Template.Spec.Containers[0]
+		if len(stackService.Command) > 0 {
+			container.Command = stackService.Command
+		}
+		if len(stackService.Args) > 0 {
+			container.Args = stackService.Args
+		}
+
+		// The developer environment mounts the volumes of the stack's
+		// service at the same paths, so the source can be edited in place
+		app, _ := s.etcd.GetServiceSpec(userId, stack.Key)
+		if app != nil && app.DeveloperEnvironment == spec.Key {
+			for _, ss := range stack.Services {
+				if ss.Service != stack.Key {
+					continue
+				}
+				// Volumes are numbered in mount path order, so the
+				// controller is the same each time it is built
+				fromPaths := map[string]string{}
+				toPaths := []string{}
+				for fromPath, toPath := range ss.VolumeMounts {
+					fromPaths[toPath] = fromPath
+					toPaths = append(toPaths, toPath)
+				}
+				sort.Strings(toPaths)
+
+				idx := 0
+				for _, toPath := range toPaths {
+					fromPath := fromPaths[toPath]
+					inUse := false
+					for _, mount := range container.VolumeMounts {
+						if mount.MountPath == toPath {
+							inUse = true
+						}
+					}
+					if inUse {
+						glog.Warningf("Not mounting %s in developer environment, path in use\n", toPath)
+						continue
+					}
+
+					volName := fmt.Sprintf("dev%d", idx)
+					k8hostPath := k8api.HostPathVolumeSource{Path: s.volDir + "/" + userId + "/" + fromPath}
+					k8vols = append(k8vols, k8api.Volume{Name: volName, VolumeSource: k8api.VolumeSource{HostPath: &k8hostPath}})
+					container.VolumeMounts = append(container.VolumeMounts, k8api.VolumeMount{Name: volName, MountPath: toPath})
+					idx++
+				}
+			}
+		}
+	}
 	template.Spec.Template.Spec.Volumes = k8vols
 
+	return template
+}
+
+// Start the replication controller for the stack service. Returns true if
+// its pod is already running, otherwise the watches report when it is ready.
+func (s *Server) startController(userId string, serviceKey string, stack *api.Stack, addrPortMap *map[string]kube.ServiceAddrPort, configs *stackConfig) (bool, error) {
+
+	var stackService *api.StackService
+	for i := range stack.Services {
+		ss := &stack.Services[i]
+		if ss.Service == serviceKey {
+			stackService = ss
+		}
+	}
+	if stackService == nil {
+		return false, fmt.Errorf("No such stack service %s", serviceKey)
+	}
+
+	pods, _ := s.kube.GetPods(userId, "name", fmt.Sprintf("%s-%s", stack.Id, serviceKey))
+	for _, pod := range pods {
+		if pod.Status.Phase == "Running" {
+			glog.V(4).Infof("Controller %s already running\n", serviceKey)
+			return true, nil
+		}
+	}
+
+	glog.V(4).Infof("Starting controller for %s\n", serviceKey)
+	spec, _ := s.etcd.GetServiceSpec(userId, serviceKey)
+
+	name := fmt.Sprintf("%s-%s", stack.Id, spec.Key)
+	template := s.createControllerTemplate(userId, stack, stackService, spec, addrPortMap, configs)
+
 	glog.V(4).Infof("Starting controller %s\n", name)
 	_, err := s.kube.StartController(userId, template)
 	if err != nil {
-		stackService.Status = "error"
-		stackService.StatusMessages = append(stackService.StatusMessages,
-			fmt.Sprintf("Error starting stack service: %s\n", err))
-		return false, err
+		return false, fmt.Errorf("Error starting stack service: %s", err)
 	}
+	return false, nil
+}
 
-	// Give Kubernetes time to create the pods for the RC
-	time.Sleep(time.Second * 3)
+// Start the stack, or a service of a started stack given its stack service
+// id, in the background, returning the operation to follow
+func (s *Server) StartStack(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+	sid := r.PathParam("sid")
 
-	// Wait for stack service to be in ready state
-	ready := 0
-	failed := 0
+	if strings.Contains(sid, "-") {
+		s.stackServiceOperation(w, r, sid, api.OperationStart)
+		return
+	}
 
-	for (ready + failed) < len(stack.Services) {
-		stack, _ := s.etcd.GetStack(userId, stack.Id)
-		for _, stackService := range stack.Services {
-			glog.V(4).Infof("Stack service %s: status=%s\n", stackService.Id, stackService.Status)
-			if stackService.Status == "ready" {
-				ready++
-			} else if stackService.Status == "error" {
-				failed++
-			}
-		}
-		time.Sleep(time.Second * 3)
+	stack, _ := s.etcd.GetStack(userId, sid)
+	if stack == nil {
+		rest.NotFound(w, r)
+		return
 	}
+	glog.V(4).Infof("Starting stack %s", stack.Id)
 
-	if failed > 0 {
-		return false, nil
-	} else {
-		return true, nil
+	glog.V(4).Infof("Stack status %s\n", stack.Status)
+	if stack.Status != stackStatus[Stopped] {
+		// Can't start a stopping or started service
+		glog.V(4).Infof("Can't start a service with status %s\n", stack.Status)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if !s.checkStartable(w, userId, stack) {
+		return
+	}
+
+	if !s.transitionStack(userId, sid, stackStatus[Stopped], stackStatus[Starting]) {
+		w.WriteHeader(http.StatusConflict)
+		return
 	}
+	stack.Status = stackStatus[Starting]
+
+	operation := s.newOperation(sid, "", api.OperationStart)
+	s.startOperation(userId, operation, func() (*api.Stack, error) {
+		return s.startStack(userId, stack)
+	})
+	s.writeOperation(w, operation)
 }
 
-func (s *Server) StartStack(w rest.ResponseWriter, r *rest.Request) {
+// Restart a started stack, or one in error, or one of its services, in the
+// background
+func (s *Server) RestartStack(w rest.ResponseWriter, r *rest.Request) {
 	userId := s.getUser(r)
 	sid := r.PathParam("sid")
 
-	stack, _ := s.etcd.GetStack(userId, sid)
-	if stack == nil {
-		rest.NotFound(w, r)
-		return
+	if strings.Contains(sid, "-") {
+		s.stackServiceOperation(w, r, sid, api.OperationRestart)
+		return
+	}
+
+	stack, _ := s.etcd.GetStack(userId, sid)
+	if stack == nil {
+		rest.NotFound(w, r)
+		return
+	}
+
+	if stack.Status != stackStatus[Started] && stack.Status != string(fsm.StackError) {
+		glog.V(4).Infof("Can't restart a stack with status %s\n", stack.Status)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if !s.checkStartable(w, userId, stack) {
+		return
+	}
+
+	if !s.transitionStack(userId, sid, stack.Status, stackStatus[Stopping]) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	operation := s.newOperation(sid, "", api.OperationRestart)
+	s.startOperation(userId, operation, func() (*api.Stack, error) {
+		_, err := s.stopStack(userId, sid)
+		if err != nil {
+			return nil, err
+		}
+		if !s.transitionStack(userId, sid, stackStatus[Stopped], stackStatus[Starting]) {
+			return nil, fmt.Errorf("Stack %s changed during the restart", sid)
+		}
+		stack, err := s.etcd.GetStack(userId, sid)
+		if err != nil {
+			return nil, err
+		}
+		return s.startStack(userId, stack)
+	})
+	s.writeOperation(w, operation)
+}
+
+// Check that the stack's config is complete and none of its services are
+// retired, writing the error if not
+func (s *Server) checkStartable(w rest.ResponseWriter, userId string, stack *api.Stack) bool {
+	if errors := s.validateStackConfig(userId, stack, true); len(errors) > 0 {
+		glog.V(1).Infof("Stack %s failed config validation\n", stack.Id)
+		w.WriteHeader(http.StatusBadRequest)
+		w.WriteJson(&api.ValidationResult{Valid: false, Errors: errors})
+		return false
+	}
+
+	if retired := s.retiredServices(userId, stack); len(retired) > 0 {
+		rest.Error(w, "Retired services cannot be started: "+strings.Join(retired, ", "), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// Start the stack's services in dependency order, returning once the stack
+// is started, in error or stopped by a concurrent stop. The stack is marked
+// as starting by the caller.
+func (s *Server) startStack(userId string, stack *api.Stack) (*api.Stack, error) {
+
+	sid := stack.Id
+
+	deps, err := s.stackGraph(userId, stack)
+	if err != nil {
+		return nil, s.abortStart(userId, sid, err)
+	}
+
+	if retired := s.retiredServices(userId, stack); len(retired) > 0 {
+		return nil, s.abortStart(userId, sid, fmt.Errorf("Retired services cannot be started: %s", strings.Join(retired, ", ")))
+	}
+
+	actions := &stackActions{server: s, userId: userId, stack: stack}
+	m := fsm.New(deps, actions, s.pool, s.timeouts)
+	if existing := s.addMachine(userId, sid, m); existing != nil {
+		return nil, s.abortStart(userId, sid, fmt.Errorf("Stack %s is already starting or stopping", sid))
 	}
-	glog.V(4).Infof("Starting stack %s", stack.Id)
+	defer s.removeMachine(userId, sid, m)
 
-	glog.V(4).Infof("Stack status %s\n", stack.Status)
-	if stack.Status != stackStatus[Stopped] {
-		// Can't start a stopping or started service
-		glog.V(4).Infof("Can't start a service with status %s\n", stack.Status)
-		w.WriteHeader(http.StatusConflict)
-		return
+	// A stop before the machine was registered has nothing to cancel
+	current, err := s.etcd.GetStack(userId, sid)
+	if err != nil || current == nil || current.Status == stackStatus[Stopped] {
+		m.Close()
+		return current, err
+	}
+
+	if s.pinDigests {
+		s.pinImageDigests(userId, stack)
+	} else {
+		// Digests pinned while pinning was on would hold back the tags
+		for i := range stack.Services {
+			stack.Services[i].ImageDigest = ""
+		}
 	}
 
-	stack, err := s.startStack(userId, stack)
+	err = s.prepareStack(userId, stack, deps, actions)
 	if err != nil {
-		rest.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		glog.Errorf("Error starting stack %s: %s\n", sid, err)
+		m.Stop()
+		return nil, err
 	}
-	w.WriteJson(&stack)
+
+	glog.V(4).Infof("Starting services for %s %s\n", userId, sid)
+	state := m.Start()
+	glog.V(4).Infof("Stack %s %s\n", sid, state)
+
+	return s.getStackWithStatus(userId, sid)
 }
 
-func (s *Server) startStack(userId string, stack *api.Stack) (*api.Stack, error) {
+// Return a stack that could not be started before its machine ran from
+// starting to stopped, recording why. Returns err.
+func (s *Server) abortStart(userId string, sid string, err error) error {
+	glog.Errorf("Error starting stack %s: %s\n", sid, err)
+	s.updateStack(userId, sid, func(stack *api.Stack) {
+		if stack.Status == stackStatus[Starting] {
+			stack.Status = stackStatus[Stopped]
+			stack.StopReason = err.Error()
+		}
+	})
+	return err
+}
 
+// Set up what the stack's controllers need: pinned images, the password
+// secret, the Kubernetes services and the evaluated config
+func (s *Server) prepareStack(userId string, stack *api.Stack, deps *graph.Graph, actions *stackActions) error {
 	sid := stack.Id
-	stack.Status = stackStatus[Starting]
-	s.etcd.PutStack(userId, sid, stack)
-
 	stackServices := stack.Services
 
+	// Stacks saved before passwords were kept in secrets still have them in
+	// their config
+	err := s.storeStackPasswords(userId, stack)
+	if err != nil {
+		return err
+	}
+
+	// Only the config without passwords and the pinned digests change here.
+	// The stack's status is being written by the machine and the watches.
+	s.updateStack(userId, sid, func(current *api.Stack) {
+		for i := range current.Services {
+			if j := serviceIndex(stack, current.Services[i].Service); j >= 0 {
+				current.Services[i].Config = stack.Services[j].Config
+				current.Services[i].ImageDigest = stack.Services[j].ImageDigest
+			}
+		}
+	})
+
 	// Start all Kubernetes services
 	addrPortMap := make(map[string]kube.ServiceAddrPort)
 	for _, stackService := range stackServices {
@@ -1421,7 +2956,7 @@ func (s *Server) startStack(userId string, stack *api.Stack) (*api.Stack, error)
 				svc, err = s.kube.StartService(userId, template)
 				if err != nil {
 					glog.Errorf("Error starting service %s\n", name)
-					return nil, err
+					return err
 				}
 
 				if s.ingress == IngressTypeLoadBalancer &&
@@ -1434,7 +2969,7 @@ func (s *Server) startStack(userId string, stack *api.Stack) (*api.Stack, error)
 						int(svc.Spec.Ports[0].Port), secretName)
 					if err != nil {
 						glog.Errorf("Error creating ingress %s\n", name)
-						return nil, err
+						return err
 					}
 					glog.V(4).Infof("Started ingress %s for service %s\n", host, svc.Name)
 				}
@@ -1449,81 +2984,193 @@ func (s *Server) startStack(userId string, stack *api.Stack) (*api.Stack, error)
 				Host:     svc.Spec.ClusterIP,
 				Port:     svc.Spec.Ports[0].Port,
 				NodePort: svc.Spec.Ports[0].NodePort,
+				Protocol: svc.Spec.Ports[0].Protocol,
 			}
 			addrPortMap[stackService.Service] = addrPort
 		}
 	}
 
-	// For each stack service, if no dependencies or dependency == started,
-	// start service. Otherwise wait
-	started := map[string]int{}
-	errors := map[string]int{}
-	glog.V(4).Infof("Starting services for %s %s\n", userId, sid)
-	for len(started) < len(stackServices) {
-		if len(errors) > 0 {
-			// Dependent service is in error, abort
-			glog.V(4).Infof("Aborting startup due to error\n")
-			break
+	configs, err := s.evaluateStackConfig(userId, stack, deps, &addrPortMap, true)
+	if err != nil {
+		return err
+	}
+	actions.addrPortMap = &addrPortMap
+	actions.configs = configs
+	return nil
+}
+
+// Build the dependency graph for the services in a stack. Fails if the
+// services are missing from the catalog or their dependencies form a cycle.
+func (s *Server) stackGraph(userId string, stack *api.Stack) (*graph.Graph, error) {
+	keys := []string{}
+	for _, stackService := range stack.Services {
+		keys = append(keys, stackService.Service)
+	}
+
+	deps, err := graph.New(keys, s.specLookup(userId))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := deps.StartOrder(); err != nil {
+		return nil, err
+	}
+	return deps, nil
+}
+
+// Build the dependency graph for stopping services. Services whose specs no
+// longer resolve have no dependencies, so they are stopped without ordering
+// rather than keeping the stack from stopping.
+func (s *Server) stopGraph(userId string, keys []string) (*graph.Graph, error) {
+	lookup := s.specLookup(userId)
+	return graph.New(keys, func(key string) *api.ServiceSpec {
+		spec := lookup(key)
+		if spec == nil {
+			glog.Warningf("Stopping service %s without its spec\n", key)
+			return &api.ServiceSpec{Key: key}
+		}
+		return spec
+	})
+}
+
+// The evaluated config of each stack service. Values that contain a
+// password of a dependency or a generated random value are kept in the
+// stack's config secret, and secrets holds their secret keys by name.
+type stackConfig struct {
+	values  map[string]map[string]string
+	secrets map[string]map[string]string
+}
+
+// Evaluate the config value templates of each stack service. Services are
+// evaluated in start order so that they can refer to the evaluated config,
+// including passwords, of their dependencies. Spec defaults that are
+// templates are used when the stack does not set a value. Values generated
+// by {{ random N }} are kept in the stack's config secret and reused. Unless
+// save is set the secret is left as it is, so values that would be generated
+// are not kept.
+func (s *Server) evaluateStackConfig(userId string, stack *api.Stack, deps *graph.Graph, addrPortMap *map[string]kube.ServiceAddrPort, save bool) (*stackConfig, error) {
+	order, err := deps.StartOrder()
+	if err != nil {
+		return nil, err
+	}
+	secret, _ := s.kube.GetSecret(userId, kube.ConfigSecretName(stack.Id))
+	secretData := map[string][]byte{}
+	if secret != nil {
+		for key, value := range secret.Data {
+			secretData[key] = value
+		}
+	}
+	changed := false
+	setSecret := func(key string, value string) {
+		if value == "" {
+			changed = changed || secretData[key] != nil
+			delete(secretData, key)
+		} else if string(secretData[key]) != value {
+			secretData[key] = []byte(value)
+			changed = true
+		}
+	}
+
+	configs := &stackConfig{values: map[string]map[string]string{}, secrets: map[string]map[string]string{}}
+	dependencies := map[string]templates.Dependency{}
+	passwords := []string{}
+	for _, key := range order {
+		spec, _ := s.etcd.GetServiceSpec(userId, key)
+		if spec == nil {
+			continue
+		}
+
+		data := &templates.Data{
+			Stack:     stack.Id,
+			Name:      stack.Name,
+			Namespace: userId,
+			Domain:    s.domain,
+			Deps:      map[string]templates.Dependency{},
+		}
+		for _, dep := range deps.Dependencies(key) {
+			data.Deps[dep] = dependencies[dep]
 		}
 
-		stack, _ = s.getStackWithStatus(userId, sid)
+		values := map[string]string{}
 		for _, stackService := range stack.Services {
-			if stackService.Status == "error" {
-				errors[stackService.Service] = 1
-				break
+			if stackService.Service == key {
+				for name, value := range stackService.Config {
+					values[name] = value
+				}
 			}
-
-			if started[stackService.Service] == 1 {
+		}
+		for _, config := range spec.Config {
+			if _, ok := values[config.Name]; !ok && templates.IsTemplate(config.Value) {
+				values[config.Name] = config.Value
+			}
+		}
+		secrets := map[string]string{}
+		for name, value := range values {
+			valueKey := kube.ValueSecretKey(key, name)
+			randomKey := kube.RandomSecretKey(key, name)
+			if !templates.IsTemplate(value) {
+				setSecret(valueKey, "")
+				setSecret(randomKey, "")
 				continue
 			}
-			svc, _ := s.etcd.GetServiceSpec(userId, stackService.Service)
+			saved := []string{}
+			if len(secretData[randomKey]) > 0 {
+				saved = strings.Split(string(secretData[randomKey]), ",")
+			}
+			var used []string
+			values[name], used, err = templates.EvaluateRandom(value, data, saved)
+			if err != nil {
+				return nil, fmt.Errorf("Error evaluating %s for service %s: %s", name, key, err)
+			}
+			setSecret(randomKey, strings.Join(used, ","))
 
-			numDeps := 0
-			startedDeps := 0
-			for _, dep := range svc.Dependencies {
-				for _, ss := range stack.Services {
-					if dep.DependencyKey == ss.Service {
-						numDeps++
-						if ss.Status == "ready" {
-							startedDeps++
-						}
-					}
+			secretValue := len(used) > 0
+			for _, password := range passwords {
+				if strings.Contains(values[name], password) {
+					secretValue = true
 				}
 			}
-			if numDeps == 0 || startedDeps == numDeps {
-				go s.startController(userId, stackService.Service, stack, &addrPortMap)
-				started[stackService.Service] = 1
+			if secretValue {
+				setSecret(valueKey, values[name])
+				secrets[name] = valueKey
+			} else {
+				setSecret(valueKey, "")
 			}
 		}
-		time.Sleep(time.Second * 3)
-	}
+		configs.values[key] = values
+		configs.secrets[key] = secrets
 
-	ready := map[string]int{}
-	for len(ready) < len(started) && len(errors) == 0 {
-		stack, _ = s.getStackWithStatus(userId, sid)
-		for _, stackService := range stack.Services {
-			if stackService.Status == "ready" {
-				ready[stackService.Service] = 1
-			}
-			if stackService.Status == "error" {
-				errors[stackService.Service] = 1
+		dependency := templates.Dependency{Config: map[string]string{}}
+		for name, value := range values {
+			dependency.Config[name] = value
+		}
+		for _, config := range spec.Config {
+			if config.IsPassword && secret != nil {
+				password := string(secret.Data[kube.ConfigSecretKey(key, config.Name)])
+				dependency.Config[config.Name] = password
+				if password != "" {
+					passwords = append(passwords, password)
+				}
 			}
 		}
-		time.Sleep(time.Second * 3)
+		if addrPort, ok := (*addrPortMap)[key]; ok {
+			dependency.Host = addrPort.Host
+			dependency.Port = addrPort.Port
+			dependency.NodePort = addrPort.NodePort
+		}
+		dependencies[key] = dependency
 	}
 
-	stack, _ = s.getStackWithStatus(userId, sid)
-	stack.Status = "started"
-	for _, stackService := range stack.Services {
-		if stackService.Status == "error" {
-			stack.Status = "error"
+	if changed && save {
+		if secret != nil {
+			_, err = s.kube.UpdateSecret(userId, kube.ConfigSecretName(stack.Id), secretData)
+		} else {
+			_, err = s.kube.CreateSecret(userId, kube.ConfigSecretName(stack.Id), secretData)
+		}
+		if err != nil {
+			return nil, err
 		}
 	}
-
-	s.etcd.PutStack(userId, sid, stack)
-	glog.V(4).Infof("Stack %s started\n", sid)
-
-	return stack, nil
+	return configs, nil
 }
 
 func (s *Server) getStackWithStatus(userId string, sid string) (*api.Stack, error) {
@@ -1548,12 +3195,13 @@ func (s *Server) getStackWithStatus(userId string, sid string) (*api.Stack, erro
 		spec, err := s.etcd.GetServiceSpec(userId, stackService.Service)
 		if err != nil {
 			glog.Error(err)
+			continue
 		}
 
 		stackService.InternalIP = k8service.Spec.ClusterIP
 		for _, specPort := range spec.Ports {
 			for _, k8port := range k8service.Spec.Ports {
-				if specPort.Port == k8port.Port {
+				if specPort.Port == k8port.Port && kube.PortProtocol(specPort) == k8port.Protocol {
 					endpoint := api.Endpoint{}
 					endpoint.Port = specPort.Port
 					endpoint.Protocol = specPort.Protocol
@@ -1572,9 +3220,21 @@ func (s *Server) getStackWithStatus(userId string, sid string) (*api.Stack, erro
 	return stack, nil
 }
 
-func (s *Server) StopStack(w rest.ResponseWriter, r *rest.Request) {
+// The value of each key of the stack's config secret in exports
+const secretPlaceholder = "CHANGEME"
+
+// Render the Kubernetes objects or docker-compose file that starting the stack
+// would create. Services are linked by DNS name rather than cluster IP.
+// Secrets are replaced by placeholders.
+func (s *Server) ExportStack(w rest.ResponseWriter, r *rest.Request) {
 	userId := s.getUser(r)
 	sid := r.PathParam("sid")
+	format := r.Request.FormValue("format")
+
+	if format != "" && format != "k8s" && format != "compose" {
+		rest.Error(w, "Unsupported format "+format, http.StatusBadRequest)
+		return
+	}
 
 	stack, err := s.etcd.GetStack(userId, sid)
 	if stack == nil {
@@ -1587,23 +3247,157 @@ func (s *Server) StopStack(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
-	stack, err = s.stopStack(userId, sid)
-	if err == nil {
-		glog.V(4).Infof("Stack %s stopped \n", sid)
-		w.WriteJson(&stack)
+	deps, err := s.stackGraph(userId, stack)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	order, _ := deps.StartOrder()
+
+	specs := map[string]*api.ServiceSpec{}
+	addrPortMap := make(map[string]kube.ServiceAddrPort)
+	for _, key := range order {
+		spec, _ := s.etcd.GetServiceSpec(userId, key)
+		specs[key] = spec
+		if len(spec.Ports) > 0 {
+			addrPortMap[key] = kube.ServiceAddrPort{
+				Name:     key,
+				Host:     fmt.Sprintf("%s-%s", stack.Id, key),
+				Port:     spec.Ports[0].Port,
+				Protocol: kube.PortProtocol(spec.Ports[0]),
+			}
+		}
+	}
+
+	// Exporting must not change the stack's config secret
+	configs, err := s.evaluateStackConfig(userId, stack, deps, &addrPortMap, false)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	objects := []interface{}{}
+	services := []*k8api.Service{}
+	controllers := []*k8api.ReplicationController{}
+	depends := map[string][]string{}
+	for _, key := range order {
+		spec := specs[key]
+		name := fmt.Sprintf("%s-%s", stack.Id, key)
+
+		if len(spec.Ports) > 0 {
+			svc := s.kube.CreateServiceTemplate(name, stack.Id, spec)
+			services = append(services, svc)
+			objects = append(objects, svc)
+
+			if s.ingress == IngressTypeLoadBalancer && spec.Access == api.AccessExternal {
+				host := fmt.Sprintf("%s.%s", name, s.domain)
+				secretName := fmt.Sprintf("%s-tls-secret", userId)
+				objects = append(objects, s.kube.CreateIngressTemplate(userId, host, name, int(spec.Ports[0].Port), secretName))
+			}
+		}
+
+		for i := range stack.Services {
+			if stack.Services[i].Service == key {
+				rc := s.createControllerTemplate(userId, stack, &stack.Services[i], spec, &addrPortMap, configs)
+				controllers = append(controllers, rc)
+				objects = append(objects, rc)
+			}
+		}
+
+		for _, dep := range deps.Dependencies(key) {
+			depends[name] = append(depends[name], fmt.Sprintf("%s-%s", stack.Id, dep))
+		}
+	}
+
+	var data []byte
+	if format == "compose" {
+		data, err = compose.Export(controllers, services, depends, s.volDir+"/"+userId)
 	} else {
+		// Secrets are not exported, the controllers refer to placeholders
+		keys := []string{}
+		seen := map[string]bool{}
+		for _, rc := range controllers {
+			for _, container := range rc.Spec.Template.Spec.Containers {
+				for _, env := range container.Env {
+					if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil && !seen[env.ValueFrom.SecretKeyRef.Key] {
+						seen[env.ValueFrom.SecretKeyRef.Key] = true
+						keys = append(keys, env.ValueFrom.SecretKeyRef.Key)
+					}
+				}
+			}
+		}
+		if len(keys) > 0 {
+			sort.Strings(keys)
+			objects = append([]interface{}{s.kube.CreateSecretTemplate(stack.Id, keys, secretPlaceholder)}, objects...)
+		}
+		manifests := []string{}
+		for _, object := range objects {
+			var manifest []byte
+			manifest, err = yaml.Marshal(object)
+			if err != nil {
+				break
+			}
+			manifests = append(manifests, string(manifest))
+		}
+		if err == nil && len(keys) > 0 {
+			manifests[0] = fmt.Sprintf("# Replace each %s with the base64 encoded value of the secret\n%s",
+				base64.StdEncoding.EncodeToString([]byte(secretPlaceholder)), manifests[0])
+		}
+		data = []byte(strings.Join(manifests, "---\n"))
+	}
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-yaml")
+	w.(http.ResponseWriter).Write(data)
+}
+
+// Stop the stack, or one of its services, in the background, cancelling a
+// start in progress
+func (s *Server) StopStack(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+	sid := r.PathParam("sid")
+
+	if strings.Contains(sid, "-") {
+		s.stackServiceOperation(w, r, sid, api.OperationStop)
+		return
+	}
+
+	stack, err := s.etcd.GetStack(userId, sid)
+	if stack == nil {
+		rest.NotFound(w, r)
+		return
+	}
+	if err != nil {
 		glog.Error(err)
 		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
+	s.setStopReason(userId, sid, "Stopped by the user")
+
+	operation := s.newOperation(sid, "", api.OperationStop)
+	s.startOperation(userId, operation, func() (*api.Stack, error) {
+		return s.stopStack(userId, sid)
+	})
+	s.writeOperation(w, operation)
 }
 
+// Stop the stack's services, dependents first. A stack that is starting is
+// stopped by cancelling its start.
 func (s *Server) stopStack(userId string, sid string) (*api.Stack, error) {
 
 	path := "/accounts/" + userId + "/stacks/" + sid
 	glog.V(4).Infof("Stopping stack %s\n", path)
 
 	stack, _ := s.etcd.GetStack(userId, sid)
+	if stack == nil {
+		return nil, nil
+	}
 
 	glog.V(4).Infof("Stack status %s\n", stack.Status)
 	if stack.Status == stackStatus[Stopped] {
@@ -1612,64 +3406,42 @@ func (s *Server) stopStack(userId string, sid string) (*api.Stack, error) {
 		return stack, nil
 	}
 
-	stack.Status = stackStatus[Stopping]
-	s.etcd.PutStack(userId, sid, stack)
-
-	// For each stack service, stop dependent services first.
-	stopped := map[string]int{}
-
-	for len(stopped) < len(stack.Services) {
-		stack, _ = s.getStackWithStatus(userId, sid)
-		for _, stackService := range stack.Services {
-			if stopped[stackService.Service] == 1 {
-				continue
-			}
-
-			glog.V(4).Infof("Stopping stack service %s\n", stackService.Service)
-			numDeps := 0
-			stoppedDeps := 0
-			for _, ss := range stack.Services {
-				svc, _ := s.etcd.GetServiceSpec(userId, ss.Service)
-				for _, dep := range svc.Dependencies {
-					if dep.DependencyKey == stackService.Service {
-						numDeps++
-						if ss.Status == "stopped" || ss.Status == "" {
-							stoppedDeps++
-						}
-					}
-				}
-			}
-			if numDeps == 0 || stoppedDeps == numDeps {
-				stopped[stackService.Service] = 1
-				name := fmt.Sprintf("%s-%s", stack.Id, stackService.Service)
-				glog.V(4).Infof("Stopping service %s\n", name)
-
-				spec, _ := s.etcd.GetServiceSpec(userId, stackService.Service)
-				if len(spec.Ports) > 0 {
-					err := s.kube.StopService(userId, name)
-					// Log and continue
-					if err != nil {
-						glog.Error(err)
-					}
-				}
-				if s.ingress == IngressTypeLoadBalancer {
-
-					s.kube.DeleteIngress(userId, stackService.Id)
-					glog.V(4).Infof("Deleted ingress for service %s\n", stackService.Id)
-				}
+	keys := []string{}
+	for _, stackService := range stack.Services {
+		keys = append(keys, stackService.Service)
+	}
+	deps, err := s.stopGraph(userId, keys)
+	if err != nil {
+		return nil, err
+	}
 
-				glog.V(4).Infof("Stopping controller %s\n", name)
-				err := s.kube.StopController(userId, name)
-				if err != nil {
-					glog.Error(err)
-				}
-			}
+	m := fsm.New(deps, &stackActions{server: s, userId: userId, stack: stack}, s.pool, s.timeouts)
+	for {
+		existing := s.addMachine(userId, sid, m)
+		if existing == nil {
+			break
 		}
-		time.Sleep(time.Second * 3)
+		glog.V(4).Infof("Cancelling start of stack %s\n", sid)
+		existing.Cancel()
+		<-existing.Done()
+		s.removeMachine(userId, sid, existing)
+	}
+	defer s.removeMachine(userId, sid, m)
+
+	// A cancelled start leaves the stack stopped
+	stack, _ = s.etcd.GetStack(userId, sid)
+	if stack == nil {
+		m.Close()
+		return nil, nil
+	}
+	if stack.Status == stackStatus[Stopped] {
+		m.Close()
+	} else {
+		m.Stop()
 	}
 
 	podStatus := make(map[string]string)
-	pods, _ := s.kube.GetPods(userId, "stack", stack.Id)
+	pods, _ := s.kube.GetPods(userId, "stack", sid)
 	for _, pod := range pods {
 		label := pod.Labels["service"]
 		glog.V(4).Infof("Pod %s %d\n", label, len(pod.Status.Conditions))
@@ -1677,15 +3449,15 @@ func (s *Server) stopStack(userId string, sid string) (*api.Stack, error) {
 			podStatus[label] = string(pod.Status.Phase)
 		}
 	}
-	for i := range stack.Services {
-		stackService := &stack.Services[i]
-		stackService.Status = podStatus[stackService.Service]
-		stackService.StatusMessages = []string{}
-		stackService.Endpoints = nil
-	}
-
-	stack.Status = stackStatus[Stopped]
-	s.etcd.PutStack(userId, sid, stack)
+	s.updateStack(userId, sid, func(stack *api.Stack) {
+		for i := range stack.Services {
+			stackService := &stack.Services[i]
+			stackService.Status = podStatus[stackService.Service]
+			stackService.StatusMessages = []string{}
+			stackService.Endpoints = nil
+		}
+		stack.Status = stackStatus[Stopped]
+	})
 
 	stack, _ = s.getStackWithStatus(userId, sid)
 	return stack, nil
@@ -1735,7 +3507,7 @@ func (s *Server) GetConfigs(w rest.ResponseWriter, r *rest.Request) {
 			configs[sid] = spec.Config
 		}
 	}
-	w.WriteJson(&configs)
+	writeEntity(w, r, &configs)
 }
 
 func (s *Server) getLogs(userId string, sid string, ssid string, tailLines int) (string, error) {
@@ -1778,49 +3550,12 @@ func (s *Server) getLogs(userId string, sid string, ssid string, tailLines int)
 	return "", nil
 }
 
-func (s *Server) addServiceFile(path string) error {
-	if path[len(path)-4:len(path)] != "json" {
-		return nil
-	}
-	glog.V(4).Infof("Adding %s", path)
-	service := api.ServiceSpec{}
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-	err = json.Unmarshal(data, &service)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-	s.etcd.PutGlobalService(service.Key, &service)
-	return nil
-}
-
-func (s *Server) loadSpecs(path string) error {
-	files, err := ioutil.ReadDir(path)
-	if err != nil {
-		return err
-	}
-
-	for _, file := range files {
-		if file.IsDir() {
-			if file.Name() != "vocab" {
-				s.loadSpecs(fmt.Sprintf("%s/%s", path, file.Name()))
-			}
-		} else {
-			s.addServiceFile(fmt.Sprintf("%s/%s", path, file.Name()))
-		}
-	}
-
-	return nil
-}
-
 func (s *Server) HandlePodEvent(eventType watch.EventType, event *k8api.Event, pod *k8api.Pod) {
 
 	if pod.Namespace != "default" && pod.Namespace != "kube-system" {
 		glog.V(4).Infof("HandlePodEvent %s", eventType)
+		s.stacksMutex.Lock()
+		defer s.stacksMutex.Unlock()
 
 		//name := pod.Name
 		userId := pod.Namespace
@@ -1858,19 +3593,60 @@ func (s *Server) HandlePodEvent(eventType watch.EventType, event *k8api.Event, p
 		} else {
 			// This is a Pod event
 			ready := false
+
+			// Report containers restarted by Kubernetes, for example after
+			// failing liveness probes. Restart counts start over with each pod.
+			if eventType == "ADDED" {
+				stackService.Restarts = 0
+			}
+			restarts := int32(0)
+			for _, status := range pod.Status.ContainerStatuses {
+				restarts += status.RestartCount
+			}
+			if restarts > stackService.Restarts {
+				for _, status := range pod.Status.ContainerStatuses {
+					last := status.LastTerminationState.Terminated
+					if status.RestartCount > 0 && last != nil {
+						stackService.StatusMessages = append(stackService.StatusMessages,
+							fmt.Sprintf("Container=%s, Reason=Restarted, RestartCount=%d, ExitCode=%d, LastReason=%s",
+								status.Name, status.RestartCount, last.ExitCode, last.Reason))
+					}
+				}
+				stackService.Restarts = restarts
+			}
+
+			// Init containers run before the service's containers start
+			for _, status := range kube.InitContainerStatuses(pod) {
+				if status.State.Terminated != nil && status.State.Terminated.ExitCode != 0 {
+					stackService.Status = "error"
+					stackService.StatusMessages = append(stackService.StatusMessages,
+						fmt.Sprintf("Container=%s, Reason=%s, ExitCode=%d, Message=%s", status.Name,
+							status.State.Terminated.Reason, status.State.Terminated.ExitCode, status.State.Terminated.Message))
+				} else if status.State.Running != nil {
+					stackService.StatusMessages = append(stackService.StatusMessages,
+						fmt.Sprintf("Container=%s, Reason=Initializing", status.Name))
+				}
+			}
 			if len(pod.Status.Conditions) > 0 {
 				if pod.Status.Conditions[0].Type == "Ready" {
 					ready = (pod.Status.Conditions[0].Status == "True")
 				}
 
 				if len(pod.Status.ContainerStatuses) > 0 {
-					// The pod was terminated, this is an error
-					if pod.Status.ContainerStatuses[0].State.Terminated != nil {
-						reason := pod.Status.ContainerStatuses[0].State.Terminated.Reason
-						message := pod.Status.ContainerStatuses[0].State.Terminated.Message
-						stackService.Status = "error"
-						stackService.StatusMessages = append(stackService.StatusMessages,
-							fmt.Sprintf("Reason=%s, Message=%s", reason, message))
+					// A container in the pod was terminated, this is an error
+					for _, status := range pod.Status.ContainerStatuses {
+						if status.State.Terminated != nil {
+							reason := status.State.Terminated.Reason
+							message := status.State.Terminated.Message
+							stackService.Status = "error"
+							if status.Name == stackService.Service {
+								stackService.StatusMessages = append(stackService.StatusMessages,
+									fmt.Sprintf("Reason=%s, Message=%s", reason, message))
+							} else {
+								stackService.StatusMessages = append(stackService.StatusMessages,
+									fmt.Sprintf("Container=%s, Reason=%s, Message=%s", status.Name, reason, message))
+							}
+						}
 					}
 				} else {
 					reason := pod.Status.Conditions[0].Reason
@@ -1898,6 +3674,7 @@ func (s *Server) HandlePodEvent(eventType watch.EventType, event *k8api.Event, p
 		glog.V(4).Infof("Namespace: %s, Pod: %s, Status: %s, StatusMessage: %s\n", userId, pod.Name,
 			stackService.Status, message)
 		s.etcd.PutStack(userId, sid, stack)
+		s.serviceEvent(userId, sid, stackService.Service, stackService.Status)
 	}
 }
 
@@ -1906,6 +3683,8 @@ func (s *Server) HandleReplicationControllerEvent(eventType watch.EventType, eve
 
 	if rc.Namespace != "default" && rc.Namespace != "kube-system" {
 		glog.V(4).Infof("HandleReplicationControllerEvent %s", eventType)
+		s.stacksMutex.Lock()
+		defer s.stacksMutex.Unlock()
 
 		userId := rc.Namespace
 		sid := rc.ObjectMeta.Labels["stack"]
@@ -1938,29 +3717,10 @@ func (s *Server) HandleReplicationControllerEvent(eventType watch.EventType, eve
 				stackService.Status, stackService.StatusMessages[len(stackService.StatusMessages)-1])
 		}
 		s.etcd.PutStack(userId, sid, stack)
+		s.serviceEvent(userId, sid, stackService.Service, stackService.Status)
 	}
 }
 
-func (s *Server) addVocabulary(path string) error {
-	if path[len(path)-4:len(path)] != "json" {
-		return nil
-	}
-	glog.V(4).Infof("Adding vocabulary %s", path)
-	vocab := api.Vocabulary{}
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-	err = json.Unmarshal(data, &vocab)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-	s.etcd.PutVocabulary(vocab.Name, &vocab)
-	return nil
-}
-
 func (s *Server) GetVocabulary(w rest.ResponseWriter, r *rest.Request) {
 	name := r.PathParam("name")
 	vocab, err := s.etcd.GetVocabulary(name)
@@ -1968,6 +3728,6 @@ func (s *Server) GetVocabulary(w rest.ResponseWriter, r *rest.Request) {
 		rest.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	} else {
-		w.WriteJson(&vocab)
+		writeEntity(w, r, &vocab)
 	}
 }
@@ -0,0 +1,350 @@
+// Copyright © 2016 National Data Service
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	diff "github.com/ndslabs/apiserver/diff"
+	api "github.com/ndslabs/apiserver/types"
+	validation "github.com/ndslabs/apiserver/validation"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"gopkg.in/fsnotify.v1"
+)
+
+// Initialize the system catalog from the specs directory and keep it in sync.
+// If a specs repository is configured, it is cloned into the specs directory
+// and pulled periodically.
+func (s *Server) initSpecs(cfg Config) {
+	s.specsDir = cfg.Server.SpecsDir
+	s.specsRepo = cfg.Server.SpecsRepo
+	s.specsRef = cfg.Server.SpecsRef
+	if s.specsRef == "" {
+		s.specsRef = "master"
+	}
+
+	if s.specsRepo != "" {
+		glog.Infof("Pulling service specs from %s %s\n", s.specsRepo, s.specsRef)
+		err := s.pullSpecs()
+		if err != nil {
+			glog.Warningf("Error pulling specs: %s\n", err)
+		}
+	}
+
+	glog.Infof("Loading service specs from %s\n", s.specsDir)
+	s.syncSpecs()
+
+	go s.watchSpecs()
+
+	if s.specsRepo != "" {
+		interval := time.Second * 300
+		if cfg.Server.SpecsInterval > 0 {
+			interval = time.Second * time.Duration(cfg.Server.SpecsInterval)
+		}
+		go func() {
+			for {
+				time.Sleep(interval)
+				err := s.pullSpecs()
+				if err != nil {
+					glog.Warningf("Error pulling specs: %s\n", err)
+					continue
+				}
+				s.syncSpecs()
+			}
+		}()
+	}
+}
+
+// Clone the specs repository if needed and check out the configured ref
+func (s *Server) pullSpecs() error {
+	if _, err := os.Stat(s.specsDir + "/.git"); os.IsNotExist(err) {
+		err = git("", "clone", "-q", s.specsRepo, s.specsDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := git(s.specsDir, "fetch", "-q", "origin", s.specsRef)
+	if err != nil {
+		return err
+	}
+	return git(s.specsDir, "reset", "-q", "--hard", "FETCH_HEAD")
+}
+
+func git(dir string, args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %s: %s: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Watch the specs directory and sync after changes settle
+func (s *Server) watchSpecs() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		glog.Errorf("Unable to watch specs: %s\n", err)
+		return
+	}
+	defer watcher.Close()
+
+	s.watchSpecsDir(watcher, s.specsDir)
+
+	var changed <-chan time.Time
+	for {
+		select {
+		case event := <-watcher.Events:
+			if event.Op&fsnotify.Create == fsnotify.Create {
+				info, err := os.Stat(event.Name)
+				if err == nil && info.IsDir() {
+					s.watchSpecsDir(watcher, event.Name)
+				}
+			}
+			changed = time.After(time.Second * 2)
+		case err := <-watcher.Errors:
+			glog.Warningf("Error watching specs: %s\n", err)
+		case <-changed:
+			changed = nil
+			s.syncSpecs()
+		}
+	}
+}
+
+func (s *Server) watchSpecsDir(watcher *fsnotify.Watcher, path string) {
+	err := watcher.Add(path)
+	if err != nil {
+		glog.Warningf("Unable to watch %s: %s\n", path, err)
+		return
+	}
+
+	files, _ := ioutil.ReadDir(path)
+	for _, file := range files {
+		if file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
+			s.watchSpecsDir(watcher, path+"/"+file.Name())
+		}
+	}
+}
+
+// Bring the system catalog in line with the specs directory. Specs are
+// validated against each other first, so dependencies can be loaded in any
+// order. Specs used by running stacks are not updated, and specs used by any
+// stack are not removed, until a later sync.
+func (s *Server) syncSpecs() {
+	s.specsMutex.Lock()
+	defer s.specsMutex.Unlock()
+
+	// Vocabularies come first, since specs are validated against the tags
+	files, _ := ioutil.ReadDir(s.specsDir + "/vocab")
+	for _, file := range files {
+		s.addVocabulary(s.specsDir + "/vocab/" + file.Name())
+	}
+	vocab, _ := s.etcd.GetVocabulary("tags")
+
+	specs := make(map[string]*api.ServiceSpec)
+	err := s.readSpecs(s.specsDir, specs)
+	if err != nil {
+		glog.Warningf("Error loading specs: %s\n", err)
+		return
+	}
+
+	synced, err := s.etcd.GetSyncedSpecs()
+	if err != nil {
+		glog.Warningf("Error loading specs: %s\n", err)
+		return
+	}
+
+	// Dropping an invalid spec can invalidate specs that depend on it, and
+	// specs whose files were removed no longer satisfy dependencies
+	valid := make(map[string]*api.ServiceSpec)
+	for key, spec := range specs {
+		valid[key] = spec
+	}
+	lookup := func(key string) *api.ServiceSpec {
+		if _, ok := specs[key]; ok {
+			return valid[key]
+		}
+		if _, ok := synced[key]; ok {
+			return nil
+		}
+		spec, _ := s.etcd.GetServiceSpec("", key)
+		return spec
+	}
+
+	invalid := true
+	for invalid {
+		invalid = false
+		for key, spec := range valid {
+			errors := validation.ValidateServiceSpec(spec, lookup)
+			errors = append(errors, validation.ValidateTags(spec, vocab)...)
+			if len(errors) > 0 {
+				for _, e := range errors {
+					glog.Warningf("Skipping invalid spec %s: %s: %s\n", key, e.Field, e.Message)
+				}
+				delete(valid, key)
+				invalid = true
+			}
+		}
+	}
+
+	inUse := s.servicesInUse()
+	for key, spec := range valid {
+		data, _ := json.Marshal(spec)
+		checksum := fmt.Sprintf("%x", sha1.Sum(data))
+		if synced[key] == checksum {
+			continue
+		}
+		stored, _ := s.getSystemSpec(key)
+		if _, ok := synced[key]; ok && inUse[key] && !statusChangeOnly(stored, spec) {
+			glog.Warningf("Not updating spec %s, in use by a running stack\n", key)
+			continue
+		}
+
+		glog.V(4).Infof("Adding %s", key)
+		err = s.etcd.PutGlobalService(key, spec)
+		if err != nil {
+			glog.Warningf("Error adding spec %s: %s\n", key, err)
+			continue
+		}
+		synced[key] = checksum
+
+		if spec.Status == api.SpecRetired && (stored == nil || stored.Status != api.SpecRetired) {
+			s.noticeRetired("", spec)
+		}
+	}
+
+	// Invalid specs keep the last valid version rather than being removed
+	for key := range synced {
+		if _, ok := specs[key]; ok {
+			continue
+		}
+		if _, ok := inUse[key]; ok {
+			glog.Warningf("Not removing spec %s, in use by a stack\n", key)
+			continue
+		}
+
+		glog.V(4).Infof("Removing %s", key)
+		err = s.etcd.DeleteGlobalService(key)
+		if err != nil {
+			glog.Warningf("Error removing spec %s: %s\n", key, err)
+			continue
+		}
+		delete(synced, key)
+	}
+
+	s.etcd.PutSyncedSpecs(synced)
+}
+
+// Lifecycle changes are applied to specs in use
+func statusChangeOnly(old *api.ServiceSpec, new *api.ServiceSpec) bool {
+	if old == nil {
+		return false
+	}
+	for _, change := range diff.Specs(old, new) {
+		if change.Field != "status" && change.Field != "replacedBy" {
+			return false
+		}
+	}
+	return true
+}
+
+// Services used by stacks in any account, mapped to whether any of the stacks
+// using them is running
+func (s *Server) servicesInUse() map[string]bool {
+	inUse := map[string]bool{}
+	accounts, err := s.etcd.GetAccounts()
+	if err != nil {
+		return inUse
+	}
+
+	for _, account := range *accounts {
+		stacks, err := s.etcd.GetStacks(account.Namespace)
+		if err != nil {
+			continue
+		}
+		for _, stack := range *stacks {
+			running := stack.Status != "" && stack.Status != stackStatus[Stopped]
+			for _, stackService := range stack.Services {
+				inUse[stackService.Service] = inUse[stackService.Service] || running
+			}
+		}
+	}
+	return inUse
+}
+
+// Spec and vocabulary files may be JSON or YAML
+func isSpecFile(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".json" || ext == ".yaml" || ext == ".yml"
+}
+
+func (s *Server) readServiceFile(path string) (*api.ServiceSpec, error) {
+	if !isSpecFile(path) {
+		return nil, nil
+	}
+	glog.V(4).Infof("Reading %s", path)
+	service := api.ServiceSpec{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(data, &service)
+	if err != nil {
+		return nil, err
+	}
+	return &service, nil
+}
+
+func (s *Server) readSpecs(path string, specs map[string]*api.ServiceSpec) error {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			if file.Name() != "vocab" && !strings.HasPrefix(file.Name(), ".") {
+				s.readSpecs(fmt.Sprintf("%s/%s", path, file.Name()), specs)
+			}
+		} else {
+			filePath := fmt.Sprintf("%s/%s", path, file.Name())
+			spec, err := s.readServiceFile(filePath)
+			if err != nil {
+				glog.Warningf("Error reading spec %s: %s\n", filePath, err)
+			} else if spec != nil {
+				specs[spec.Key] = spec
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) addVocabulary(path string) error {
+	if !isSpecFile(path) {
+		return nil
+	}
+	glog.V(4).Infof("Adding vocabulary %s", path)
+	vocab := api.Vocabulary{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	err = yaml.Unmarshal(data, &vocab)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	s.etcd.PutVocabulary(vocab.Name, &vocab)
+	return nil
+}
@@ -0,0 +1,656 @@
+// Copyright © 2016 National Data Service
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	diff "github.com/ndslabs/apiserver/diff"
+	fsm "github.com/ndslabs/apiserver/fsm"
+	graph "github.com/ndslabs/apiserver/graph"
+	kube "github.com/ndslabs/apiserver/kube"
+	api "github.com/ndslabs/apiserver/types"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/golang/glog"
+)
+
+// stackActions carries out the decisions of a stack's machine. The address
+// map and configs are set once the stack's Kubernetes services exist.
+type stackActions struct {
+	server      *Server
+	userId      string
+	stack       *api.Stack
+	addrPortMap *map[string]kube.ServiceAddrPort
+	configs     *stackConfig
+}
+
+func (a *stackActions) StartService(key string) (bool, error) {
+	return a.server.startController(a.userId, key, a.stack, a.addrPortMap, a.configs)
+}
+
+func (a *stackActions) StopService(key string) (bool, error) {
+	return a.server.stopController(a.userId, a.stack, key)
+}
+
+func (a *stackActions) UpdateStack(state fsm.StackState) {
+	a.server.updateStack(a.userId, a.stack.Id, func(stack *api.Stack) {
+		stack.Status = string(state)
+	})
+}
+
+func (a *stackActions) UpdateService(key string, state fsm.ServiceState, message string) {
+	a.server.updateStack(a.userId, a.stack.Id, func(stack *api.Stack) {
+		for i := range stack.Services {
+			stackService := &stack.Services[i]
+			if stackService.Service == key {
+				stackService.Status = string(state)
+				if message != "" {
+					stackService.StatusMessages = append(stackService.StatusMessages, message)
+				}
+			}
+		}
+	})
+}
+
+// serviceActions carries out the decisions of a machine for some of a
+// stack's services. The stack's status is left to the operation.
+type serviceActions struct {
+	*stackActions
+}
+
+func (a *serviceActions) UpdateStack(state fsm.StackState) {}
+
+func machineKey(userId string, sid string) string {
+	return userId + "/" + sid
+}
+
+// Register the machine starting or stopping the stack. If the stack already
+// has one, it is returned instead.
+func (s *Server) addMachine(userId string, sid string, m *fsm.Machine) *fsm.Machine {
+	s.machinesMutex.Lock()
+	defer s.machinesMutex.Unlock()
+	if existing, ok := s.machines[machineKey(userId, sid)]; ok {
+		return existing
+	}
+	s.machines[machineKey(userId, sid)] = m
+	return nil
+}
+
+func (s *Server) removeMachine(userId string, sid string, m *fsm.Machine) {
+	s.machinesMutex.Lock()
+	defer s.machinesMutex.Unlock()
+	if s.machines[machineKey(userId, sid)] == m {
+		delete(s.machines, machineKey(userId, sid))
+	}
+}
+
+// Pass the status of a stack service from the watches to the stack's
+// machine, if it has one. Status messages are already recorded.
+func (s *Server) serviceEvent(userId string, sid string, key string, status string) {
+	state := fsm.ServiceState(status)
+	if state != fsm.ServiceReady && state != fsm.ServiceError && state != fsm.ServiceStopped {
+		return
+	}
+
+	s.machinesMutex.Lock()
+	m := s.machines[machineKey(userId, sid)]
+	s.machinesMutex.Unlock()
+	if m != nil {
+		m.ServiceEvent(key, state, "")
+	}
+}
+
+// Apply a change to the stored stack. Changes from the machines and the
+// watches are serialized so they do not overwrite each other.
+func (s *Server) updateStack(userId string, sid string, update func(stack *api.Stack)) error {
+	s.stacksMutex.Lock()
+	defer s.stacksMutex.Unlock()
+
+	stack, err := s.etcd.GetStack(userId, sid)
+	if err != nil || stack == nil {
+		glog.Warningf("Cannot update stack %s: %s\n", sid, err)
+		return fmt.Errorf("Cannot update stack %s", sid)
+	}
+	update(stack)
+	return s.etcd.PutStack(userId, sid, stack)
+}
+
+// Stop the stack service's controller, Kubernetes service and ingress.
+// Returns true if no pods were running, in which case no pod events follow.
+func (s *Server) stopController(userId string, stack *api.Stack, key string) (bool, error) {
+	name := fmt.Sprintf("%s-%s", stack.Id, key)
+	pods, _ := s.kube.GetPods(userId, "name", name)
+
+	spec, _ := s.etcd.GetServiceSpec(userId, key)
+	// Without its spec the service may have ports, so try to stop it
+	if spec == nil || len(spec.Ports) > 0 {
+		err := s.kube.StopService(userId, name)
+		// Log and continue
+		if err != nil {
+			glog.Error(err)
+		}
+	}
+	if s.ingress == IngressTypeLoadBalancer {
+		s.kube.DeleteIngress(userId, name)
+		glog.V(4).Infof("Deleted ingress for service %s\n", name)
+	}
+
+	glog.V(4).Infof("Stopping controller %s\n", name)
+	err := s.kube.StopController(userId, name)
+	if err != nil {
+		glog.Error(err)
+		return true, nil
+	}
+	return len(pods) == 0, nil
+}
+
+// Change the stack's status if it is still from, so that concurrent requests
+// cannot both start or stop it
+func (s *Server) transitionStack(userId string, sid string, from string, to string) bool {
+	ok := false
+	s.updateStack(userId, sid, func(stack *api.Stack) {
+		if stack.Status == from {
+			stack.Status = to
+			if to == stackStatus[Starting] {
+				// The runtime is counted from the latest start
+				stack.StartedTime = int(time.Now().Unix())
+				stack.StopReason = ""
+			}
+			ok = true
+		}
+	})
+	return ok
+}
+
+// Record why a stack that is not yet stopped is being stopped
+func (s *Server) setStopReason(userId string, sid string, reason string) {
+	s.updateStack(userId, sid, func(stack *api.Stack) {
+		if stack.Status != stackStatus[Stopped] {
+			stack.StopReason = reason
+		}
+	})
+}
+
+// Completed operations are kept for a day
+const operationTTL = 24 * time.Hour
+
+// Operations can be waited on for at most a minute per request
+const maxOperationWait = 60
+
+// A new operation on the stack, or on one of its services if ssid is set
+func (s *Server) newOperation(sid string, ssid string, operationType api.OperationType) *api.Operation {
+	return &api.Operation{
+		Id:           s.kube.RandomString(10),
+		Type:         operationType,
+		Stack:        sid,
+		StackService: ssid,
+		Phase:        api.OperationRunning,
+		Services:     []api.OperationService{},
+		StartedTime:  int(time.Now().Unix()),
+	}
+}
+
+// Run the operation in the background. The operation completes when run
+// returns the stack or an error.
+func (s *Server) startOperation(userId string, operation *api.Operation, run func() (*api.Stack, error)) {
+	sid := operation.Stack
+	s.etcd.PutOperation(userId, operation, 0)
+
+	done := make(chan struct{})
+	s.operationsMutex.Lock()
+	s.operations[operation.Id] = done
+	s.operationsMutex.Unlock()
+
+	go func() {
+		stack, err := func() (stack *api.Stack, err error) {
+			// A panic fails the operation rather than the apiserver
+			defer func() {
+				if r := recover(); r != nil {
+					glog.Errorf("Operation %s of stack %s panicked: %v\n", operation.Id, sid, r)
+					stack, err = nil, fmt.Errorf("Internal error: %v", r)
+				}
+			}()
+			return run()
+		}()
+
+		completed := *operation
+		completeOperation(&completed, stack, err)
+		glog.V(1).Infof("Operation %s %s of stack %s %s\n", completed.Id, completed.Type, sid, completed.Phase)
+		s.etcd.PutOperation(userId, &completed, operationTTL)
+
+		s.operationsMutex.Lock()
+		delete(s.operations, operation.Id)
+		s.operationsMutex.Unlock()
+		close(done)
+	}()
+}
+
+// Operations left running by a previous apiserver, started before this one,
+// never complete. Their stacks are started or stopped again by
+// initExistingAccounts.
+func (s *Server) failInterruptedOperations(userId string) {
+	operations, err := s.etcd.GetOperations(userId)
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	for _, operation := range *operations {
+		if operation.Phase != api.OperationRunning || operation.StartedTime >= s.startedTime {
+			continue
+		}
+
+		operation.Phase = api.OperationFailed
+		operation.Error = "Interrupted by an apiserver restart"
+		operation.CompletedTime = int(time.Now().Unix())
+		s.etcd.PutOperation(userId, &operation, operationTTL)
+	}
+}
+
+// A stack operation succeeds if the stack ends up started, or stopped for a
+// stop
+func completeOperation(operation *api.Operation, stack *api.Stack, err error) {
+	operation.CompletedTime = int(time.Now().Unix())
+	operation.Phase = api.OperationFailed
+	if err != nil {
+		operation.Error = err.Error()
+		return
+	}
+	if stack == nil {
+		operation.Error = "Stack was deleted"
+		return
+	}
+
+	operation.Services = operationServices(stack)
+	if operation.StackService != "" {
+		// Service operations report their own failures
+		operation.Phase = api.OperationSucceeded
+		return
+	}
+
+	expected := stackStatus[Started]
+	if operation.Type == api.OperationStop {
+		expected = stackStatus[Stopped]
+	}
+	if stack.Status == expected {
+		operation.Phase = api.OperationSucceeded
+	} else if stack.Status == stackStatus[Stopped] {
+		operation.Error = "Cancelled by a stop"
+	} else {
+		operation.Error = fmt.Sprintf("Stack is %s", stack.Status)
+	}
+}
+
+// The status and latest message of each stack service
+func operationServices(stack *api.Stack) []api.OperationService {
+	services := []api.OperationService{}
+	for _, stackService := range stack.Services {
+		service := api.OperationService{Service: stackService.Service, Status: stackService.Status}
+		if len(stackService.StatusMessages) > 0 {
+			service.Message = stackService.StatusMessages[len(stackService.StatusMessages)-1]
+		}
+		services = append(services, service)
+	}
+	return services
+}
+
+// Operations are accepted, with their location, before they run
+func (s *Server) writeOperation(w rest.ResponseWriter, operation *api.Operation) {
+	w.Header().Set("Location", s.prefix+"operations/"+operation.Id)
+	w.WriteHeader(http.StatusAccepted)
+	w.WriteJson(operation)
+}
+
+// List the user's operations, optionally for one stack
+func (s *Server) GetOperations(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+	sid := r.Request.FormValue("stack")
+
+	operations, err := s.etcd.GetOperations(userId)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filtered := []api.Operation{}
+	for _, operation := range *operations {
+		if sid == "" || operation.Stack == sid {
+			filtered = append(filtered, operation)
+		}
+	}
+	writeEntity(w, r, &filtered)
+}
+
+// Get an operation, with the current progress of its stack services while
+// it runs. With ?wait=<seconds>, a running operation is returned when it
+// completes or the time is up, whichever is first.
+func (s *Server) GetOperation(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+	id := r.PathParam("id")
+
+	wait := 0
+	if param := r.Request.FormValue("wait"); param != "" {
+		var err error
+		wait, err = strconv.Atoi(param)
+		if err != nil || wait < 0 {
+			rest.Error(w, "Invalid wait", http.StatusBadRequest)
+			return
+		}
+		if wait > maxOperationWait {
+			wait = maxOperationWait
+		}
+	}
+
+	s.operationsMutex.Lock()
+	done := s.operations[id]
+	s.operationsMutex.Unlock()
+	if done != nil && wait > 0 {
+		select {
+		case <-done:
+		case <-time.After(time.Second * time.Duration(wait)):
+		}
+	}
+
+	operation, err := s.etcd.GetOperation(userId, id)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if operation == nil {
+		rest.NotFound(w, r)
+		return
+	}
+
+	if operation.Phase == api.OperationRunning {
+		stack, _ := s.etcd.GetStack(userId, operation.Stack)
+		if stack != nil {
+			operation.Services = operationServices(stack)
+		}
+	}
+	writeEntity(w, r, operation)
+}
+
+// Start, stop or restart one service of a started stack. Stopping or
+// restarting a service that running services depend on is refused unless
+// ?cascade=true, which includes them. Starting with ?cascade=true also starts
+// the stopped services that depend on it.
+func (s *Server) stackServiceOperation(w rest.ResponseWriter, r *rest.Request, ssid string, operationType api.OperationType) {
+	userId := s.getUser(r)
+	cascade := r.Request.FormValue("cascade") == "true"
+
+	stackService := s.getStackService(userId, ssid)
+	if stackService == nil {
+		rest.NotFound(w, r)
+		return
+	}
+	sid := ssid[0:strings.LastIndex(ssid, "-")]
+	key := stackService.Service
+
+	stack, err := s.etcd.GetStack(userId, sid)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if stack.Status != stackStatus[Started] && stack.Status != string(fsm.StackError) {
+		rest.Error(w, fmt.Sprintf("Stack %s is %s", sid, stack.Status), http.StatusConflict)
+		return
+	}
+
+	var deps *graph.Graph
+	if operationType == api.OperationStop {
+		keys := []string{}
+		for _, stackService := range stack.Services {
+			keys = append(keys, stackService.Service)
+		}
+		deps, err = s.stopGraph(userId, keys)
+	} else {
+		deps, err = s.stackGraph(userId, stack)
+	}
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	keys := []string{key}
+	dependents := stackDependents(deps, stack, key, operationType == api.OperationStart)
+	if cascade {
+		keys = append(keys, dependents...)
+	} else if len(dependents) > 0 && operationType != api.OperationStart {
+		rest.Error(w, fmt.Sprintf("Services %s depend on %s, use ?cascade=true to include them",
+			strings.Join(dependents, ", "), key), http.StatusConflict)
+		return
+	}
+
+	if operationType != api.OperationStop {
+		for _, dep := range deps.Dependencies(key) {
+			if serviceStatus(stack, dep) != string(fsm.ServiceReady) {
+				rest.Error(w, fmt.Sprintf("Service %s depends on %s, which is not ready", key, dep), http.StatusConflict)
+				return
+			}
+		}
+		if !s.checkStartable(w, userId, stack) {
+			return
+		}
+	}
+
+	operation := s.newOperation(sid, ssid, operationType)
+	s.startOperation(userId, operation, func() (*api.Stack, error) {
+		return s.runStackServices(userId, sid, keys, operationType)
+	})
+	s.writeOperation(w, operation)
+}
+
+// The services of the stack that depend on key, directly or not, and are
+// stopped or not
+func stackDependents(deps *graph.Graph, stack *api.Stack, key string, stopped bool) []string {
+	dependents := []string{}
+	seen := map[string]bool{key: true}
+	queue := []string{key}
+	for len(queue) > 0 {
+		for _, dependent := range deps.Dependents(queue[0]) {
+			if seen[dependent] {
+				continue
+			}
+			seen[dependent] = true
+			queue = append(queue, dependent)
+
+			status := serviceStatus(stack, dependent)
+			if (status == "" || status == string(fsm.ServiceStopped)) == stopped {
+				dependents = append(dependents, dependent)
+			}
+		}
+		queue = queue[1:]
+	}
+	return dependents
+}
+
+func serviceStatus(stack *api.Stack, key string) string {
+	for _, stackService := range stack.Services {
+		if stackService.Service == key {
+			return stackService.Status
+		}
+	}
+	return ""
+}
+
+// Stop and/or start the services of the stack, then mark the stack started
+// if all of its services are ready or in error if any failed
+func (s *Server) runStackServices(userId string, sid string, keys []string, operationType api.OperationType) (*api.Stack, error) {
+	if stack, _ := s.etcd.GetStack(userId, sid); stack == nil {
+		return nil, nil
+	}
+
+	var err error
+	if operationType != api.OperationStart {
+		err = s.runServiceMachine(userId, sid, keys, false)
+	}
+	if err == nil && operationType != api.OperationStop {
+		err = s.runServiceMachine(userId, sid, keys, true)
+	}
+
+	s.updateStack(userId, sid, func(stack *api.Stack) {
+		if stack.Status != stackStatus[Started] && stack.Status != string(fsm.StackError) {
+			return
+		}
+		status := stackStatus[Started]
+		for _, stackService := range stack.Services {
+			if stackService.Status == string(fsm.ServiceError) {
+				status = string(fsm.StackError)
+			}
+		}
+		stack.Status = status
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.getStackWithStatus(userId, sid)
+}
+
+// Run a machine that starts or stops the services of the stack. Services
+// they depend on are already running.
+func (s *Server) runServiceMachine(userId string, sid string, keys []string, start bool) error {
+	var deps *graph.Graph
+	var err error
+	if start {
+		deps, err = graph.New(keys, s.specLookup(userId))
+	} else {
+		deps, err = s.stopGraph(userId, keys)
+	}
+	if err != nil {
+		return err
+	}
+	stack, err := s.etcd.GetStack(userId, sid)
+	if err != nil {
+		return err
+	}
+
+	actions := &stackActions{server: s, userId: userId, stack: stack}
+	m := fsm.New(deps, &serviceActions{actions}, s.pool, s.timeouts)
+	if existing := s.addMachine(userId, sid, m); existing != nil {
+		return fmt.Errorf("Stack %s is already starting or stopping", sid)
+	}
+	defer s.removeMachine(userId, sid, m)
+
+	// The stack may have been stopped before the machine was registered
+	current, err := s.etcd.GetStack(userId, sid)
+	if err != nil || (current.Status != stackStatus[Started] && current.Status != string(fsm.StackError)) {
+		m.Close()
+		return fmt.Errorf("Stack %s changed during the operation", sid)
+	}
+
+	if !start {
+		if state := m.Stop(); state != fsm.StackStopped {
+			return fmt.Errorf("Services %s did not stop", strings.Join(keys, ", "))
+		}
+		return nil
+	}
+
+	all, err := s.stackGraph(userId, stack)
+	if err == nil {
+		err = s.prepareStack(userId, stack, all, actions)
+	}
+	if err != nil {
+		m.Close()
+		return err
+	}
+
+	switch m.Start() {
+	case fsm.StackStarted:
+		return nil
+	case fsm.StackStopped:
+		return fmt.Errorf("Cancelled by a stop")
+	default:
+		return fmt.Errorf("Services %s did not start", strings.Join(keys, ", "))
+	}
+}
+
+// A running stack can be updated as long as its services stay the same
+func sameServices(existing *api.Stack, stack *api.Stack) bool {
+	if len(existing.Services) != len(stack.Services) {
+		return false
+	}
+	for _, stackService := range stack.Services {
+		if serviceIndex(existing, stackService.Service) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func serviceIndex(stack *api.Stack, key string) int {
+	for i := range stack.Services {
+		if stack.Services[i].Service == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// Passwords are kept out of the stored config, so changes to them are found
+// by comparing with the stack's secret before it is updated
+func (s *Server) passwordChanges(userId string, stack *api.Stack) map[string][]api.SpecChange {
+	changes := map[string][]api.SpecChange{}
+	secret, _ := s.kube.GetSecret(userId, kube.ConfigSecretName(stack.Id))
+	if secret == nil {
+		return changes
+	}
+
+	for _, stackService := range stack.Services {
+		spec, _ := s.etcd.GetServiceSpec(userId, stackService.Service)
+		if spec == nil {
+			continue
+		}
+		for _, config := range spec.Config {
+			value := stackService.Config[config.Name]
+			if !config.IsPassword || !config.CanOverride || value == "" || value == api.PasswordMask {
+				continue
+			}
+			if value != string(secret.Data[kube.ConfigSecretKey(spec.Key, config.Name)]) {
+				changes[stackService.Id] = append(changes[stackService.Id],
+					api.SpecChange{Field: "config." + config.Name, Old: api.PasswordMask, New: api.PasswordMask})
+			}
+		}
+	}
+	return changes
+}
+
+// Keep the status of the running stack's services in the update and add
+// the changes to each service's settings. Returns the services whose
+// controllers must be replaced.
+func (s *Server) mergeRunningStack(userId string, existing *api.Stack, stack *api.Stack, changes map[string][]api.SpecChange) []string {
+	keys := []string{}
+	for i := range stack.Services {
+		stackService := &stack.Services[i]
+		current := existing.Services[serviceIndex(existing, stackService.Service)]
+
+		serviceChanges := diff.StackServices(&current, stackService)
+		changes[stackService.Id] = append(serviceChanges, changes[stackService.Id]...)
+
+		stackService.Status = current.Status
+		stackService.StatusMessages = current.StatusMessages
+		stackService.Endpoints = current.Endpoints
+		stackService.Restarts = current.Restarts
+		stackService.InternalIP = current.InternalIP
+		stackService.CreatedTime = current.CreatedTime
+		stackService.ImageDigest = current.ImageDigest
+		if stackService.ImageTag != current.ImageTag {
+			stackService.ImageDigest = ""
+			if s.pinDigests {
+				s.pinImageDigest(userId, stackService)
+			}
+		}
+
+		if len(changes[stackService.Id]) == 0 {
+			delete(changes, stackService.Id)
+		} else {
+			keys = append(keys, stackService.Service)
+		}
+	}
+	return keys
+}
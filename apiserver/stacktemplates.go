@@ -0,0 +1,458 @@
+// Copyright © 2016 National Data Service
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	api "github.com/ndslabs/apiserver/types"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/golang/glog"
+)
+
+// List the user's templates and those published in the catalog
+func (s *Server) GetTemplates(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+	published := r.Request.FormValue("published") == "true"
+
+	templates, err := s.etcd.GetTemplates()
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	visible := []api.StackTemplate{}
+	for _, template := range *templates {
+		if published && !template.Published {
+			continue
+		}
+		if !template.Published && template.Owner != userId && !s.IsAdmin(r) {
+			continue
+		}
+		if template.Owner != userId {
+			template.Token = ""
+		}
+		visible = append(visible, template)
+	}
+	writeEntity(w, r, &visible)
+}
+
+// Get a template the user owns, that is published or, with ?token=, that is
+// shared by link
+func (s *Server) GetTemplate(w rest.ResponseWriter, r *rest.Request) {
+	template := s.getTemplate(w, r, r.Request.FormValue("token"))
+	if template != nil {
+		writeEntity(w, r, template)
+	}
+}
+
+func (s *Server) getTemplate(w rest.ResponseWriter, r *rest.Request, token string) *api.StackTemplate {
+	userId := s.getUser(r)
+	id := r.PathParam("id")
+
+	template, err := s.etcd.GetTemplate(id)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if template == nil || !(template.Owner == userId || s.IsAdmin(r) || template.Published ||
+		(template.Token != "" && token == template.Token)) {
+		rest.NotFound(w, r)
+		return nil
+	}
+	if template.Owner != userId {
+		template.Token = ""
+	}
+	return template
+}
+
+// Templates can only be changed by their owner
+func (s *Server) getOwnTemplate(w rest.ResponseWriter, r *rest.Request) *api.StackTemplate {
+	userId := s.getUser(r)
+	id := r.PathParam("id")
+
+	template, err := s.etcd.GetTemplate(id)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if template == nil || template.Owner != userId {
+		rest.NotFound(w, r)
+		return nil
+	}
+	return template
+}
+
+// Author a template directly
+func (s *Server) PostTemplate(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+
+	template := api.StackTemplate{}
+	err := decodePayload(r, &template)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	template.Id = s.kube.GenerateName(5)
+	template.Owner = userId
+	template.Token = ""
+	template.Published = false
+	template.CreatedTime = int(time.Now().Unix())
+	s.saveTemplate(w, r, &template)
+}
+
+// Save a template from the services of one of the user's stacks. The
+// template's name defaults to the stack's.
+func (s *Server) PostStackTemplate(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+	sid := r.PathParam("sid")
+
+	stack, _ := s.etcd.GetStack(userId, sid)
+	if stack == nil {
+		rest.NotFound(w, r)
+		return
+	}
+
+	template := api.StackTemplate{}
+	err := decodePayload(r, &template)
+	if err != nil && err != rest.ErrJsonPayloadEmpty {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if template.Name == "" {
+		template.Name = stack.Name
+	}
+	template.Id = s.kube.GenerateName(5)
+	template.Key = stack.Key
+	template.Owner = userId
+	template.Token = ""
+	template.Published = false
+	template.CreatedTime = int(time.Now().Unix())
+	template.Services = []api.TemplateService{}
+	for _, stackService := range stack.Services {
+		template.Services = append(template.Services, templateService(&stackService))
+	}
+	s.saveTemplate(w, r, &template)
+}
+
+// The settings of the stack service, without passwords, which are not
+// stored with the stack, or AppData folders, which belong to the stack
+func templateService(stackService *api.StackService) api.TemplateService {
+	service := api.TemplateService{
+		Service:        stackService.Service,
+		ImageTag:       stackService.ImageTag,
+		Config:         map[string]string{},
+		VolumeMounts:   map[string]string{},
+		RepositoryRefs: stackService.RepositoryRefs,
+		Command:        stackService.Command,
+		Args:           stackService.Args,
+	}
+	for name, value := range stackService.Config {
+		service.Config[name] = value
+	}
+	for fromPath, toPath := range stackService.VolumeMounts {
+		if !strings.HasPrefix(fromPath, "AppData/") {
+			service.VolumeMounts[fromPath] = toPath
+		}
+	}
+	return service
+}
+
+// Update one of the user's templates. Templates are published by curators,
+// so an update by anyone else withdraws the template from the catalog.
+func (s *Server) PutTemplate(w rest.ResponseWriter, r *rest.Request) {
+	existing := s.getOwnTemplate(w, r)
+	if existing == nil {
+		return
+	}
+
+	template := api.StackTemplate{}
+	err := decodePayload(r, &template)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	template.Id = existing.Id
+	template.Owner = existing.Owner
+	template.Token = existing.Token
+	// Changes to a published template are only published by curators
+	template.Published = existing.Published && s.IsCurator(r)
+	template.CreatedTime = existing.CreatedTime
+	s.saveTemplate(w, r, &template)
+}
+
+// Validate and store the template. Values of its parameters are left out.
+func (s *Server) saveTemplate(w rest.ResponseWriter, r *rest.Request, template *api.StackTemplate) {
+	if errors := s.validateTemplate(template); len(errors) > 0 {
+		glog.V(1).Infof("Template %s failed validation\n", template.Name)
+		w.WriteHeader(http.StatusBadRequest)
+		w.WriteJson(&api.ValidationResult{Valid: false, Errors: errors})
+		return
+	}
+
+	for _, parameter := range template.Parameters {
+		for i := range template.Services {
+			if template.Services[i].Service == parameter.Service {
+				delete(template.Services[i].Config, parameter.Name)
+			}
+		}
+	}
+
+	template.UpdatedTime = int(time.Now().Unix())
+	err := s.etcd.PutTemplate(template.Id, template)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	glog.V(1).Infof("User %s saved template %s\n", template.Owner, template.Id)
+	writeEntity(w, r, template)
+}
+
+// The template's services must be in its owner's catalogs and its parameters
+// must be config of its services
+func (s *Server) validateTemplate(template *api.StackTemplate) []api.ValidationError {
+	errors := []api.ValidationError{}
+	if template.Name == "" {
+		errors = append(errors, api.ValidationError{Field: "name", Message: "Name is required"})
+	}
+
+	specs := map[string]*api.ServiceSpec{}
+	for i, service := range template.Services {
+		spec, _ := s.etcd.GetServiceSpec(template.Owner, service.Service)
+		if spec == nil {
+			errors = append(errors, api.ValidationError{
+				Field:   fmt.Sprintf("services[%d].service", i),
+				Message: fmt.Sprintf("No such service %s", service.Service),
+			})
+			continue
+		}
+		specs[service.Service] = spec
+	}
+	if len(template.Services) == 0 {
+		errors = append(errors, api.ValidationError{Field: "services", Message: "At least one service is required"})
+	} else if _, ok := specs[template.Key]; !ok {
+		errors = append(errors, api.ValidationError{Field: "key", Message: "Key must be one of the template's services"})
+	}
+
+	for i, parameter := range template.Parameters {
+		spec := specs[parameter.Service]
+		found := false
+		if spec != nil {
+			for _, config := range spec.Config {
+				if config.Name == parameter.Name && config.CanOverride {
+					found = true
+				}
+			}
+		}
+		if !found {
+			errors = append(errors, api.ValidationError{
+				Field:   fmt.Sprintf("parameters[%d]", i),
+				Message: fmt.Sprintf("Service %s has no config %s that can be set", parameter.Service, parameter.Name),
+			})
+		}
+	}
+	return errors
+}
+
+// Delete one of the user's templates. Curators can also remove templates
+// from the catalog.
+func (s *Server) DeleteTemplate(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+	id := r.PathParam("id")
+
+	template, err := s.etcd.GetTemplate(id)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if template == nil || (template.Owner != userId && !s.IsAdmin(r) && !(template.Published && s.IsCurator(r))) {
+		rest.NotFound(w, r)
+		return
+	}
+
+	err = s.etcd.DeleteTemplate(id)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Share the template by link, replacing any earlier link, or with
+// ?revoke=true stop sharing it
+func (s *Server) ShareTemplate(w rest.ResponseWriter, r *rest.Request) {
+	template := s.getOwnTemplate(w, r)
+	if template == nil {
+		return
+	}
+
+	template.Token = ""
+	if r.Request.FormValue("revoke") != "true" {
+		token, err := templateToken()
+		if err != nil {
+			glog.Error(err)
+			rest.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		template.Token = token
+	}
+	err := s.etcd.PutTemplate(template.Id, template)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeEntity(w, r, template)
+}
+
+// Share links must not be guessable
+func templateToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// Add the template to the catalog, or with ?revoke=true remove it. Only
+// curators publish templates.
+func (s *Server) PublishTemplate(w rest.ResponseWriter, r *rest.Request) {
+	if !s.IsCurator(r) {
+		rest.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+
+	template, err := s.etcd.GetTemplate(r.PathParam("id"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if template == nil {
+		rest.NotFound(w, r)
+		return
+	}
+
+	template.Published = r.Request.FormValue("revoke") != "true"
+	err = s.etcd.PutTemplate(template.Id, template)
+	if err != nil {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	glog.V(1).Infof("Template %s published %t\n", template.Id, template.Published)
+	if template.Owner != s.getUser(r) {
+		template.Token = ""
+	}
+	writeEntity(w, r, template)
+}
+
+// Create a stack in the user's account from the template, with the values
+// given for its parameters
+func (s *Server) InstantiateTemplate(w rest.ResponseWriter, r *rest.Request) {
+	userId := s.getUser(r)
+
+	instance := api.TemplateInstance{}
+	err := decodePayload(r, &instance)
+	if err != nil && err != rest.ErrJsonPayloadEmpty {
+		glog.Error(err)
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	template := s.getTemplate(w, r, instance.Token)
+	if template == nil {
+		return
+	}
+
+	errors := validateInstance(template, &instance)
+	for i, service := range template.Services {
+		// Templates are checked against their owner's catalogs, which may
+		// differ from the user's
+		spec, _ := s.etcd.GetServiceSpec(userId, service.Service)
+		if spec == nil {
+			errors = append(errors, api.ValidationError{
+				Field:   fmt.Sprintf("services[%d].service", i),
+				Message: fmt.Sprintf("Service %s is not in your catalogs", service.Service),
+			})
+		}
+	}
+	if len(errors) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.WriteJson(&api.ValidationResult{Valid: false, Errors: errors})
+		return
+	}
+
+	stack := api.Stack{Key: template.Key, Name: instance.Name, Services: []api.StackService{}}
+	if stack.Name == "" {
+		stack.Name = template.Name
+	}
+	for _, service := range template.Services {
+		stackService := api.StackService{
+			Service:        service.Service,
+			ImageTag:       service.ImageTag,
+			Config:         map[string]string{},
+			VolumeMounts:   map[string]string{},
+			RepositoryRefs: service.RepositoryRefs,
+			Command:        service.Command,
+			Args:           service.Args,
+		}
+		for name, value := range service.Config {
+			stackService.Config[name] = value
+		}
+		for name, value := range instance.Values[service.Service] {
+			stackService.Config[name] = value
+		}
+		for fromPath, toPath := range service.VolumeMounts {
+			stackService.VolumeMounts[fromPath] = toPath
+		}
+		stack.Services = append(stack.Services, stackService)
+	}
+
+	if !s.createStack(w, userId, &stack) {
+		return
+	}
+	glog.V(1).Infof("User %s created stack %s from template %s\n", userId, stack.Id, template.Id)
+	s.maskStackPasswords(userId, &stack, false)
+	w.WriteJson(&stack)
+}
+
+// Values can only be given for parameters, and must be given for required
+// parameters
+func validateInstance(template *api.StackTemplate, instance *api.TemplateInstance) []api.ValidationError {
+	errors := []api.ValidationError{}
+	parameters := map[string]bool{}
+	for _, parameter := range template.Parameters {
+		parameters[parameter.Service+"."+parameter.Name] = true
+		if parameter.Required && instance.Values[parameter.Service][parameter.Name] == "" {
+			errors = append(errors, api.ValidationError{
+				Field:   fmt.Sprintf("values.%s.%s", parameter.Service, parameter.Name),
+				Message: "A value is required",
+			})
+		}
+	}
+	for service, values := range instance.Values {
+		for name := range values {
+			if !parameters[service+"."+name] {
+				errors = append(errors, api.ValidationError{
+					Field:   fmt.Sprintf("values.%s.%s", service, name),
+					Message: "Not a parameter of the template",
+				})
+			}
+		}
+	}
+	return errors
+}
@@ -1,10 +1,14 @@
 package main
 
+import (
+	fsm "github.com/ndslabs/apiserver/fsm"
+)
+
 var stackStatus = map[int]string{
-	Started:  "started",
-	Starting: "starting",
-	Stopped:  "stopped",
-	Stopping: "stopping",
+	Started:  string(fsm.StackStarted),
+	Starting: string(fsm.StackStarting),
+	Stopped:  string(fsm.StackStopped),
+	Stopping: string(fsm.StackStopping),
 }
 
 const (
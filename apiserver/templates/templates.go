@@ -0,0 +1,109 @@
+// Copyright © 2016 National Data Service
+package templates
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+	"text/template"
+)
+
+const randomChars = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// Data is what config value templates can refer to, for example
+// {{ .Deps.postgres.Host }}:{{ .Deps.postgres.Port }}
+type Data struct {
+	Stack     string
+	Name      string
+	Namespace string
+	Domain    string
+	Deps      map[string]Dependency
+}
+
+// Dependency describes a service the templated service depends on. Config
+// holds the dependency's evaluated config values, including passwords.
+type Dependency struct {
+	Host     string
+	Port     int32
+	NodePort int32
+	Config   map[string]string
+}
+
+var funcs = template.FuncMap{
+	"random": Random,
+}
+
+// IsTemplate returns true if the value needs to be evaluated
+func IsTemplate(value string) bool {
+	return strings.Contains(value, "{{")
+}
+
+// Parse checks the template syntax without evaluating it
+func Parse(value string) error {
+	_, err := parse(value, funcs)
+	return err
+}
+
+// Evaluate renders the template. Referring to unknown dependencies or config
+// values is an error. {{ random N }} returns N random lowercase letters and
+// digits, new each time the template is evaluated.
+func Evaluate(value string, data *Data) (string, error) {
+	result, _, err := EvaluateRandom(value, data, nil)
+	return result, err
+}
+
+// EvaluateRandom renders the template like Evaluate, except that the calls
+// to random return the values saved from an earlier evaluation, in order,
+// where their length matches. Returns the random values used, to be saved
+// for the next evaluation.
+func EvaluateRandom(value string, data *Data, saved []string) (string, []string, error) {
+	used := []string{}
+	tmpl, err := parse(value, template.FuncMap{
+		"random": func(n int) (string, error) {
+			i := len(used)
+			if i < len(saved) && len(saved[i]) == n {
+				used = append(used, saved[i])
+				return saved[i], nil
+			}
+			random, err := Random(n)
+			if err != nil {
+				return "", err
+			}
+			used = append(used, random)
+			return random, nil
+		},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", nil, err
+	}
+	return buf.String(), used, nil
+}
+
+func parse(value string, funcs template.FuncMap) (*template.Template, error) {
+	return template.New("config").Funcs(funcs).Option("missingkey=error").Parse(value)
+}
+
+// Random returns n random lowercase letters and digits from crypto/rand
+func Random(n int) (string, error) {
+	if n < 1 || n > 256 {
+		return "", fmt.Errorf("random length must be between 1 and 256")
+	}
+	max := big.NewInt(int64(len(randomChars)))
+	value := make([]byte, n)
+	for i := range value {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		value[i] = randomChars[idx.Int64()]
+	}
+	return string(value), nil
+}
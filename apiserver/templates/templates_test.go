@@ -0,0 +1,80 @@
+package templates
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var testData = &Data{
+	Stack:     "s1abcd",
+	Name:      "My stack",
+	Namespace: "demo",
+	Domain:    "ndslabs.org",
+	Deps: map[string]Dependency{
+		"postgres": {
+			Host:   "10.0.0.5",
+			Port:   5432,
+			Config: map[string]string{"POSTGRES_USER": "admin"},
+		},
+	},
+}
+
+func TestEvaluate(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected string
+	}{
+		{"plain", "plain"},
+		{"{{ .Stack }}.{{ .Namespace }}.{{ .Domain }}", "s1abcd.demo.ndslabs.org"},
+		{"{{ .Deps.postgres.Host }}:{{ .Deps.postgres.Port }}", "10.0.0.5:5432"},
+		{"postgres://{{ .Deps.postgres.Config.POSTGRES_USER }}@db", "postgres://admin@db"},
+	} {
+		actual, err := Evaluate(test.value, testData)
+		if err != nil {
+			t.Errorf("%s: %s", test.value, err)
+		} else if actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.value, test.expected, actual)
+		}
+	}
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	for _, value := range []string{
+		"{{ .Deps.mongo.Host }}",
+		"{{ .Deps.postgres.Config.MISSING }}",
+		"{{ random 0 }}",
+		"{{ .Stack ",
+	} {
+		if _, err := Evaluate(value, testData); err == nil {
+			t.Errorf("%s: expected error", value)
+		}
+	}
+}
+
+func TestRandom(t *testing.T) {
+	first, err := Evaluate("{{ random 16 }}", testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile("^[a-z0-9]{16}$").MatchString(first) {
+		t.Errorf("Unexpected random value %s", first)
+	}
+	second, _ := Evaluate("{{ random 16 }}", testData)
+	if first == second {
+		t.Errorf("Expected different random values")
+	}
+
+	// Saved values are reused while their length matches
+	value, used, err := EvaluateRandom("{{ random 4 }}-{{ random 8 }}", testData, []string{"abcd"})
+	if err != nil || !strings.HasPrefix(value, "abcd-") || len(used) != 2 || used[0] != "abcd" || len(used[1]) != 8 {
+		t.Errorf("Unexpected value %s with %v: %v", value, used, err)
+	}
+	again, _, _ := EvaluateRandom("{{ random 4 }}-{{ random 8 }}", testData, used)
+	if again != value {
+		t.Errorf("Expected %s, got %s", value, again)
+	}
+	if changed, _, _ := EvaluateRandom("{{ random 5 }}", testData, used); len(changed) != 5 {
+		t.Errorf("Expected a new value, got %s", changed)
+	}
+}
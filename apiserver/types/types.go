@@ -21,11 +21,71 @@ type ServiceSpec struct {
 	CreatedTime          int                 `json:"createdTime"`
 	UpdatedTime          int                 `json:"updateTime"`
 	ReadyProbe           ReadyProbe          `json:"readinessProbe"`
+	LiveProbe            ReadyProbe          `json:"livenessProbe"`
 	VolumeMounts         []VolumeMount       `json:"volumeMounts"`
 	ResourceLimits       ResourceLimits      `json:"resourceLimits"`
 	Catalog              string              `json:"catalog"`
 	DeveloperEnvironment string              `json:"developerEnvironment"`
 	Tags                 []string            `json:"tags"`
+	Containers           []Container         `json:"containers,omitempty"`
+	InitContainers       []Container         `json:"initContainers,omitempty"`
+	Provenance           *Provenance         `json:"provenance,omitempty"`
+	Owner                string              `json:"owner,omitempty"`
+	SharedWith           []string            `json:"sharedWith,omitempty"`
+	Status               SpecStatus          `json:"status,omitempty"`
+	ReplacedBy           string              `json:"replacedBy,omitempty"`
+}
+
+// SpecStatus is the lifecycle state of a catalog spec. Drafts can only be
+// used from the owner's catalog, deprecated specs only by stacks that already
+// use them, and stacks using retired specs cannot be started. ReplacedBy
+// points deprecated and retired specs at their successor. An empty status is
+// published.
+type SpecStatus string
+
+const (
+	SpecDraft      SpecStatus = "draft"
+	SpecPublished  SpecStatus = "published"
+	SpecDeprecated SpecStatus = "deprecated"
+	SpecRetired    SpecStatus = "retired"
+)
+
+// SpecLifecycle changes the lifecycle status of a spec
+type SpecLifecycle struct {
+	Status     SpecStatus `json:"status"`
+	ReplacedBy string     `json:"replacedBy,omitempty"`
+}
+
+// Notice tells an account about a catalog change affecting its stacks
+type Notice struct {
+	Id          string   `json:"id"`
+	Message     string   `json:"message"`
+	Service     string   `json:"service"`
+	ReplacedBy  string   `json:"replacedBy,omitempty"`
+	Stacks      []string `json:"stacks"`
+	CreatedTime int      `json:"createdTime"`
+}
+
+// Provenance records where a system catalog spec published from a user
+// catalog came from. Revision counts the publications of the key.
+type Provenance struct {
+	Author        string `json:"author"`
+	Revision      int    `json:"revision"`
+	Curator       string `json:"curator"`
+	PublishedTime int    `json:"publishedTime"`
+}
+
+// Container is an additional container in a service's pod, either a sidecar
+// running alongside the service or an init container run to completion
+// before it starts. Volume mounts refer to the service's volumes by name.
+type Container struct {
+	Name           string         `json:"name"`
+	Image          ServiceImage   `json:"image"`
+	Command        []string       `json:"command,omitempty"`
+	Args           []string       `json:"args,omitempty"`
+	Config         []Config       `json:"config,omitempty"`
+	VolumeMounts   []VolumeMount  `json:"volumeMounts,omitempty"`
+	ResourceLimits ResourceLimits `json:"resourceLimits"`
 }
 
 type ServiceImage struct {
@@ -34,9 +94,15 @@ type ServiceImage struct {
 	Tags     []string `json:"tags"`
 }
 
+// Repository is checked out at Path, which must be in one of the service's
+// volume mounts, before the service's containers start. Ref is the branch,
+// tag or revision, defaulting to the repository's default branch.
 type Repository struct {
-	URL  string         `json:"url"`
-	Type RepositoryType `json:"type"`
+	URL    string           `json:"url"`
+	Type   RepositoryType   `json:"type"`
+	Path   string           `json:"path"`
+	Ref    string           `json:"ref,omitempty"`
+	Update RepositoryUpdate `json:"update,omitempty"`
 }
 
 type ServiceSorter []ServiceSpec
@@ -60,14 +126,49 @@ const (
 	RepositoryHG  RepositoryType = "hg"
 )
 
+// RepositoryUpdate says what happens to an existing checkout when the service
+// starts. By default it is left alone.
+type RepositoryUpdate string
+
+const (
+	RepositoryKeep    RepositoryUpdate = ""
+	RepositoryPull    RepositoryUpdate = "pull"
+	RepositoryReclone RepositoryUpdate = "reclone"
+)
+
+// Config is a service configuration parameter, passed to the service as an
+// environment variable. Min and Max bound int values and the length of other
+// values.
 type Config struct {
-	Name        string `json:"name"`
-	Value       string `json:"value"`
-	Label       string `json:"label"`
-	IsPassword  bool   `json:"isPassword"`
-	CanOverride bool   `json:"canOverride"`
+	Name        string     `json:"name"`
+	Value       string     `json:"value"`
+	Label       string     `json:"label"`
+	IsPassword  bool       `json:"isPassword"`
+	CanOverride bool       `json:"canOverride"`
+	Type        ConfigType `json:"type,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Required    bool       `json:"required,omitempty"`
+	Options     []string   `json:"options,omitempty"`
+	Pattern     string     `json:"pattern,omitempty"`
+	Min         *int       `json:"min,omitempty"`
+	Max         *int       `json:"max,omitempty"`
 }
 
+type ConfigType string
+
+const (
+	ConfigString ConfigType = "string"
+	ConfigInt    ConfigType = "int"
+	ConfigBool   ConfigType = "bool"
+	ConfigEnum   ConfigType = "enum"
+	ConfigURL    ConfigType = "url"
+	ConfigEmail  ConfigType = "email"
+)
+
+// Password config values are returned masked. Sending the mask back leaves
+// the stored value unchanged.
+const PasswordMask = "********"
+
 type Port struct {
 	Port     int32  `json:"port"`
 	Protocol string `json:"protocol"`
@@ -78,12 +179,17 @@ type VolumeMount struct {
 	Name      string `json:"name"`
 }
 
+// ReadyProbe describes a readiness or liveness probe of type http, tcp or exec
 type ReadyProbe struct {
-	Type         string `json:"type"`
-	Path         string `json:"path"`
-	Port         int    `json:"port"`
-	InitialDelay int32  `json:"initialDelay"`
-	Timeout      int32  `json:"timeout"`
+	Type             string   `json:"type"`
+	Path             string   `json:"path"`
+	Port             int      `json:"port"`
+	Command          []string `json:"command,omitempty"`
+	InitialDelay     int32    `json:"initialDelay"`
+	Timeout          int32    `json:"timeout"`
+	Period           int32    `json:"period,omitempty"`
+	FailureThreshold int32    `json:"failureThreshold,omitempty"`
+	SuccessThreshold int32    `json:"successThreshold,omitempty"`
 }
 
 type AccountList struct {
@@ -149,21 +255,55 @@ type ServiceDependency struct {
 	ShareConfig   bool   `json:"shareConfig"`
 }
 
+// In dev mode the developer environment of the stack's service is added to
+// the stack, and stack services may override their spec's command and args.
 type Stack struct {
 	Id          string         `json:"id"`
 	Key         string         `json:"key"`
 	Name        string         `json:"name"`
 	Services    []StackService `json:"services"`
 	Status      string         `json:"status"`
+	DevMode     bool           `json:"devMode,omitempty"`
+	Schedule    *StackSchedule `json:"schedule,omitempty"`
+	StartedTime int            `json:"startedTime,omitempty"`
+	StopReason  string         `json:"stopReason,omitempty"`
 	CreatedTime int            `json:"createdTime"`
 	UpdatedTime int            `json:"updateTime"`
 }
 
+// StackSchedule starts and stops a stack at the times of the cron
+// expressions Start and Stop, in the server's time zone. MaxRuntime stops
+// the stack after it has run for that many seconds. An unset Stop or
+// MaxRuntime uses the server's default.
+type StackSchedule struct {
+	Start      string `json:"start,omitempty"`
+	Stop       string `json:"stop,omitempty"`
+	MaxRuntime int    `json:"maxRuntime,omitempty"`
+}
+
+// StackClone asks for a copy of a stack, named Name or after the stack.
+// Volumes says whether the copy shares the stack's AppData folders, gets
+// copies of them or starts with new ones, the default.
+type StackClone struct {
+	Name    string       `json:"name,omitempty"`
+	Volumes CloneVolumes `json:"volumes,omitempty"`
+}
+
+type CloneVolumes string
+
+const (
+	CloneVolumesShare CloneVolumes = "share"
+	CloneVolumesCopy  CloneVolumes = "copy"
+	CloneVolumesNew   CloneVolumes = "new"
+)
+
 type StackService struct {
 	Id             string            `json:"id"`
 	Stack          string            `json:"stack"`
 	Service        string            `json:"service"`
 	ImageTag       string            `json:"imageTag"`
+	ImageDigest    string            `json:"imageDigest,omitempty"`
+	Restarts       int32             `json:"restarts"`
 	Status         string            `json:"status"`
 	StatusMessages []string          `json:"statusMessages"`
 	Endpoints      []Endpoint        `json:"endpoints,omitempty"`
@@ -171,9 +311,53 @@ type StackService struct {
 	UpdatedTime    int               `json:"updateTime"`
 	Config         map[string]string `json:"config"`
 	VolumeMounts   map[string]string `json:"volumeMounts"`
+	RepositoryRefs map[string]string `json:"repositoryRefs,omitempty"`
+	Command        []string          `json:"command,omitempty"`
+	Args           []string          `json:"args,omitempty"`
 	InternalIP     string            `json:"internalIP"`
 }
 
+// Operation is an asynchronous start, stop or restart of a stack, or of one
+// of its services and those that depend on it, or the update of a running
+// stack. Services show the progress of each stack service while the operation
+// runs and their final status once it completes. Changes are those applied by
+// an update, by stack service id.
+type Operation struct {
+	Id            string                  `json:"id"`
+	Type          OperationType           `json:"type"`
+	Stack         string                  `json:"stack"`
+	StackService  string                  `json:"stackService,omitempty"`
+	Phase         OperationPhase          `json:"phase"`
+	Services      []OperationService      `json:"services"`
+	Changes       map[string][]SpecChange `json:"changes,omitempty"`
+	Error         string                  `json:"error,omitempty"`
+	StartedTime   int                     `json:"startedTime"`
+	CompletedTime int                     `json:"completedTime,omitempty"`
+}
+
+type OperationService struct {
+	Service string `json:"service"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+type OperationType string
+
+const (
+	OperationStart   OperationType = "start"
+	OperationStop    OperationType = "stop"
+	OperationRestart OperationType = "restart"
+	OperationUpdate  OperationType = "update"
+)
+
+type OperationPhase string
+
+const (
+	OperationRunning   OperationPhase = "running"
+	OperationSucceeded OperationPhase = "succeeded"
+	OperationFailed    OperationPhase = "failed"
+)
+
 type Endpoint struct {
 	Host     string `json:"host"`
 	Port     int32  `json:"port"`
@@ -191,3 +375,118 @@ type Term struct {
 	Name       string `json:"name"`
 	Definition string `json:"definition"`
 }
+
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type ValidationResult struct {
+	Valid  bool              `json:"valid"`
+	Errors []ValidationError `json:"errors"`
+}
+
+// StackTemplate is a stack configuration others can create stacks from.
+// Parameters are config values left blank for the user creating the stack.
+// Templates are private to their owner unless shared by link, with Token,
+// or Published in the catalog.
+type StackTemplate struct {
+	Id          string              `json:"id"`
+	Name        string              `json:"name"`
+	Description string              `json:"description,omitempty"`
+	Key         string              `json:"key"`
+	Services    []TemplateService   `json:"services"`
+	Parameters  []TemplateParameter `json:"parameters,omitempty"`
+	Owner       string              `json:"owner"`
+	Token       string              `json:"token,omitempty"`
+	Published   bool                `json:"published"`
+	CreatedTime int                 `json:"createdTime"`
+	UpdatedTime int                 `json:"updateTime"`
+}
+
+// TemplateService holds the settings of a stack service in a template
+type TemplateService struct {
+	Service        string            `json:"service"`
+	ImageTag       string            `json:"imageTag,omitempty"`
+	Config         map[string]string `json:"config,omitempty"`
+	VolumeMounts   map[string]string `json:"volumeMounts,omitempty"`
+	RepositoryRefs map[string]string `json:"repositoryRefs,omitempty"`
+	Command        []string          `json:"command,omitempty"`
+	Args           []string          `json:"args,omitempty"`
+}
+
+// TemplateParameter is a config value of a template service that the user
+// creating a stack from the template fills in
+type TemplateParameter struct {
+	Service     string `json:"service"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+}
+
+// TemplateInstance names the stack created from a template and gives the
+// values of the template's parameters, by service and config name. Token is
+// needed for templates shared by link.
+type TemplateInstance struct {
+	Name   string                       `json:"name,omitempty"`
+	Token  string                       `json:"token,omitempty"`
+	Values map[string]map[string]string `json:"values,omitempty"`
+}
+
+// Publication is a user catalog spec submitted for the system catalog. It is
+// pending until a curator approves or rejects it.
+type Publication struct {
+	Id            string            `json:"id"`
+	Key           string            `json:"key"`
+	Author        string            `json:"author"`
+	Spec          ServiceSpec       `json:"spec"`
+	Status        PublicationStatus `json:"status"`
+	Curator       string            `json:"curator,omitempty"`
+	Comment       string            `json:"comment,omitempty"`
+	SubmittedTime int               `json:"submittedTime"`
+	ReviewedTime  int               `json:"reviewedTime,omitempty"`
+}
+
+type PublicationStatus string
+
+const (
+	PublicationPending  PublicationStatus = "pending"
+	PublicationApproved PublicationStatus = "approved"
+	PublicationRejected PublicationStatus = "rejected"
+)
+
+// SpecChange is a difference between two specs. Field is the JSON path of
+// the changed value, Old and New are absent when the value was added or
+// removed.
+type SpecChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old,omitempty"`
+	New   interface{} `json:"new,omitempty"`
+}
+
+type ServiceGraph struct {
+	Key        string   `json:"key"`
+	Required   []string `json:"required"`
+	Optional   []string `json:"optional"`
+	StartOrder []string `json:"startOrder"`
+	StopOrder  []string `json:"stopOrder"`
+}
+
+type SearchResult struct {
+	Total    int           `json:"total"`
+	Offset   int           `json:"offset"`
+	Limit    int           `json:"limit"`
+	Services []ServiceSpec `json:"services"`
+	Facets   []Facet       `json:"facets"`
+}
+
+type Facet struct {
+	Id    string `json:"id"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type ImportResult struct {
+	Services []ServiceSpec `json:"services"`
+	Warnings []string      `json:"warnings"`
+}
@@ -0,0 +1,513 @@
+// Copyright © 2016 National Data Service
+package validation
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ndslabs/apiserver/cron"
+	"github.com/ndslabs/apiserver/graph"
+	"github.com/ndslabs/apiserver/templates"
+	api "github.com/ndslabs/apiserver/types"
+	"github.com/ndslabs/apiserver/vcs"
+)
+
+// Stack IDs are "s" plus 5 random characters. Kubernetes object names are
+// built as <sid>-<key> and must fit in a 63 character DNS label.
+const MaxKeyLength = 63 - 7
+
+var keyRegexp = regexp.MustCompile("^[a-z]([-a-z0-9]*[a-z0-9])?$")
+var envRegexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// Keys that would be shadowed by fixed routes under /services
+var reservedKeys = map[string]bool{"search": true, "validate": true, "import": true}
+
+// ValidateServiceSpec checks the spec for missing or malformed fields and
+// verifies that its dependencies exist and do not form a cycle.
+func ValidateServiceSpec(spec *api.ServiceSpec, lookup graph.SpecLookup) []api.ValidationError {
+	errors := []api.ValidationError{}
+	addError := func(field string, format string, args ...interface{}) {
+		errors = append(errors, api.ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if spec.Key == "" {
+		addError("key", "Key is required")
+	} else if len(spec.Key) > MaxKeyLength {
+		addError("key", "Key must be no more than %d characters", MaxKeyLength)
+	} else if !keyRegexp.MatchString(spec.Key) {
+		addError("key", "Key must start with a letter and contain only lowercase letters, digits and '-'")
+	} else if reservedKeys[spec.Key] {
+		addError("key", "Key %q is reserved", spec.Key)
+	}
+
+	if spec.Label == "" {
+		addError("label", "Label is required")
+	}
+
+	if spec.Image.Name == "" {
+		addError("image.name", "Image name is required")
+	}
+	if len(spec.Image.Tags) == 0 {
+		addError("image.tags", "At least one image tag is required")
+	}
+	for i, tag := range spec.Image.Tags {
+		if strings.TrimSpace(tag) == "" {
+			addError(fmt.Sprintf("image.tags[%d]", i), "Image tag cannot be empty")
+		}
+	}
+
+	if spec.Access != "" && spec.Access != api.AccessExternal && spec.Access != api.AccessInternal {
+		addError("access", "Access must be %s or %s", api.AccessExternal, api.AccessInternal)
+	}
+
+	// A port number may be used for both TCP and UDP. Probes use TCP.
+	ports := map[int32]bool{}
+	udpPorts := map[int32]bool{}
+	for i, port := range spec.Ports {
+		field := fmt.Sprintf("ports[%d]", i)
+		seen := ports
+		if strings.ToLower(port.Protocol) == "udp" {
+			seen = udpPorts
+		}
+		if port.Port < 1 || port.Port > 65535 {
+			addError(field+".port", "Port %d is out of range", port.Port)
+		} else if seen[port.Port] {
+			addError(field+".port", "Duplicate port %d", port.Port)
+		}
+		seen[port.Port] = true
+	}
+
+	validateProbe("readinessProbe", spec.ReadyProbe, ports, addError)
+	validateProbe("livenessProbe", spec.LiveProbe, ports, addError)
+	if spec.LiveProbe.SuccessThreshold > 1 {
+		addError("livenessProbe.successThreshold", "Success threshold must be 1 for liveness probes")
+	}
+
+	names := map[string]bool{}
+	paths := map[string]bool{}
+	for i, mount := range spec.VolumeMounts {
+		field := fmt.Sprintf("volumeMounts[%d]", i)
+		if mount.Name == "" {
+			addError(field+".name", "Volume mount name is required")
+		} else if mount.Name == "home" {
+			addError(field+".name", "Volume mount name \"home\" is reserved")
+		} else if !keyRegexp.MatchString(mount.Name) {
+			addError(field+".name", "Volume mount name must contain only lowercase letters, digits and '-'")
+		} else if names[mount.Name] {
+			addError(field+".name", "Duplicate volume mount name %s", mount.Name)
+		}
+		names[mount.Name] = true
+
+		if mount.MountPath == "" {
+			addError(field+".mountPath", "Mount path is required")
+		} else if !strings.HasPrefix(mount.MountPath, "/") {
+			addError(field+".mountPath", "Mount path must be absolute")
+		} else if paths[mount.MountPath] {
+			addError(field+".mountPath", "Duplicate mount path %s", mount.MountPath)
+		}
+		paths[mount.MountPath] = true
+	}
+
+	containers := map[string]bool{spec.Key: true}
+	for i := range spec.Repositories {
+		containers[vcs.ContainerName(i)] = true
+	}
+	validateContainers("containers", spec.Containers, containers, names, addError)
+	validateContainers("initContainers", spec.InitContainers, containers, names, addError)
+	validateRepositories(spec, addError)
+
+	configs := map[string]bool{}
+	for i, config := range spec.Config {
+		field := fmt.Sprintf("config[%d]", i)
+		if !envRegexp.MatchString(config.Name) {
+			addError(field+".name", "Config name %q is not a valid environment variable name", config.Name)
+		} else if configs[config.Name] {
+			addError(field+".name", "Duplicate config name %s", config.Name)
+		}
+		configs[config.Name] = true
+		validateConfigDefinition(field, &config, addError)
+	}
+
+	limits := spec.ResourceLimits
+	if limits.CPUMax < 0 || limits.CPUDefault < 0 || limits.MemoryMax < 0 || limits.MemoryDefault < 0 {
+		addError("resourceLimits", "Resource limits cannot be negative")
+	}
+	if limits.CPUMax > 0 && limits.CPUDefault > limits.CPUMax {
+		addError("resourceLimits.cpuDefault", "Default CPU cannot exceed max CPU")
+	}
+	if limits.MemoryMax > 0 && limits.MemoryDefault > limits.MemoryMax {
+		addError("resourceLimits.memDefault", "Default memory cannot exceed max memory")
+	}
+
+	switch spec.Status {
+	case "", api.SpecDraft, api.SpecPublished:
+		if spec.ReplacedBy != "" {
+			addError("replacedBy", "Only deprecated and retired services can be replaced")
+		}
+	case api.SpecDeprecated, api.SpecRetired:
+		if spec.ReplacedBy == "" {
+			break
+		}
+		if spec.ReplacedBy == spec.Key {
+			addError("replacedBy", "Service cannot replace itself")
+		} else if lookup != nil && lookup(spec.ReplacedBy) == nil {
+			addError("replacedBy", "No such service %s", spec.ReplacedBy)
+		}
+	default:
+		addError("status", "Status must be %s, %s, %s or %s", api.SpecDraft, api.SpecPublished, api.SpecDeprecated, api.SpecRetired)
+	}
+
+	deps := map[string]bool{}
+	for i, dep := range spec.Dependencies {
+		field := fmt.Sprintf("depends[%d].key", i)
+		if dep.DependencyKey == "" {
+			addError(field, "Dependency key is required")
+		} else if dep.DependencyKey == spec.Key {
+			addError(field, "Service cannot depend on itself")
+		} else if deps[dep.DependencyKey] {
+			addError(field, "Duplicate dependency %s", dep.DependencyKey)
+		} else if lookup != nil && lookup(dep.DependencyKey) == nil {
+			addError(field, "No such service %s", dep.DependencyKey)
+		}
+		deps[dep.DependencyKey] = true
+	}
+
+	if lookup != nil && spec.Key != "" {
+		// The spec being validated takes the place of any stored spec with the same key
+		withSpec := func(key string) *api.ServiceSpec {
+			if key == spec.Key {
+				return spec
+			}
+			return lookup(key)
+		}
+		if cycle := graph.FindCycle(spec.Key, withSpec); cycle != nil {
+			addError("depends", "Dependency cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	return errors
+}
+
+// ValidateTags checks that the spec's tags are terms in the tags vocabulary.
+// Tags are not checked if there is no vocabulary.
+func ValidateTags(spec *api.ServiceSpec, vocab *api.Vocabulary) []api.ValidationError {
+	errors := []api.ValidationError{}
+	if vocab == nil || len(vocab.Terms) == 0 {
+		return errors
+	}
+
+	terms := map[string]bool{}
+	for _, term := range vocab.Terms {
+		terms[term.Id] = true
+	}
+	for i, tag := range spec.Tags {
+		if !terms[tag] {
+			errors = append(errors, api.ValidationError{
+				Field:   fmt.Sprintf("tags[%d]", i),
+				Message: fmt.Sprintf("Unknown tag %s", tag),
+			})
+		}
+	}
+	return errors
+}
+
+func validateConfigDefinition(field string, config *api.Config, addError func(string, string, ...interface{})) {
+	switch config.Type {
+	case "", api.ConfigString, api.ConfigInt, api.ConfigBool, api.ConfigURL, api.ConfigEmail:
+	case api.ConfigEnum:
+		if len(config.Options) == 0 {
+			addError(field+".options", "Options are required for enum config")
+		}
+	default:
+		addError(field+".type", "Config type must be string, int, bool, enum, url or email")
+		return
+	}
+
+	if config.Pattern != "" {
+		if _, err := regexp.Compile(config.Pattern); err != nil {
+			addError(field+".pattern", "Invalid pattern: %s", err)
+			return
+		}
+	}
+	if config.Min != nil && config.Max != nil && *config.Min > *config.Max {
+		addError(field+".min", "Min cannot exceed max")
+		return
+	}
+	if config.Value != "" {
+		if err := ValidateConfigValue(config, config.Value); err != nil {
+			addError(field+".value", "%s", err)
+		}
+	}
+}
+
+// ValidateConfigValue checks a value against the type and constraints of the
+// config parameter. Requiredness is checked by ValidateStackConfig.
+func ValidateConfigValue(config *api.Config, value string) error {
+	if value == "" {
+		return nil
+	}
+
+	// Templates are checked when they are evaluated at start
+	if templates.IsTemplate(value) {
+		if config.IsPassword {
+			return fmt.Errorf("Value of a password cannot be a template")
+		}
+		if err := templates.Parse(value); err != nil {
+			return fmt.Errorf("Value is not a valid template: %s", err)
+		}
+		return nil
+	}
+
+	length := len(value)
+	switch config.Type {
+	case api.ConfigInt:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("Value %q is not an integer", value)
+		}
+		length = n
+	case api.ConfigBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("Value %q is not true or false", value)
+		}
+	case api.ConfigEnum:
+		found := false
+		for _, option := range config.Options {
+			if option == value {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Value %q must be one of %s", value, strings.Join(config.Options, ", "))
+		}
+	case api.ConfigURL:
+		u, err := url.Parse(value)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("Value %q is not a valid URL", value)
+		}
+	case api.ConfigEmail:
+		if _, err := mail.ParseAddress(value); err != nil || strings.ContainsAny(value, "<> ") {
+			return fmt.Errorf("Value %q is not a valid email address", value)
+		}
+	}
+
+	if config.Type == api.ConfigInt {
+		if config.Min != nil && length < *config.Min {
+			return fmt.Errorf("Value %d is less than %d", length, *config.Min)
+		}
+		if config.Max != nil && length > *config.Max {
+			return fmt.Errorf("Value %d is greater than %d", length, *config.Max)
+		}
+	} else {
+		if config.Min != nil && length < *config.Min {
+			return fmt.Errorf("Value must be at least %d characters", *config.Min)
+		}
+		if config.Max != nil && length > *config.Max {
+			return fmt.Errorf("Value must be no more than %d characters", *config.Max)
+		}
+	}
+
+	if config.Pattern != "" {
+		matched, err := regexp.MatchString("^(?:"+config.Pattern+")$", value)
+		if err != nil || !matched {
+			return fmt.Errorf("Value %q does not match %s", value, config.Pattern)
+		}
+	}
+	return nil
+}
+
+// Available returns an error if the spec cannot be added to a stack. Drafts
+// are only available from the user's own catalog, and deprecated and retired
+// specs are not available at all.
+func Available(spec *api.ServiceSpec) error {
+	var err error
+	switch spec.Status {
+	case api.SpecDraft:
+		if spec.Catalog != "user" {
+			err = fmt.Errorf("Service %s is a draft", spec.Key)
+		}
+	case api.SpecDeprecated, api.SpecRetired:
+		err = fmt.Errorf("Service %s is %s", spec.Key, spec.Status)
+		if spec.ReplacedBy != "" {
+			err = fmt.Errorf("%s, use %s instead", err, spec.ReplacedBy)
+		}
+	}
+	return err
+}
+
+// ValidateStackConfig checks the config values of a stack service against the
+// parameters in its spec. Values for names not in the spec are custom
+// environment variables and are accepted. If required is set, required
+// parameters without a default must have a value.
+func ValidateStackConfig(field string, spec *api.ServiceSpec, values map[string]string, required bool) []api.ValidationError {
+	errors := []api.ValidationError{}
+	for i := range spec.Config {
+		config := &spec.Config[i]
+		value, ok := values[config.Name]
+		configField := field + "." + config.Name
+
+		if config.IsPassword && (value == "" || value == api.PasswordMask) {
+			// Passwords left empty are generated
+			continue
+		}
+		if ok && value != "" && !config.CanOverride && value != config.Value {
+			errors = append(errors, api.ValidationError{Field: configField, Message: "Cannot be overridden"})
+			continue
+		}
+		if !ok || value == "" {
+			value = config.Value
+		}
+		if required && config.Required && value == "" {
+			errors = append(errors, api.ValidationError{Field: configField, Message: "A value is required"})
+			continue
+		}
+		if err := ValidateConfigValue(config, value); err != nil {
+			errors = append(errors, api.ValidationError{Field: configField, Message: err.Error()})
+		}
+	}
+	return errors
+}
+
+// ValidateSchedule checks the cron expressions and maximum runtime of a
+// stack's schedule. A nil schedule is valid.
+func ValidateSchedule(schedule *api.StackSchedule) []api.ValidationError {
+	errors := []api.ValidationError{}
+	if schedule == nil {
+		return errors
+	}
+
+	fields := map[string]string{"schedule.start": schedule.Start, "schedule.stop": schedule.Stop}
+	for _, field := range []string{"schedule.start", "schedule.stop"} {
+		if fields[field] == "" {
+			continue
+		}
+		if _, err := cron.Parse(fields[field]); err != nil {
+			errors = append(errors, api.ValidationError{Field: field, Message: err.Error()})
+		}
+	}
+	if schedule.MaxRuntime < 0 {
+		errors = append(errors, api.ValidationError{Field: "schedule.maxRuntime", Message: "Maximum runtime cannot be negative"})
+	}
+	return errors
+}
+
+// Repositories with a path are checked out into the service's volumes
+func validateRepositories(spec *api.ServiceSpec, addError func(string, string, ...interface{})) {
+	for i, repo := range spec.Repositories {
+		field := fmt.Sprintf("repositories[%d]", i)
+		if repo.URL == "" {
+			addError(field+".url", "Repository URL is required")
+		}
+		if !vcs.Supported(repo.Type) {
+			addError(field+".type", "Repository type must be %s, %s or %s", api.RepositoryGit, api.RepositorySVN, api.RepositoryHG)
+		}
+		if repo.Update != api.RepositoryKeep && repo.Update != api.RepositoryPull && repo.Update != api.RepositoryReclone {
+			addError(field+".update", "Update must be empty, %s or %s", api.RepositoryPull, api.RepositoryReclone)
+		}
+
+		if err := vcs.CheckRef(repo.Ref); err != nil {
+			addError(field+".ref", err.Error())
+		}
+
+		if repo.Path == "" {
+			// Repositories without a path are not checked out
+			continue
+		}
+		found := false
+		for _, mount := range spec.VolumeMounts {
+			if mount.Name != "docker" && (repo.Path == mount.MountPath || strings.HasPrefix(repo.Path, strings.TrimSuffix(mount.MountPath, "/")+"/")) {
+				found = true
+			}
+		}
+		if !found {
+			addError(field+".path", "Repository path must be in one of the service's volume mounts")
+		}
+	}
+}
+
+// Containers share the pod with the service, so their names must be unique
+// and their volume mounts must refer to the service's volumes
+func validateContainers(field string, containers []api.Container, names map[string]bool, volumes map[string]bool, addError func(string, string, ...interface{})) {
+	for i, container := range containers {
+		field := fmt.Sprintf("%s[%d]", field, i)
+		if container.Name == "" {
+			addError(field+".name", "Container name is required")
+		} else if !keyRegexp.MatchString(container.Name) {
+			addError(field+".name", "Container name must start with a letter and contain only lowercase letters, digits and '-'")
+		} else if names[container.Name] {
+			addError(field+".name", "Duplicate container name %s", container.Name)
+		}
+		names[container.Name] = true
+
+		if container.Image.Name == "" {
+			addError(field+".image.name", "Image name is required")
+		}
+
+		for j, config := range container.Config {
+			if !envRegexp.MatchString(config.Name) {
+				addError(fmt.Sprintf("%s.config[%d].name", field, j), "Config name %q is not a valid environment variable name", config.Name)
+			}
+		}
+
+		for j, mount := range container.VolumeMounts {
+			mountField := fmt.Sprintf("%s.volumeMounts[%d]", field, j)
+			if mount.Name != "home" && !volumes[mount.Name] {
+				addError(mountField+".name", "No such volume %s", mount.Name)
+			}
+			if !strings.HasPrefix(mount.MountPath, "/") {
+				addError(mountField+".mountPath", "Mount path must be absolute")
+			}
+		}
+
+		limits := container.ResourceLimits
+		if limits.CPUMax < 0 || limits.CPUDefault < 0 || limits.MemoryMax < 0 || limits.MemoryDefault < 0 {
+			addError(field+".resourceLimits", "Resource limits cannot be negative")
+		}
+	}
+}
+
+func validateProbe(field string, probe api.ReadyProbe, ports map[int32]bool, addError func(string, string, ...interface{})) {
+	if reflect.DeepEqual(probe, api.ReadyProbe{}) {
+		return
+	}
+
+	switch probe.Type {
+	case "http":
+		if probe.Path == "" {
+			addError(field+".path", "Path is required for http probes")
+		}
+	case "tcp":
+	case "exec":
+		if len(probe.Command) == 0 {
+			addError(field+".command", "Command is required for exec probes")
+		}
+	default:
+		addError(field+".type", "Probe type must be http, tcp or exec")
+	}
+
+	if probe.Type != "exec" {
+		if probe.Port < 1 || probe.Port > 65535 {
+			addError(field+".port", "Port %d is out of range", probe.Port)
+		} else if !ports[int32(probe.Port)] {
+			addError(field+".port", "Port %d is not one of the service's TCP ports", probe.Port)
+		}
+	}
+
+	if probe.InitialDelay < 0 {
+		addError(field+".initialDelay", "Initial delay cannot be negative")
+	}
+	if probe.Timeout < 0 {
+		addError(field+".timeout", "Timeout cannot be negative")
+	}
+	if probe.Period < 0 {
+		addError(field+".period", "Period cannot be negative")
+	}
+	if probe.FailureThreshold < 0 || probe.SuccessThreshold < 0 {
+		addError(field, "Thresholds cannot be negative")
+	}
+}
@@ -0,0 +1,286 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ndslabs/apiserver/graph"
+	api "github.com/ndslabs/apiserver/types"
+)
+
+func newSpec(key string, deps ...string) *api.ServiceSpec {
+	spec := &api.ServiceSpec{
+		Key:   key,
+		Label: key,
+		Image: api.ServiceImage{Name: "ndslabs/" + key, Tags: []string{"latest"}},
+	}
+	for _, dep := range deps {
+		spec.Dependencies = append(spec.Dependencies, api.ServiceDependency{DependencyKey: dep, Required: true})
+	}
+	return spec
+}
+
+func catalog(specs ...*api.ServiceSpec) graph.SpecLookup {
+	return func(key string) *api.ServiceSpec {
+		for _, spec := range specs {
+			if spec.Key == key {
+				return spec
+			}
+		}
+		return nil
+	}
+}
+
+func hasError(errors []api.ValidationError, field string) bool {
+	for _, e := range errors {
+		if e.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidSpec(t *testing.T) {
+	spec := newSpec("clowder", "mongo")
+	spec.Ports = []api.Port{{Port: 9000, Protocol: "http"}}
+	spec.ReadyProbe = api.ReadyProbe{Type: "http", Path: "/", Port: 9000}
+	spec.VolumeMounts = []api.VolumeMount{{Name: "data", MountPath: "/data"}}
+
+	errors := ValidateServiceSpec(spec, catalog(newSpec("mongo")))
+	if len(errors) > 0 {
+		t.Errorf("Expected no errors, got %v", errors)
+	}
+}
+
+func TestRequiredFields(t *testing.T) {
+	errors := ValidateServiceSpec(&api.ServiceSpec{}, nil)
+	for _, field := range []string{"key", "label", "image.name", "image.tags"} {
+		if !hasError(errors, field) {
+			t.Errorf("Expected error for %s", field)
+		}
+	}
+}
+
+func TestKeyFormat(t *testing.T) {
+	for _, key := range []string{"Clowder", "my_service", "-dash", "1abc", "search", strings.Repeat("a", MaxKeyLength+1)} {
+		if !hasError(ValidateServiceSpec(newSpec(key), nil), "key") {
+			t.Errorf("Expected key %q to be rejected", key)
+		}
+	}
+}
+
+func TestPortsAndProbe(t *testing.T) {
+	spec := newSpec("web")
+	spec.Ports = []api.Port{{Port: 80}, {Port: 80}, {Port: 70000}, {Port: 53, Protocol: "tcp"}, {Port: 53, Protocol: "udp"}}
+	spec.ReadyProbe = api.ReadyProbe{Type: "http", Port: 8080}
+
+	errors := ValidateServiceSpec(spec, nil)
+	for _, field := range []string{"ports[1].port", "ports[2].port", "readinessProbe.path", "readinessProbe.port"} {
+		if !hasError(errors, field) {
+			t.Errorf("Expected error for %s", field)
+		}
+	}
+	if hasError(errors, "ports[4].port") {
+		t.Errorf("Expected port 53 to be allowed for both TCP and UDP")
+	}
+}
+
+func TestLivenessProbe(t *testing.T) {
+	spec := newSpec("web")
+	spec.LiveProbe = api.ReadyProbe{Type: "exec", SuccessThreshold: 2, Period: -1}
+
+	errors := ValidateServiceSpec(spec, nil)
+	for _, field := range []string{"livenessProbe.command", "livenessProbe.successThreshold", "livenessProbe.period"} {
+		if !hasError(errors, field) {
+			t.Errorf("Expected error for %s", field)
+		}
+	}
+	if hasError(errors, "livenessProbe.port") {
+		t.Errorf("Unexpected port error for exec probe")
+	}
+}
+
+func TestVolumeMounts(t *testing.T) {
+	spec := newSpec("web")
+	spec.VolumeMounts = []api.VolumeMount{
+		{Name: "data", MountPath: "/data"},
+		{Name: "data", MountPath: "relative"},
+		{Name: "home", MountPath: "/data"},
+	}
+
+	errors := ValidateServiceSpec(spec, nil)
+	for _, field := range []string{"volumeMounts[1].name", "volumeMounts[1].mountPath", "volumeMounts[2].name", "volumeMounts[2].mountPath"} {
+		if !hasError(errors, field) {
+			t.Errorf("Expected error for %s", field)
+		}
+	}
+}
+
+func TestMissingDependency(t *testing.T) {
+	errors := ValidateServiceSpec(newSpec("clowder", "mongo"), catalog())
+	if !hasError(errors, "depends[0].key") {
+		t.Errorf("Expected missing dependency error, got %v", errors)
+	}
+}
+
+func TestDependencyCycle(t *testing.T) {
+	// a -> b -> c -> a, with a being updated to close the loop
+	lookup := catalog(newSpec("a"), newSpec("b", "c"), newSpec("c", "a"))
+
+	errors := ValidateServiceSpec(newSpec("a", "b"), lookup)
+	if !hasError(errors, "depends") {
+		t.Fatalf("Expected dependency cycle error, got %v", errors)
+	}
+	for _, e := range errors {
+		if e.Field == "depends" && !strings.Contains(e.Message, "a -> b -> c -> a") {
+			t.Errorf("Unexpected cycle message %s", e.Message)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	spec := newSpec("clowder")
+	spec.Tags = []string{"1", "99"}
+	vocab := &api.Vocabulary{Name: "tags", Terms: []api.Term{{Id: "1", Name: "Database"}}}
+
+	errors := ValidateTags(spec, vocab)
+	if len(errors) != 1 || errors[0].Field != "tags[1]" {
+		t.Errorf("Expected unknown tag error, got %v", errors)
+	}
+	if len(ValidateTags(spec, nil)) > 0 {
+		t.Error("Expected tags to be accepted without a vocabulary")
+	}
+}
+
+func TestContainers(t *testing.T) {
+	spec := newSpec("clowder")
+	spec.VolumeMounts = []api.VolumeMount{{Name: "data", MountPath: "/data"}}
+	spec.Containers = []api.Container{
+		{Name: "logs", Image: api.ServiceImage{Name: "fluentd"}, VolumeMounts: []api.VolumeMount{{Name: "data", MountPath: "/logs"}}},
+		{Name: "clowder", Image: api.ServiceImage{Name: "proxy"}},
+	}
+	spec.InitContainers = []api.Container{
+		{Name: "chown", VolumeMounts: []api.VolumeMount{{Name: "cache", MountPath: "/cache"}}},
+	}
+
+	errors := ValidateServiceSpec(spec, nil)
+	for _, field := range []string{"containers[1].name", "initContainers[0].image.name", "initContainers[0].volumeMounts[0].name"} {
+		if !hasError(errors, field) {
+			t.Errorf("Expected error for %s", field)
+		}
+	}
+	if hasError(errors, "containers[0].name") || hasError(errors, "containers[0].volumeMounts[0].name") {
+		t.Errorf("Unexpected errors %v", errors)
+	}
+}
+
+func TestRepositories(t *testing.T) {
+	spec := newSpec("jupyter")
+	spec.VolumeMounts = []api.VolumeMount{{Name: "notebooks", MountPath: "/notebooks"}}
+	spec.Repositories = []api.Repository{
+		{URL: "https://github.com/nds-org/examples.git", Path: "/notebooks/examples", Update: api.RepositoryPull},
+		{URL: "https://example.org/svn/trunk", Type: api.RepositorySVN, Path: "/src"},
+		{Type: "cvs", Path: "/notebooks", Update: "always"},
+		{URL: "https://github.com/nds-org/docs.git", Ref: "--upload-pack=touch"},
+	}
+	spec.InitContainers = []api.Container{{Name: "repo-0", Image: api.ServiceImage{Name: "busybox"}}}
+
+	errors := ValidateServiceSpec(spec, nil)
+	for _, field := range []string{"repositories[1].path", "repositories[2].url", "repositories[2].type", "repositories[2].update", "repositories[3].ref", "initContainers[0].name"} {
+		if !hasError(errors, field) {
+			t.Errorf("Expected error for %s", field)
+		}
+	}
+	if hasError(errors, "repositories[0].path") || hasError(errors, "repositories[2].path") || hasError(errors, "repositories[3].path") {
+		t.Errorf("Unexpected errors %v", errors)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	spec := newSpec("clowder")
+	spec.Status = api.SpecDeprecated
+	spec.ReplacedBy = "clowder2"
+	if errors := ValidateServiceSpec(spec, catalog(spec)); !hasError(errors, "replacedBy") {
+		t.Errorf("Expected error for missing replacement, got %v", errors)
+	}
+	if errors := ValidateServiceSpec(spec, catalog(spec, newSpec("clowder2"))); len(errors) > 0 {
+		t.Errorf("Unexpected errors %v", errors)
+	}
+	if err := Available(spec); err == nil || !strings.Contains(err.Error(), "use clowder2") {
+		t.Errorf("Expected deprecated spec to be unavailable, got %v", err)
+	}
+
+	spec.Status = api.SpecPublished
+	if errors := ValidateServiceSpec(spec, nil); !hasError(errors, "replacedBy") {
+		t.Errorf("Expected error for replacement of a published spec, got %v", errors)
+	}
+	spec.Status = "archived"
+	if errors := ValidateServiceSpec(spec, nil); !hasError(errors, "status") {
+		t.Errorf("Expected error for unknown status, got %v", errors)
+	}
+
+	// Drafts can only be used from the user's own catalog
+	draft := newSpec("draft")
+	draft.Status = api.SpecDraft
+	draft.Catalog = "user"
+	if err := Available(draft); err != nil {
+		t.Errorf("Expected user draft to be available, got %s", err)
+	}
+	draft.Catalog = "shared"
+	if err := Available(draft); err == nil {
+		t.Error("Expected shared draft to be unavailable")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	min, max := 1, 10
+	spec := newSpec("web")
+	spec.Config = []api.Config{
+		{Name: "WORKERS", Type: api.ConfigInt, Value: "4", Min: &min, Max: &max, CanOverride: true},
+		{Name: "MODE", Type: api.ConfigEnum, Options: []string{"dev", "prod"}, Value: "prod", CanOverride: true},
+		{Name: "ADMIN_EMAIL", Type: api.ConfigEmail, Required: true, CanOverride: true},
+		{Name: "SITE", Type: api.ConfigURL, Value: "http://localhost"},
+		{Name: "CODE", Pattern: "[A-Z]{3}", CanOverride: true},
+		{Name: "DB_PASSWORD", IsPassword: true, Required: true, Pattern: "[a-z0-9]{16}", CanOverride: true},
+	}
+	if errors := ValidateServiceSpec(spec, nil); len(errors) > 0 {
+		t.Fatalf("Expected valid config, got %v", errors)
+	}
+
+	values := map[string]string{
+		"WORKERS":     "20",
+		"MODE":        "test",
+		"ADMIN_EMAIL": "not an address",
+		"SITE":        "http://example.org",
+		"CODE":        "abc",
+		"DB_PASSWORD": "secret",
+		"CUSTOM":      "anything",
+	}
+	errors := ValidateStackConfig("config", spec, values, false)
+	for _, field := range []string{"config.WORKERS", "config.MODE", "config.ADMIN_EMAIL", "config.SITE", "config.CODE", "config.DB_PASSWORD"} {
+		if !hasError(errors, field) {
+			t.Errorf("Expected error for %s", field)
+		}
+	}
+
+	errors = ValidateStackConfig("config", spec, map[string]string{}, true)
+	if len(errors) != 1 || errors[0].Field != "config.ADMIN_EMAIL" {
+		t.Errorf("Expected required error, got %v", errors)
+	}
+
+	// Templates are only checked for syntax until they are evaluated
+	errors = ValidateStackConfig("config", spec, map[string]string{"WORKERS": "{{ .Deps.web.Port }}", "CODE": "{{ .Stack"}, false)
+	if hasError(errors, "config.WORKERS") || !hasError(errors, "config.CODE") {
+		t.Errorf("Unexpected template errors %v", errors)
+	}
+
+	// Masked and empty passwords keep the stored or generated value
+	if hasError(ValidateStackConfig("config", spec, map[string]string{"DB_PASSWORD": api.PasswordMask}, false), "config.DB_PASSWORD") {
+		t.Error("Unexpected error for masked password")
+	}
+
+	spec.Config[0].Value = "zero"
+	if !hasError(ValidateServiceSpec(spec, nil), "config[0].value") {
+		t.Error("Expected error for invalid default")
+	}
+}
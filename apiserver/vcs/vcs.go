@@ -0,0 +1,121 @@
+// Copyright © 2016 National Data Service
+package vcs
+
+import (
+	"fmt"
+	"strings"
+
+	api "github.com/ndslabs/apiserver/types"
+)
+
+// Image runs the checkout scripts. It needs a shell, git, svn and hg.
+var Image = "buildpack-deps:scm"
+
+type commands struct {
+	marker string
+	clone  string
+	update string
+}
+
+// The commands for each repository type, with the repository in $url, the
+// checkout in $dir and the optional ref in $ref
+var vcsCommands = map[api.RepositoryType]commands{
+	api.RepositoryGit: {
+		marker: ".git",
+		clone:  `git clone -q "$url" "$dir" && { [ -z "$ref" ] || git -C "$dir" checkout -q "$ref"; }`,
+		update: `cd "$dir" && git fetch -q --tags origin && { [ -z "$ref" ] || git checkout -q "$ref"; } && { ! git symbolic-ref -q HEAD >/dev/null || git merge -q --ff-only; }`,
+	},
+	api.RepositorySVN: {
+		marker: ".svn",
+		clone:  `svn checkout -q ${ref:+-r "$ref"} "$url" "$dir"`,
+		update: `svn update -q ${ref:+-r "$ref"} "$dir"`,
+	},
+	api.RepositoryHG: {
+		marker: ".hg",
+		clone:  `hg clone -q ${ref:+-u "$ref"} "$url" "$dir"`,
+		update: `hg pull -q -R "$dir" && hg update -q -R "$dir" ${ref:+"$ref"}`,
+	},
+}
+
+// Failures are written to the termination log so Kubernetes reports them in
+// the container status
+const header = `fail() {
+	echo "$1" >&2
+	echo "$1" 2>/dev/null >"${TERMINATION_LOG:-/dev/termination-log}"
+	exit 1
+}
+`
+
+// Supported returns true if the repository type can be checked out. An
+// empty type is git.
+func Supported(repoType api.RepositoryType) bool {
+	_, ok := vcsCommands[repositoryType(repoType)]
+	return ok
+}
+
+// CheckRef returns an error if the ref would be read as an option by the
+// checkout commands
+func CheckRef(ref string) error {
+	if strings.HasPrefix(ref, "-") {
+		return fmt.Errorf("Ref %s cannot start with '-'", ref)
+	}
+	return nil
+}
+
+// Script returns the shell script that checks out the repository at its path.
+// An empty path is cloned into, an existing checkout is kept, pulled or
+// recloned depending on the repository's update setting, and anything else
+// in the way is an error. The ref overrides the repository's ref if set.
+func Script(repo api.Repository, ref string) (string, error) {
+	cmds, ok := vcsCommands[repositoryType(repo.Type)]
+	if !ok {
+		return "", fmt.Errorf("Unsupported repository type %s", repo.Type)
+	}
+	if ref == "" {
+		ref = repo.Ref
+	}
+	if repo.Path == "" {
+		return "", fmt.Errorf("Repository %s has no path", repo.URL)
+	}
+	if err := CheckRef(ref); err != nil {
+		return "", err
+	}
+
+	script := header
+	script += fmt.Sprintf("url=%s\ndir=%s\nref=%s\n", quote(repo.URL), quote(repo.Path), quote(ref))
+	script += "mkdir -p \"$dir\" || fail \"Cannot create $dir\"\n"
+	if repo.Update == api.RepositoryReclone {
+		script += "find \"$dir\" -mindepth 1 -delete || fail \"Cannot remove the checkout in $dir\"\n"
+	}
+
+	script += fmt.Sprintf("if [ -e \"$dir/%s\" ]; then\n", cmds.marker)
+	if repo.Update == api.RepositoryPull {
+		script += fmt.Sprintf("\t( %s ) || fail \"Update of $url in $dir failed\"\n", cmds.update)
+	} else {
+		script += "\techo \"Keeping the checkout in $dir\"\n"
+	}
+	script += "elif [ -n \"$(ls -A \"$dir\")\" ]; then\n"
+	script += "\tfail \"Cannot check out $url, $dir is not empty\"\n"
+	script += "else\n"
+	script += fmt.Sprintf("\t( %s ) || fail \"Checkout of $url into $dir failed\"\n", cmds.clone)
+	script += "fi\n"
+	return script, nil
+}
+
+func repositoryType(repoType api.RepositoryType) api.RepositoryType {
+	if repoType == "" {
+		return api.RepositoryGit
+	}
+	return repoType
+}
+
+// Quote a value for the shell
+func quote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// ContainerName returns the name of the init container checking out the
+// service's i-th repository
+func ContainerName(i int) string {
+	return fmt.Sprintf("repo-%d", i)
+}
@@ -0,0 +1,133 @@
+package vcs
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	api "github.com/ndslabs/apiserver/types"
+)
+
+// Create a git repository with a commit on master and one on the "dev" branch
+func newTestRepository(t *testing.T, dir string) string {
+	origin := filepath.Join(dir, "origin")
+	for _, args := range [][]string{
+		{"init", "-q", origin},
+		{"-C", origin, "checkout", "-q", "-b", "master"},
+		{"-C", origin, "commit", "-q", "--allow-empty", "-m", "first"},
+		{"-C", origin, "checkout", "-q", "-b", "dev"},
+		{"-C", origin, "commit", "-q", "--allow-empty", "-m", "dev"},
+		{"-C", origin, "checkout", "-q", "master"},
+	} {
+		git(t, args...)
+	}
+	return origin
+}
+
+func git(t *testing.T, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.org",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.org")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %s %s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Run the checkout script, returning the termination log on failure
+func run(t *testing.T, repo api.Repository, ref string, log string) error {
+	script, err := Script(repo, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Env = append(os.Environ(), "TERMINATION_LOG="+log)
+	return cmd.Run()
+}
+
+func TestCheckout(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "vcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origin := newTestRepository(t, dir)
+	log := filepath.Join(dir, "termination-log")
+	repo := api.Repository{URL: origin, Path: filepath.Join(dir, "src")}
+	subject := func() string { return git(t, "-C", repo.Path, "log", "-1", "--format=%s") }
+
+	if err := run(t, repo, "", log); err != nil {
+		t.Fatalf("Clone failed: %s", err)
+	}
+	if subject() != "first" {
+		t.Errorf("Expected the default branch, got %s", subject())
+	}
+
+	// Existing checkouts are kept unless updates are enabled
+	git(t, "-C", origin, "commit", "-q", "--allow-empty", "-m", "second")
+	if err := run(t, repo, "", log); err != nil || subject() != "first" {
+		t.Errorf("Expected checkout to be kept, got %s %v", subject(), err)
+	}
+	repo.Update = api.RepositoryPull
+	if err := run(t, repo, "", log); err != nil || subject() != "second" {
+		t.Errorf("Expected checkout to be pulled, got %s %v", subject(), err)
+	}
+
+	// The stack's ref overrides the spec's
+	repo.Ref = "master"
+	repo.Update = api.RepositoryReclone
+	if err := run(t, repo, "dev", log); err != nil || subject() != "dev" {
+		t.Errorf("Expected reclone of dev, got %s %v", subject(), err)
+	}
+}
+
+func TestCheckoutFailure(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "vcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log := filepath.Join(dir, "termination-log")
+	repo := api.Repository{URL: filepath.Join(dir, "missing"), Path: filepath.Join(dir, "src")}
+	if err := run(t, repo, "", log); err == nil {
+		t.Fatal("Expected clone of a missing repository to fail")
+	}
+	message, _ := ioutil.ReadFile(log)
+	if !strings.HasPrefix(string(message), "Checkout of "+repo.URL) {
+		t.Errorf("Unexpected termination message %q", message)
+	}
+
+	ioutil.WriteFile(filepath.Join(repo.Path, "file"), []byte{}, 0644)
+	repo.URL = newTestRepository(t, dir)
+	if err := run(t, repo, "", log); err == nil {
+		t.Fatal("Expected clone into a non-empty directory to fail")
+	}
+	message, _ = ioutil.ReadFile(log)
+	if !strings.Contains(string(message), "is not empty") {
+		t.Errorf("Unexpected termination message %q", message)
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	if !Supported("") || !Supported(api.RepositoryHG) || Supported("cvs") {
+		t.Error("Unexpected supported repository types")
+	}
+	if _, err := Script(api.Repository{Type: "cvs"}, ""); err == nil {
+		t.Error("Expected error for unsupported repository type")
+	}
+	if _, err := Script(api.Repository{URL: "https://github.com/nds-org/docs.git", Path: "/src"}, "-b"); err == nil {
+		t.Error("Expected error for a ref starting with '-'")
+	}
+}
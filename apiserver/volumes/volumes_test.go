@@ -0,0 +1,72 @@
+package volumes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(filepath.Join(src, "data", "empty"), 0750)
+	ioutil.WriteFile(filepath.Join(src, "config"), []byte("config"), 0600)
+	ioutil.WriteFile(filepath.Join(src, "data", "script"), []byte("script"), 0755)
+	os.Symlink("data/script", filepath.Join(src, "link"))
+
+	dst := filepath.Join(dir, "dst")
+	if err := CopyDir(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{"config": "config", "data/script": "script"}
+	for name, expected := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if err != nil || string(data) != expected {
+			t.Errorf("Expected %s to contain %q, got %q %v\n", name, expected, data, err)
+		}
+	}
+
+	modes := map[string]os.FileMode{"config": 0600, "data/script": 0755, "data/empty": 0750}
+	for name, expected := range modes {
+		info, err := os.Stat(filepath.Join(dst, name))
+		if err != nil || info.Mode().Perm() != expected {
+			t.Errorf("Expected %s to have mode %v, got %v %v\n", name, expected, info, err)
+		}
+	}
+
+	link, err := os.Readlink(filepath.Join(dst, "link"))
+	if err != nil || link != "data/script" {
+		t.Errorf("Expected link to data/script, got %q %v\n", link, err)
+	}
+}
+
+func TestCopyDirExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	os.MkdirAll(src, 0755)
+	os.MkdirAll(dst, 0755)
+	ioutil.WriteFile(filepath.Join(src, "config"), []byte("new"), 0644)
+	ioutil.WriteFile(filepath.Join(dst, "config"), []byte("old"), 0644)
+
+	// Files are not overwritten
+	if err := CopyDir(src, dst); err == nil {
+		t.Errorf("Expected copying over an existing file to fail\n")
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dst, "config"))
+	if string(data) != "old" {
+		t.Errorf("Expected the existing file to be kept, got %q\n", data)
+	}
+}